@@ -0,0 +1,87 @@
+// admin.go
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// With ADMIN_SECRET set /map/admin/ serves details about connected clients to
+// requests with it in X-Admin-Secret
+var adminSecret = os.Getenv("ADMIN_SECRET")
+
+// adminAuth lets a request through only with the right X-Admin-Secret
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Secret")), []byte(adminSecret)) != 1 {
+			w.WriteHeader(401)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type clientInfo struct {
+	ID        string `json:"id"`
+	Format    string `json:"format"`
+	Framed    bool   `json:"framed"`
+	Wide      bool   `json:"wide"`
+	Batch     bool   `json:"batch"`
+	Fields    string `json:"fields,omitempty"`
+	Aggregate bool   `json:"aggregate"`
+	Paused    bool   `json:"paused,omitempty"`
+	Detached  bool   `json:"detached,omitempty"`
+	Shared    bool   `json:"shared,omitempty"`
+	Queued    int    `json:"queued"`
+	Dropped   uint64 `json:"dropped"`
+	// Only for clients with max_eps
+	MaxEPS    float64 `json:"max_eps,omitempty"`
+	Rate      float64 `json:"rate,omitempty"`
+	Throttled uint64  `json:"throttled,omitempty"`
+}
+
+// adminClientsHandler lists the connected clients and how many events each
+// has missed because it wasn't keeping up
+func adminClientsHandler(w http.ResponseWriter, r *http.Request) {
+	list := hub.Snapshot()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// info describes client id, called with the hub's lock held
+func (c *client) info(id string, now time.Time) clientInfo {
+	info := clientInfo{
+		ID:        id,
+		Format:    c.format,
+		Framed:    c.framed,
+		Wide:      c.wide,
+		Batch:     c.batch,
+		Fields:    fieldsOf(c),
+		Aggregate: c.aggregate,
+		Paused:    c.paused,
+		Detached:  c.detached,
+		Shared:    c.shared,
+		Queued:    len(c.ch),
+		Dropped:   c.dropped.Load(),
+	}
+	if c.throttle != nil {
+		info.MaxEPS = c.throttle.rate
+		info.Rate = c.throttle.effectiveRate(now)
+		info.Throttled = c.throttled.Load()
+	}
+	return info
+}
+
+// fieldsOf lists what c's messages have in them for formatFields clients
+func fieldsOf(c *client) string {
+	if c.format != formatFields {
+		return ""
+	}
+	return c.fields.String()
+}
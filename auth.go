@@ -0,0 +1,189 @@
+// auth.go
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With CLIENT_TOKENS or CLIENT_TOKENS_FILE set, registering, connecting a
+// websocket, polling and server-sent events need "Authorization: Bearer
+// <token>" with one of them. Browsers can't set headers on websockets or
+// EventSource, so registering also returns a ticket in X-Ticket, good for
+// TICKET_TTL, to pass as ?ticket= instead. Without any tokens everything is
+// open.
+var ticketTTL = envDuration("TICKET_TTL", time.Minute)
+
+var clientTokens []string
+var clientTokens_lock sync.RWMutex
+
+// Signs tickets, new each start since clients don't outlive the server
+var ticketKey = make([]byte, 32)
+
+// Close code for websockets with an expired ticket, in the range left for
+// applications
+const closeTicketExpired = 4001
+
+type authResult int
+
+const (
+	authOK authResult = iota
+	authMissing
+	authExpired
+)
+
+// initAuth reads CLIENT_TOKENS and CLIENT_TOKENS_FILE, one token per line,
+// which is reread on SIGHUP
+func initAuth() error {
+	if ticketTTL <= 0 {
+		return fmt.Errorf("TICKET_TTL must be more than 0")
+	}
+	if _, err := rand.Read(ticketKey); err != nil {
+		return err
+	}
+	return loadClientTokens()
+}
+
+func loadClientTokens() error {
+	entries := strings.Split(os.Getenv("CLIENT_TOKENS"), ",")
+	if file := os.Getenv("CLIENT_TOKENS_FILE"); file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, strings.Split(string(b), "\n")...)
+	}
+
+	var tokens []string
+	for _, t := range entries {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	clientTokens_lock.Lock()
+	clientTokens = tokens
+	clientTokens_lock.Unlock()
+	return nil
+}
+
+// authRequired reports whether clients need a token
+func authRequired() bool {
+	clientTokens_lock.RLock()
+	defer clientTokens_lock.RUnlock()
+	return len(clientTokens) > 0
+}
+
+// hasToken reports whether r has a bearer token that's one of clientTokens
+func hasToken(r *http.Request) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	clientTokens_lock.RLock()
+	defer clientTokens_lock.RUnlock()
+	for _, t := range clientTokens {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// newTicket lets whoever has it connect to id, or with no id open a stream
+// that doesn't have one, until ticketTTL from now. It's the expiry in Unix
+// seconds, a dot and a signature of both.
+func newTicket(id string) string {
+	expires := strconv.FormatInt(time.Now().Add(ticketTTL).Unix(), 10)
+	return expires + "." + signTicket(id, expires)
+}
+
+func signTicket(id, expires string) string {
+	mac := hmac.New(sha256.New, ticketKey)
+	mac.Write([]byte(id + "." + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkTicket checks ticket was made for id
+func checkTicket(ticket, id string) authResult {
+	expires, sig, ok := strings.Cut(ticket, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signTicket(id, expires))) {
+		return authMissing
+	}
+	t, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > t {
+		return authExpired
+	}
+	return authOK
+}
+
+// authorize checks r has a token, or a ticket for id
+func authorize(r *http.Request, id string) authResult {
+	if !authRequired() || hasToken(r) {
+		return authOK
+	}
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		return checkTicket(ticket, id)
+	}
+	return authMissing
+}
+
+// requireAuth answers with 401 and returns false unless r is authorized for
+// id
+func requireAuth(w http.ResponseWriter, r *http.Request, id string) bool {
+	switch authorize(r, id) {
+	case authOK:
+		return true
+	case authExpired:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "ticket expired", 401)
+	default:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", 401)
+	}
+	return false
+}
+
+// requireSocketAuth is requireAuth for websockets. An expired ticket is
+// accepted and closed with closeTicketExpired, since browsers can't see why
+// an upgrade failed.
+func requireSocketAuth(w http.ResponseWriter, r *http.Request, id string) bool {
+	if authorize(r, id) != authExpired {
+		return requireAuth(w, r, id)
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return false
+	}
+	writeClose(conn, closeTicketExpired, "ticket expired")
+	conn.Close()
+	return false
+}
+
+// ticketHandler gives a client with a token a ticket for the id in ?id=, or
+// for streams without one
+func ticketHandler(w http.ResponseWriter, r *http.Request) {
+	if authRequired() && !hasToken(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id != "" {
+		if _, ok := hub.Lookup(id); !ok {
+			unknownID(w, id)
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(newTicket(id)))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// withTokens turns on token auth for a test
+func withTokens(t *testing.T, tokens ...string) {
+	t.Helper()
+	clientTokens_lock.Lock()
+	old := clientTokens
+	clientTokens = tokens
+	clientTokens_lock.Unlock()
+	t.Cleanup(func() {
+		clientTokens_lock.Lock()
+		clientTokens = old
+		clientTokens_lock.Unlock()
+	})
+}
+
+func TestCheckTicket(t *testing.T) {
+	ticket := newTicket("abc")
+	if got := checkTicket(ticket, "abc"); got != authOK {
+		t.Errorf("ticket for abc gave %d", got)
+	}
+	if got := checkTicket(ticket, "def"); got != authMissing {
+		t.Errorf("ticket for abc let def in with %d", got)
+	}
+	if got := checkTicket("123.abc", "abc"); got != authMissing {
+		t.Errorf("made up ticket gave %d", got)
+	}
+	expires := "1"
+	if got := checkTicket(expires+"."+signTicket("abc", expires), "abc"); got != authExpired {
+		t.Errorf("old ticket gave %d", got)
+	}
+}
+
+func TestPollNeedsAuth(t *testing.T) {
+	withTokens(t, "secret")
+	r := mux.NewRouter()
+	r.HandleFunc("/map/poll/{id}", pollHandler)
+
+	tests := []struct {
+		name   string
+		target string
+		token  string
+		want   int
+	}{
+		{"nothing", "/map/poll/abc", "", 401},
+		{"wrong token", "/map/poll/abc", "nope", 401},
+		{"ticket for another id", "/map/poll/abc?ticket=" + newTicket("def"), "", 401},
+		// Past auth to an id that isn't registered
+		{"token", "/map/poll/abc", "secret", 404},
+		{"ticket", "/map/poll/abc?ticket=" + newTicket("abc"), "", 404},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.target, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
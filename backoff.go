@@ -0,0 +1,42 @@
+// backoff.go
+package main
+
+import "time"
+
+// backoff hands out exponentially growing delays for reconnect loops
+type backoff struct {
+	min time.Duration
+	max time.Duration
+	cur time.Duration
+}
+
+func newBackoff() *backoff {
+	return &backoff{min: time.Second, max: time.Minute}
+}
+
+// next returns how long to wait before the next attempt
+func (b *backoff) next() time.Duration {
+	if b.cur == 0 {
+		b.cur = b.min
+	} else if b.cur *= 2; b.cur > b.max {
+		b.cur = b.max
+	}
+	return b.cur
+}
+
+// reset is called after a successful attempt
+func (b *backoff) reset() {
+	b.cur = 0
+}
+
+// sleep waits for the next delay, returning false if done was closed first
+func (b *backoff) sleep(done <-chan struct{}) bool {
+	t := time.NewTimer(b.next())
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
@@ -0,0 +1,108 @@
+// batch.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Clients registered with batch=true get events in batches of up to
+// BATCH_MAX, sent at most BATCH_WINDOW after the first event in the batch,
+// instead of one websocket message each
+var batchWindow = envDuration("BATCH_WINDOW", 100*time.Millisecond)
+var batchMax = envInt("BATCH_MAX", 50)
+
+// initBatch checks the batch settings
+func initBatch() error {
+	if batchWindow <= 0 {
+		return fmt.Errorf("BATCH_WINDOW must be more than 0")
+	}
+	// The count has to fit in the header
+	if batchMax < 1 || batchMax > math.MaxUint16 {
+		return fmt.Errorf("BATCH_MAX must be between 1 and %d", math.MaxUint16)
+	}
+	return nil
+}
+
+// writeBatches sends everything for c to conn in batches of the given format
+// until a write fails or the client goes
+func writeBatches(conn *websocket.Conn, c *client, format string, k *keepalive) error {
+	var batch [][]byte
+	timer := time.NewTimer(batchWindow)
+	timer.Stop()
+	idle := newIdleTimer(c)
+
+	for {
+		select {
+		case msg, ok := <-c.ch:
+			if !ok {
+				// What's waiting still goes, before any close message
+				if len(batch) > 0 {
+					if err := writeMessage(conn, messageType(format), encodeBatch(batch, format)); err != nil {
+						return err
+					}
+				}
+				return errClientRemoved
+			}
+			if len(batch) == 0 {
+				// Quiet times still go out within the window
+				timer.Reset(batchWindow)
+			}
+			batch = append(batch, msg.data)
+			if len(batch) < batchMax {
+				continue
+			}
+			timer.Stop()
+		case <-timer.C:
+		case <-idle.C():
+			if err := writeHeartbeat(conn, c, format); err != nil {
+				return err
+			}
+			idle.reset()
+			continue
+		case <-k.C():
+			if err := k.ping(); err != nil {
+				return err
+			}
+			continue
+		case <-k.Dead():
+			return k.Err()
+		}
+
+		if err := writeMessage(conn, messageType(format), encodeBatch(batch, format)); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		idle.reset()
+	}
+}
+
+// encodeBatch joins messages in the given format into one. Text ones become
+// a JSON array, or one per line for formatText, binary ones a little endian
+// uint16 count followed by each message with its length as a little endian
+// uint16 in front.
+func encodeBatch(msgs [][]byte, format string) []byte {
+	if format == formatText {
+		return bytes.Join(msgs, []byte{'\n'})
+	}
+	if messageFormats[format].text {
+		return append(append([]byte{'['}, bytes.Join(msgs, []byte{','})...), ']')
+	}
+
+	size := 2
+	for _, msg := range msgs {
+		size += 2 + len(msg)
+	}
+	out := make([]byte, 0, size)
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(msgs)))
+	for _, msg := range msgs {
+		out = binary.LittleEndian.AppendUint16(out, uint16(len(msg)))
+		out = append(out, msg...)
+	}
+	return out
+}
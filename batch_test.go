@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"runtime"
+	"runtime/metrics"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+	"github.com/gorilla/websocket"
+)
+
+// A batch client gets every event in batches, even a lone one at a quiet time
+func TestBatchFlushesWhenQuiet(t *testing.T) {
+	url := socketServer(t)
+	conn, _ := dialClient(t, url, "batch=true")
+
+	for _, n := range []int{1, batchMax + 3} {
+		for i := 0; i < n; i++ {
+			hub.Broadcast(event{Distro: 1, Lat: 1, Long: 1, Time: time.Now()})
+		}
+		got := 0
+		conn.SetReadDeadline(time.Now().Add(batchWindow + 2*time.Second))
+		for got < n {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("%d of %d events: %s", got, n, err)
+			}
+			count := int(binary.LittleEndian.Uint16(msg))
+			if typ != websocket.BinaryMessage || count < 1 || count > batchMax {
+				t.Fatalf("got a %d event batch of type %d", count, typ)
+			}
+			// Never a bare event in between
+			if len(msg) != 2+count*(2+parse.LegacySize) {
+				t.Fatalf("%d event batch is %d bytes", count, len(msg))
+			}
+			got += count
+		}
+		if got != n {
+			t.Errorf("got %d events, want %d", got, n)
+		}
+	}
+}
+
+// cpuSeconds is the CPU time used by the process so far. The runtime only
+// adds it up at the end of a GC cycle so it runs one first.
+func cpuSeconds() float64 {
+	runtime.GC()
+	samples := []metrics.Sample{
+		{Name: "/cpu/classes/user:cpu-seconds"},
+		{Name: "/cpu/classes/gc/total:cpu-seconds"},
+	}
+	metrics.Read(samples)
+	return samples[0].Value.Float64() + samples[1].Value.Float64()
+}
+
+// benchmarkBatching sends 1000 events a second to 100 socket clients. The
+// CPU use includes the clients reading.
+func benchmarkBatching(b *testing.B, query string) {
+	const clients, rate = 100, 1000
+	url := socketServer(b)
+	var frames atomic.Int64
+	for i := 0; i < clients; i++ {
+		conn, _ := dialClient(b, url, query)
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+				frames.Add(1)
+			}
+		}()
+	}
+
+	tick := time.NewTicker(time.Second / rate)
+	defer tick.Stop()
+	cpu := cpuSeconds()
+	start := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		<-tick.C
+		hub.Broadcast(event{Distro: 1, Lat: 1, Long: 1, Time: time.Now()})
+	}
+	// The last batches
+	time.Sleep(batchWindow)
+	b.StopTimer()
+	elapsed := time.Since(start).Seconds()
+
+	b.ReportMetric(float64(frames.Load())/elapsed, "frames/s")
+	b.ReportMetric(100*(cpuSeconds()-cpu)/elapsed, "%cpu")
+}
+
+func BenchmarkBatchingOff(b *testing.B) {
+	benchmarkBatching(b, "")
+}
+
+func BenchmarkBatchingOn(b *testing.B) {
+	benchmarkBatching(b, "batch=true")
+}
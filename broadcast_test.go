@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+	"github.com/gorilla/websocket"
+)
+
+// Clients with the same options share one prepared message, clients with
+// different ones each get theirs, and batch clients don't need one
+func TestPreparedPerFormat(t *testing.T) {
+	queries := []string{"", "", "format=json", "format=json&bbox=0,0,10,10", "framed=true", "framed=true&wide=true", "fields=time", "fields=city", "format=json&batch=true"}
+	var clients []*client
+	for _, query := range queries {
+		c := registerClient(t, query)
+		if !c.batch {
+			// Never written to, it only has to be there
+			hub.Update(func() { c.conn = &websocket.Conn{} })
+			t.Cleanup(func() { hub.Update(func() { c.conn = nil }) })
+		}
+		clients = append(clients, c)
+	}
+	ev := event{Distro: 3, Lat: 5, Long: 5, Time: time.UnixMilli(1700000000123), City: "Somewhere"}
+	hub.Broadcast(ev)
+
+	byKey := make(map[string]*websocket.PreparedMessage)
+	seen := make(map[*websocket.PreparedMessage]string)
+	for i, c := range clients {
+		msg := <-c.ch
+		if c.batch {
+			continue
+		}
+		if msg.prepared == nil {
+			t.Errorf("%q got no prepared message", queries[i])
+			continue
+		}
+		if p, ok := byKey[c.key()]; ok && p != msg.prepared {
+			t.Errorf("%q got a prepared message of its own", queries[i])
+		}
+		if key, ok := seen[msg.prepared]; ok && key != c.key() {
+			t.Errorf("%q got the prepared message for %s", queries[i], key)
+		}
+		byKey[c.key()], seen[msg.prepared] = msg.prepared, c.key()
+		ev.Seq = msg.seq
+		if string(msg.data) != string(c.encode(ev)) {
+			t.Errorf("%q got the wrong bytes", queries[i])
+		}
+	}
+	if len(byKey) != 6 {
+		t.Errorf("%d prepared messages for 6 kinds of client", len(byKey))
+	}
+}
+
+// Each websocket gets the prepared message for its own format
+func TestPreparedOverSockets(t *testing.T) {
+	url := socketServer(t)
+	legacy, _ := dialClient(t, url, "")
+	js, _ := dialClient(t, url, "format=json")
+	framed, _ := dialClient(t, url, "framed=true&wide=true")
+	elsewhere, _ := dialClient(t, url, "bbox=-10,-10,-5,-5")
+
+	hub.Broadcast(event{Distro: 300, Lat: 5, Long: 5, Time: time.Now()})
+	hub.Broadcast(event{Distro: 2, Lat: -7, Long: -7, Time: time.Now()})
+	read := func(conn *websocket.Conn) (int, []byte) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		typ, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return typ, msg
+	}
+
+	if typ, msg := read(legacy); typ != websocket.BinaryMessage || len(msg) != parse.LegacySize || msg[0] != parse.DistroOther {
+		t.Errorf("legacy client got %d %x", typ, msg)
+	}
+	if typ, msg := read(js); typ != websocket.TextMessage || !strings.Contains(string(msg), `"id":300`) {
+		t.Errorf("json client got %d %s", typ, msg)
+	}
+	typ, msg := read(framed)
+	if ev, _, err := parse.DecodeFrame(msg); typ != websocket.BinaryMessage || err != nil || ev.Distro != 300 {
+		t.Errorf("wide client got %d %x", typ, msg)
+	}
+	typ, msg = read(elsewhere)
+	if ev, err := parse.DecodeEvent(msg); err != nil || ev.Lat != -7 {
+		t.Errorf("filtered client got %d %x", typ, msg)
+	}
+}
+
+// serverConns opens n websockets to a test server and gives the server's end
+// of each, the other ends read and throw away everything
+func serverConns(b *testing.B, n int) []*websocket.Conn {
+	accepted := make(chan *websocket.Conn, n)
+	up := websocket.Upgrader{EnableCompression: true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := up.Upgrade(w, r, nil); err == nil {
+			accepted <- conn
+		}
+	}))
+	b.Cleanup(srv.Close)
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	var conns []*websocket.Conn
+	for i := 0; i < n; i++ {
+		client, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { client.Close() })
+		go func() {
+			for {
+				_, r, err := client.NextReader()
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, r)
+			}
+		}()
+		conn := <-accepted
+		b.Cleanup(func() { conn.Close() })
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// benchmarkWrites sends one event in format to 500 websockets each time, framed
+// and compressed once when prepared and for every connection when not
+func benchmarkWrites(b *testing.B, format string, prepared bool) {
+	conns := serverConns(b, 500)
+	ev := event{Distro: 12, Lat: 48.1, Long: 11.6, Time: time.Now(), Bytes: 1 << 20, Org: "Example Network Operator", Country: "DE", City: "München"}
+	data := encodeEvent(ev, format)
+
+	cpu := cpuSeconds()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg := message{data: data}
+		if prepared {
+			msg.prepared, _ = websocket.NewPreparedMessage(messageType(format), data)
+		}
+		for _, conn := range conns {
+			if err := writeQueued(conn, format, msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric((cpuSeconds()-cpu)*1e9/float64(b.N), "cpu-ns/op")
+}
+
+func BenchmarkWritesLegacy(b *testing.B)         { benchmarkWrites(b, formatLegacy, false) }
+func BenchmarkWritesLegacyPrepared(b *testing.B) { benchmarkWrites(b, formatLegacy, true) }
+func BenchmarkWritesJSON(b *testing.B)           { benchmarkWrites(b, formatJSON, false) }
+func BenchmarkWritesJSONPrepared(b *testing.B)   { benchmarkWrites(b, formatJSON, true) }
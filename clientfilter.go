@@ -0,0 +1,188 @@
+// clientfilter.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+)
+
+// clientFilter picks the events a client is sent, for clients that asked for
+// less than everything
+type clientFilter struct {
+	// Distro ids to send, nil for all of them
+	distros map[int]bool
+	// South, west, north and east edges of the areas to send events in,
+	// nil for everywhere. West past east crosses the antimeridian.
+	boxes [][4]float64
+	// Fraction of events to send, 0 for all of them
+	sample float64
+}
+
+// newClientFilter checks the options and builds a filter from them, nil if
+// they don't filter anything
+func newClientFilter(distros []string, boxes [][]float64, sample float64) (*clientFilter, error) {
+	f := &clientFilter{}
+	if len(distros) > 0 {
+		f.distros = make(map[int]bool)
+		for _, name := range distros {
+			id, ok := distroID(canonicalDistro(strings.TrimSpace(name)))
+			if !ok {
+				return nil, fmt.Errorf("unknown distro %q", name)
+			}
+			f.distros[id] = true
+		}
+	}
+	for _, bbox := range boxes {
+		if len(bbox) != 4 || bbox[0] < -90 || bbox[2] > 90 || bbox[0] > bbox[2] ||
+			bbox[1] < -180 || bbox[1] > 180 || bbox[3] < -180 || bbox[3] > 180 {
+			return nil, fmt.Errorf("bbox must be south,west,north,east in degrees")
+		}
+		f.boxes = append(f.boxes, [4]float64(bbox))
+	}
+	if sample < 0 || sample > 1 || math.IsNaN(sample) {
+		return nil, fmt.Errorf("sample must be between 0 and 1")
+	}
+	if sample < 1 {
+		f.sample = sample
+	}
+
+	if f.distros == nil && f.boxes == nil && f.sample == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// parseClientFilter reads the distros, bbox and sample options of a request
+func parseClientFilter(get func(string) string) (*clientFilter, error) {
+	var distros []string
+	if s := get("distros"); s != "" {
+		distros = strings.Split(s, ",")
+	}
+	// Boxes are separated by semicolons
+	var boxes [][]float64
+	if s := get("bbox"); s != "" {
+		for _, box := range strings.Split(s, ";") {
+			var bbox []float64
+			for _, part := range strings.Split(box, ",") {
+				v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+				if err != nil {
+					return nil, fmt.Errorf("bbox must be south,west,north,east in degrees")
+				}
+				bbox = append(bbox, v)
+			}
+			boxes = append(boxes, bbox)
+		}
+	}
+	var sample float64
+	if s := get("sample"); s != "" {
+		var err error
+		if sample, err = strconv.ParseFloat(s, 64); err != nil {
+			return nil, fmt.Errorf("sample must be between 0 and 1")
+		}
+	}
+	return newClientFilter(distros, boxes, sample)
+}
+
+// parseSelection reads the options that pick which events a client gets,
+// distros, bbox and sample in the query or a POST form, and max_eps=20 for no
+// more than 20 events a second
+func parseSelection(r *http.Request) (*clientFilter, *throttle, error) {
+	get := r.FormValue
+	// net/url drops any option with a semicolon in it, and that's what boxes
+	// are separated by
+	if strings.Contains(r.URL.RawQuery, ";") {
+		query, _ := url.ParseQuery(strings.ReplaceAll(r.URL.RawQuery, ";", "%3B"))
+		get = func(key string) string {
+			if v := r.FormValue(key); v != "" {
+				return v
+			}
+			return query.Get(key)
+		}
+	}
+	filter, err := parseClientFilter(get)
+	if err != nil {
+		return nil, nil, err
+	}
+	throttle, err := parseThrottle(get("max_eps"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return filter, throttle, nil
+}
+
+// filterData is the data of a filter message from a websocket client, like
+// {"type":"filter","data":{"distros":["archlinux"]}}
+type filterData struct {
+	Distros []string `json:"distros"`
+	// One box as four numbers, or an array of them
+	BBox   json.RawMessage `json:"bbox"`
+	Sample float64         `json:"sample"`
+}
+
+// setFilter replaces the whole filter of c with the one in a filter message,
+// one with no options sends everything
+func setFilter(c *client, data json.RawMessage) error {
+	var d filterData
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &d); err != nil {
+			return err
+		}
+	}
+	var boxes [][]float64
+	if len(d.BBox) > 0 && string(d.BBox) != "null" {
+		var box []float64
+		if err := json.Unmarshal(d.BBox, &box); err == nil {
+			boxes = [][]float64{box}
+		} else if err := json.Unmarshal(d.BBox, &boxes); err != nil {
+			return fmt.Errorf("bbox must be an array of four numbers or of boxes")
+		}
+	}
+	f, err := newClientFilter(d.Distros, boxes, d.Sample)
+	if err != nil {
+		return err
+	}
+	hub.Update(func() { c.filter = f })
+	return nil
+}
+
+// wants reports whether ev should be sent. A nil filter wants everything.
+func (f *clientFilter) wants(ev event) bool {
+	if f == nil {
+		return true
+	}
+	if f.distros != nil && !f.distros[ev.Distro] {
+		return false
+	}
+	if f.boxes != nil && !f.inBoxes(ev) {
+		return false
+	}
+	return f.sample == 0 || rand.Float64() < f.sample
+}
+
+// inBoxes reports whether ev is in any of the filter's boxes, edges included
+func (f *clientFilter) inBoxes(ev event) bool {
+	if ev.Flags&parse.FlagUnlocated != 0 || math.IsNaN(ev.Lat) || math.IsNaN(ev.Long) {
+		return false
+	}
+	for _, b := range f.boxes {
+		if ev.Lat < b[0] || ev.Lat > b[2] {
+			continue
+		}
+		west, east := b[1], b[3]
+		if west <= east && ev.Long >= west && ev.Long <= east {
+			return true
+		}
+		if west > east && (ev.Long >= west || ev.Long <= east) {
+			return true
+		}
+	}
+	return false
+}
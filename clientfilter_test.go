@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+)
+
+// boxFilter parses bbox like the query option
+func boxFilter(t *testing.T, bbox string) *clientFilter {
+	t.Helper()
+	f, err := parseClientFilter(url.Values{"bbox": {bbox}}.Get)
+	if err != nil {
+		t.Fatalf("%s: %s", bbox, err)
+	}
+	return f
+}
+
+func TestBoxEdges(t *testing.T) {
+	// Europe, roughly
+	f := boxFilter(t, "35,-10,70,40")
+	tests := []struct {
+		lat, long float64
+		want      bool
+	}{
+		{48.1, 11.6, true},
+		// Edges and corners are in
+		{35, 0, true},
+		{70, 0, true},
+		{50, -10, true},
+		{50, 40, true},
+		{35, -10, true},
+		{70, 40, true},
+		// Only just out
+		{34.999999, 0, false},
+		{70.000001, 0, false},
+		{50, -10.000001, false},
+		{50, 40.000001, false},
+		{math.NaN(), math.NaN(), false},
+	}
+	for _, tt := range tests {
+		if got := f.wants(event{Lat: tt.lat, Long: tt.long}); got != tt.want {
+			t.Errorf("%v,%v got %v", tt.lat, tt.long, got)
+		}
+	}
+	// Unlocated events are at 0,0 but nowhere really
+	f = boxFilter(t, "-1,-1,1,1")
+	if f.wants(event{Flags: parse.FlagUnlocated}) {
+		t.Error("unlocated event sent")
+	}
+}
+
+func TestBoxAntimeridian(t *testing.T) {
+	tests := []struct {
+		bbox string
+		long float64
+		want bool
+	}{
+		// Fiji to Samoa
+		{"-25,170,-10,-170", 170, true},
+		{"-25,170,-10,-170", 179.9, true},
+		{"-25,170,-10,-170", 180, true},
+		{"-25,170,-10,-170", -180, true},
+		{"-25,170,-10,-170", -170, true},
+		{"-25,170,-10,-170", 169.9, false},
+		{"-25,170,-10,-170", -169.9, false},
+		{"-25,170,-10,-170", 0, false},
+		// Up to the antimeridian from either side
+		{"-25,170,-10,180", -180, false},
+		{"-25,170,-10,180", 180, true},
+		{"-25,-180,-10,-170", -180, true},
+		{"-25,-180,-10,-170", 180, false},
+		// The whole way round
+		{"-25,-180,-10,180", 0, true},
+		{"-25,-180,-10,180", 180, true},
+	}
+	for _, tt := range tests {
+		if got := boxFilter(t, tt.bbox).wants(event{Lat: -17, Long: tt.long}); got != tt.want {
+			t.Errorf("%v in %s got %v", tt.long, tt.bbox, got)
+		}
+	}
+}
+
+func TestBoxErrors(t *testing.T) {
+	for _, bbox := range []string{"1,2,3", "1,2,3,4,5", "10,0,5,1", "-91,0,0,1", "0,0,91,1", "0,-181,1,1", "0,0,1,181", "0,0,1,east", "0,0,1,1;"} {
+		if _, err := parseClientFilter(url.Values{"bbox": {bbox}}.Get); err == nil {
+			t.Errorf("%q parsed", bbox)
+		}
+	}
+}
+
+// Boxes are checked before an event is queued for the client, through
+// registering or a filter message
+func TestBoxesInHub(t *testing.T) {
+	c := registerClient(t, "format=json&bbox=35,-10,70,40;-25,170,-10,-170")
+	inside := []event{{Lat: 48.1, Long: 11.6}, {Lat: -17, Long: 179}, {Lat: 35, Long: -10}}
+	outside := []event{{Lat: 40.7, Long: -74}, {Lat: -17, Long: 160}, {Lat: math.NaN(), Long: math.NaN()}}
+
+	check := func(inside, outside []event) {
+		t.Helper()
+		for _, ev := range append(append([]event(nil), outside...), inside...) {
+			ev.Time = time.Now()
+			hub.Broadcast(ev)
+		}
+		if len(c.ch) != len(inside) {
+			t.Fatalf("%d events queued, want %d", len(c.ch), len(inside))
+		}
+		for _, ev := range inside {
+			var j jsonEvent
+			json.Unmarshal((<-c.ch).data, &j)
+			if j.Lat == nil || *j.Lat != ev.Lat || *j.Lon != ev.Long {
+				t.Errorf("got %v,%v, want %v,%v", j.Lat, j.Lon, ev.Lat, ev.Long)
+			}
+		}
+	}
+	check(inside, outside)
+
+	// Just the Americas now
+	if err := setFilter(c, json.RawMessage(`{"bbox":[[-60,-170,75,-30]]}`)); err != nil {
+		t.Fatal(err)
+	}
+	check(outside[:1], append(inside, outside[1:]...))
+}
@@ -0,0 +1,124 @@
+// clientip.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+)
+
+// How the client address is found in a line, from IP_EXTRACT. "format" uses
+// the ip field of the log format, "field" the IP_FIELD'th whitespace separated
+// field, "regex" the ip group (or whole match) of IP_REGEX and "first" the
+// first thing in the line that parses as an address.
+var ipExtract string
+var ipField int
+var ipRegex *regexp.Regexp
+
+// Every bogon range whatever BOGON_FILTER says, used to find the client in a
+// forwarded chain
+var allBogons []*net.IPNet
+
+func init() {
+	for _, cidrs := range bogonRanges {
+		for _, cidr := range cidrs {
+			_, n, _ := net.ParseCIDR(cidr)
+			allBogons = append(allBogons, n)
+		}
+	}
+}
+
+// initIPExtract reads IP_EXTRACT and the settings that go with it
+func initIPExtract() error {
+	ipExtract = envString("IP_EXTRACT", "format")
+	switch ipExtract {
+	case "format", "first":
+	case "field":
+		ipField = envInt("IP_FIELD", 0)
+		if ipField < 0 {
+			return fmt.Errorf("IP_FIELD can't be negative")
+		}
+	case "regex":
+		pattern := os.Getenv("IP_REGEX")
+		if pattern == "" {
+			return errMissingSetting("IP_REGEX")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid IP_REGEX: %s", err)
+		}
+		ipRegex = re
+	default:
+		return fmt.Errorf("unknown IP_EXTRACT %q", ipExtract)
+	}
+	return nil
+}
+
+// extractIP finds the client address of a line, "" when there isn't one
+func extractIP(line string, fields logFields) string {
+	switch ipExtract {
+	case "field":
+		f := strings.Fields(line)
+		if ipField >= len(f) {
+			return ""
+		}
+		return pickForwarded(strings.Trim(f[ipField], `"`))
+	case "regex":
+		m := ipRegex.FindStringSubmatch(line)
+		if m == nil {
+			return ""
+		}
+		if i := ipRegex.SubexpIndex("ip"); i >= 0 {
+			return pickForwarded(m[i])
+		}
+		return pickForwarded(m[0])
+	case "first":
+		for _, tok := range strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '"' || r == ',' || r == '\t'
+		}) {
+			if parse.ExtractIP(tok) != nil {
+				return tok
+			}
+		}
+		return ""
+	}
+	return pickForwarded(fields.IP)
+}
+
+// pickForwarded takes the client out of an X-Forwarded-For style list, the
+// first public address, or the first valid one if none are public
+func pickForwarded(s string) string {
+	if !strings.Contains(s, ",") {
+		return s
+	}
+
+	first := ""
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		ip := parse.ExtractIP(addr)
+		if ip == nil {
+			continue
+		}
+		if publicIP(ip) {
+			return addr
+		}
+		if first == "" {
+			first = addr
+		}
+	}
+	return first
+}
+
+// publicIP reports whether ip could be a client out on the internet
+func publicIP(ip net.IP) bool {
+	for _, n := range allBogons {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
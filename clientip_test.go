@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// useIPExtract sets up IP_EXTRACT from env until the end of the test
+func useIPExtract(t *testing.T, env map[string]string) error {
+	t.Helper()
+	oldExtract, oldField, oldRegex := ipExtract, ipField, ipRegex
+	t.Cleanup(func() { ipExtract, ipField, ipRegex = oldExtract, oldField, oldRegex })
+	for _, key := range []string{"IP_EXTRACT", "IP_FIELD", "IP_REGEX"} {
+		t.Setenv(key, env[key])
+	}
+	return initIPExtract()
+}
+
+func TestExtractIPStrategies(t *testing.T) {
+	const request = `[15/Oct/2026:10:00:00 +0000] "GET /debian/ HTTP/1.1" 200 1234 "-" "curl/8.0"`
+	tests := []struct {
+		name string
+		env  map[string]string
+		// Parsed with the combined format when the strategy is format
+		line string
+		want string
+	}{
+		{
+			name: "format",
+			line: `203.0.113.9 - - ` + request,
+			want: "203.0.113.9",
+		},
+		{
+			name: "format with a forwarded chain",
+			line: `10.0.0.2, 81.2.69.142, 203.0.113.9 - - ` + request,
+			env:  map[string]string{"LOG_FORMAT_REGEX": `^(?P<ip>.+?) - - \[[^\]]*\] "\S+ (?P<path>\S+)`},
+			want: "81.2.69.142",
+		},
+		{
+			name: "vhost prefix",
+			env:  map[string]string{"IP_EXTRACT": "field", "IP_FIELD": "1"},
+			line: `mirror.example.org 203.0.113.9 - - ` + request,
+			want: "203.0.113.9",
+		},
+		{
+			name: "field with a forwarded chain",
+			env:  map[string]string{"IP_EXTRACT": "field", "IP_FIELD": "1"},
+			line: `mirror.example.org 192.168.1.5,10.1.1.1,81.2.69.142 - - ` + request,
+			want: "81.2.69.142",
+		},
+		{
+			name: "field past the end",
+			env:  map[string]string{"IP_EXTRACT": "field", "IP_FIELD": "40"},
+			line: `203.0.113.9 - - ` + request,
+			want: "",
+		},
+		{
+			name: "regex group",
+			env:  map[string]string{"IP_EXTRACT": "regex", "IP_REGEX": `xff="(?P<ip>[^"]*)"`},
+			line: `203.0.113.9 - - ` + request + ` xff="10.0.0.7, 81.2.69.142"`,
+			want: "81.2.69.142",
+		},
+		{
+			name: "regex whole match",
+			env:  map[string]string{"IP_EXTRACT": "regex", "IP_REGEX": `\d+\.\d+\.\d+\.\d+`},
+			line: `mirror.example.org 203.0.113.9 - - ` + request,
+			want: "203.0.113.9",
+		},
+		{
+			name: "first valid address",
+			env:  map[string]string{"IP_EXTRACT": "first"},
+			line: `mirror.example.org "2001:db8::7" - - ` + request,
+			want: "2001:db8::7",
+		},
+		{
+			name: "only private addresses",
+			env:  map[string]string{"IP_EXTRACT": "field", "IP_FIELD": "0"},
+			line: `10.0.0.1,192.168.0.1 - - ` + request,
+			want: "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := useIPExtract(t, tt.env); err != nil {
+				t.Fatal(err)
+			}
+			env := map[string]string{"LOG_FORMAT": "combined", "LOG_FORMAT_REGEX": tt.env["LOG_FORMAT_REGEX"]}
+			if err := useParser(t, env); err != nil {
+				t.Fatal(err)
+			}
+			fields, ok := parseLine(tt.line)
+			if !ok && ipExtract == "format" {
+				t.Fatal("line didn't match")
+			}
+			if got := extractIP(tt.line, fields); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractIPErrors(t *testing.T) {
+	for _, tt := range []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{"IP_EXTRACT": "last"}, `unknown IP_EXTRACT "last"`},
+		{map[string]string{"IP_EXTRACT": "field", "IP_FIELD": "-1"}, "IP_FIELD can't be negative"},
+		{map[string]string{"IP_EXTRACT": "regex"}, "IP_REGEX"},
+		{map[string]string{"IP_EXTRACT": "regex", "IP_REGEX": `(`}, "invalid IP_REGEX"},
+	} {
+		err := useIPExtract(t, tt.env)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v gave %v, want %q", tt.env, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// config.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Helpers for reading typed settings out of the environment. A value that is
+// set but can't be parsed is a configuration mistake so we refuse to start.
+
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Invalid value for %s %q: %s", key, v, err)
+	}
+	return b
+}
+
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid value for %s %q: %s", key, v, err)
+	}
+	return i
+}
+
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Fatalf("Invalid value for %s %q: %s", key, v, err)
+	}
+	return f
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid value for %s %q: %s", key, v, err)
+	}
+	return d
+}
+
+func errMissingSetting(key string) error {
+	return fmt.Errorf("%s must be set", key)
+}
+
+// reloadOnHangup rereads the files that can change while we're running
+// (the distro list, ignored paths, client tokens, GeoIP overrides and the
+// GeoIP database) on SIGHUP
+func reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := reloadGeoDB(); err != nil {
+			log.Printf("Error reloading the GeoIP database, keeping the old one: %s", err)
+		}
+		if err := initIgnorePaths(); err != nil {
+			log.Printf("Error reloading IGNORE_PATHS, keeping the old list: %s", err)
+		}
+		if err := loadClientTokens(); err != nil {
+			log.Printf("Error reloading CLIENT_TOKENS_FILE, keeping the old tokens: %s", err)
+		}
+		if err := initOverrides(); err != nil {
+			log.Printf("Error reloading GEOIP_OVERRIDES, keeping the old ones: %s", err)
+		}
+		if err := initDistros(); err != nil {
+			log.Printf("Error reloading distros, keeping the old list: %s", err)
+			continue
+		}
+		distros_lock.RLock()
+		log.Printf("Reloaded distros, %d loaded", len(distMap))
+		distros_lock.RUnlock()
+	}
+}
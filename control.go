@@ -0,0 +1,111 @@
+// control.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+	"github.com/gorilla/websocket"
+)
+
+// Kinds of control message, sent to clients registered with control=true
+const (
+	// The distro mapping changed, /map/distros should be fetched again
+	controlDistros byte = iota
+	// Sent first when connecting, see snapshot
+	controlSync
+	// Sent when nothing else has been for a while, see heartbeat
+	controlHeartbeat
+	// Sent after the events a backfill client missed, see writeBackfill
+	controlLive
+)
+
+var controlNames = map[byte]string{
+	controlDistros:   "distros",
+	controlSync:      "sync",
+	controlHeartbeat: "heartbeat",
+	controlLive:      "live",
+}
+
+// sendControl sends a control message of the given kind to every client that
+// asked for them. JSON clients get an object with the kind as its type and
+// data, if there is any, as its data. Framed clients get the magic byte,
+// parse.FrameControl, the kind and data as JSON. Clients that are full miss
+// it like they would an event.
+func sendControl(kind byte, data any) {
+	text := controlMessage(kind, data, false)
+	framed := controlMessage(kind, data, true)
+
+	hub.Range(func(id string, c *client) {
+		if !c.control || c.shared {
+			return
+		}
+		m := framed
+		if !c.framed {
+			m = text
+		}
+		hub.send(id, c, message{data: m})
+	})
+}
+
+// controlMessage builds a control message for a JSON client or, if framed, a
+// framed one
+func controlMessage(kind byte, data any, framed bool) []byte {
+	if !framed {
+		msg, _ := json.Marshal(struct {
+			Type string `json:"type"`
+			Data any    `json:"data,omitempty"`
+		}{controlNames[kind], data})
+		return msg
+	}
+
+	msg := []byte{parse.FrameMagic, parse.FrameControl, kind}
+	if data != nil {
+		payload, _ := json.Marshal(data)
+		msg = append(msg, payload...)
+	}
+	return msg
+}
+
+// clientMessage is a message a websocket client sends, what it's for in op.
+// type works too, so it can be shaped like the JSON control messages it's
+// sent.
+type clientMessage struct {
+	Op   string          `json:"op"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// handleClientMessage acts on a message from websocket client id
+func handleClientMessage(id string, c *client, msg []byte) error {
+	var m clientMessage
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return err
+	}
+	op := m.Op
+	if op == "" {
+		op = m.Type
+	}
+	switch op {
+	case "filter":
+		return setFilter(c, m.Data)
+	case "pause":
+		hub.Update(func() { c.paused = true })
+	case "resume":
+		hub.resume(id, c)
+	default:
+		return fmt.Errorf("unknown message op %q", op)
+	}
+	return nil
+}
+
+// writeControl sends c a control message straight away, on its own in a batch
+// for batch clients
+func writeControl(conn *websocket.Conn, c *client, format string, kind byte, data any) error {
+	msg := controlMessage(kind, data, c.framed)
+	if c.batch {
+		msg = encodeBatch([][]byte{msg}, format)
+	}
+	return writeMessage(conn, messageType(format), msg)
+}
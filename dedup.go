@@ -0,0 +1,117 @@
+// dedup.go
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Lines not plotted because the same address was plotted recently
+var dedupSuppressed = expvar.NewInt("dedup_suppressed")
+
+// The previous IP of each origin, used to avoid sending duplicate data when
+// the dedup cache is turned off. It is keyed by origin so hosts interleaving
+// lines don't defeat it
+var prevIps = make(map[string]string)
+var prevIps_lock sync.Mutex
+
+// dedupCache remembers the addresses plotted within the last ttl, dropping
+// the least recently seen once it holds size of them
+type dedupCache struct {
+	ttl      time.Duration
+	size     int
+	byDistro bool
+
+	lock  sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key  string
+	sent time.Time
+}
+
+// nil when DEDUP_TTL is 0, then only consecutive duplicates are dropped
+var dedup *dedupCache
+
+// initDedup sets up the dedup cache from DEDUP_TTL, DEDUP_SIZE and DEDUP_KEY
+func initDedup() error {
+	ttl := envDuration("DEDUP_TTL", 60*time.Second)
+	size := envInt("DEDUP_SIZE", 10000)
+	if ttl < 0 || size < 1 {
+		return fmt.Errorf("DEDUP_TTL can't be negative and DEDUP_SIZE must be at least 1")
+	}
+	if ttl == 0 {
+		dedup = nil
+		return nil
+	}
+
+	c := &dedupCache{
+		ttl:   ttl,
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+	switch key := envString("DEDUP_KEY", "ip"); key {
+	case "ip":
+	case "ip+distro":
+		c.byDistro = true
+	default:
+		return fmt.Errorf("DEDUP_KEY must be ip or ip+distro, not %q", key)
+	}
+	dedup = c
+	return nil
+}
+
+// isDuplicate reports whether a line from ip for distro shouldn't be plotted
+// because it was already
+func isDuplicate(origin, ip, distro string) bool {
+	ip = anonKey(ip)
+	var dup bool
+	if dedup == nil {
+		prevIps_lock.Lock()
+		dup = ip == prevIps[origin]
+		prevIps[origin] = ip
+		prevIps_lock.Unlock()
+	} else {
+		key := ip
+		if dedup.byDistro {
+			key += " " + distro
+		}
+		dup = dedup.seen(key, time.Now())
+	}
+
+	if dup {
+		dedupSuppressed.Add(1)
+	}
+	return dup
+}
+
+// seen records key as sent at now unless it was already sent within the ttl,
+// in which case it returns true and the original time is kept
+func (c *dedupCache) seen(key string, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*dedupEntry)
+		c.order.MoveToFront(e)
+		if now.Sub(entry.sent) < c.ttl {
+			return true
+		}
+		entry.sent = now
+		return false
+	}
+
+	c.items[key] = c.order.PushFront(&dedupEntry{key: key, sent: now})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*dedupEntry).key)
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+// demo.go
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// Cities demo events are drawn from, weighted roughly by how much traffic a
+// mirror sees from each region
+var demoCities = []struct {
+	lat    float64
+	long   float64
+	weight int
+}{
+	{44.6698, -74.9813, 8},  // Potsdam, NY
+	{40.7128, -74.0060, 10}, // New York
+	{37.7749, -122.4194, 8}, // San Francisco
+	{47.6062, -122.3321, 5}, // Seattle
+	{41.8781, -87.6298, 6},  // Chicago
+	{30.2672, -97.7431, 4},  // Austin
+	{43.6532, -79.3832, 5},  // Toronto
+	{19.4326, -99.1332, 3},  // Mexico City
+	{-23.5505, -46.6333, 4}, // Sao Paulo
+	{51.5074, -0.1278, 7},   // London
+	{52.5200, 13.4050, 7},   // Berlin
+	{48.1351, 11.5820, 5},   // Munich
+	{48.8566, 2.3522, 5},    // Paris
+	{52.3676, 4.9041, 4},    // Amsterdam
+	{59.3293, 18.0686, 3},   // Stockholm
+	{55.7558, 37.6173, 4},   // Moscow
+	{28.6139, 77.2090, 5},   // New Delhi
+	{12.9716, 77.5946, 4},   // Bangalore
+	{39.9042, 116.4074, 5},  // Beijing
+	{35.6762, 139.6503, 6},  // Tokyo
+	{37.5665, 126.9780, 4},  // Seoul
+	{1.3521, 103.8198, 3},   // Singapore
+	{-33.8688, 151.2093, 3}, // Sydney
+	{-33.9249, 18.4241, 2},  // Cape Town
+	{6.5244, 3.3792, 2},     // Lagos
+}
+
+// demoEnabled reports whether DEMO_MODE is on
+func demoEnabled() bool {
+	return envBool("DEMO_MODE", false)
+}
+
+// checkDemoExclusive makes sure demo events can't get mixed in with real ones
+func checkDemoExclusive() error {
+	if os.Getenv("INPUT_SOURCE") != "" || ingestSecret != "" || grpcIngestAddr != "" || upstreamURL != "" {
+		return errors.New("DEMO_MODE can't be combined with a real input source")
+	}
+	for name, isSet := range inputTriggers {
+		if isSet() {
+			return errors.New("DEMO_MODE can't be combined with the " + name + " input source")
+		}
+	}
+	return nil
+}
+
+// demoIn broadcasts made up events at DEMO_RATE events per second, encoded
+// exactly like the ones fileIn sends
+func demoIn() {
+	rate := envInt("DEMO_RATE", 5)
+	if rate <= 0 {
+		rate = 5
+	}
+	log.Printf("Demo mode, generating %d events per second", rate)
+	setIngestState("demo", nil)
+
+	total := 0
+	for _, c := range demoCities {
+		total += c.weight
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	for range ticker.C {
+		pick := rand.Intn(total)
+		for _, c := range demoCities {
+			if pick -= c.weight; pick < 0 {
+				// Spread the dots out a little around each city
+				lat := c.lat + rand.NormFloat64()*0.5
+				long := c.long + rand.NormFloat64()*0.5
+				hub.Broadcast(event{Distro: randomDistro(), Lat: lat, Long: long, Time: time.Now()})
+				break
+			}
+		}
+	}
+}
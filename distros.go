@@ -0,0 +1,426 @@
+// distros.go
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+)
+
+// The distros we mirror when DISTRO_FILE isn't set, their position is the id sent to clients
+var defaultDistros = []string{"almalinux", "alpine", "archlinux", "archlinux32", "artix-linux", "blender", "centos", "clonezilla", "cpan", "cran", "ctan", "cygwin", "debian", "debian-cd", "eclipse", "freebsd", "gentoo", "gentoo-portage", "gparted", "ipfire", "isabelle", "linux", "linuxmint", "manjaro", "msys2", "odroid", "openbsd", "opensuse", "parrot", "raspbian", "RebornOS", "ros", "sabayon", "serenity", "slackware", "slitaz", "tdf", "templeos", "ubuntu", "ubuntu-cdimage", "ubuntu-ports", "ubuntu-releases", "videolan", "voidlinux", "zorinos"}
+
+// The distros currently loaded, distList[id] is the name or "" once it's been
+// removed. distMap is the other way round, hashing a map is quicker than an array
+var distList []string
+var distMap map[string]int
+
+// distMap with lowercased names, for requests that get the case wrong. Names
+// that only differ by case in the list map to -1 since there's no telling
+// which was meant.
+var distFold map[string]int
+var distros_lock sync.RWMutex
+
+// Ids are sent to clients as a uint16 in wide frames, the last one is kept
+// for distros that couldn't be learned. Clients reading one byte ids get
+// parse.DistroOther for anything past 254, so no distro is given that id.
+const maxDistros = 1 << 16
+const distroUnknown = maxDistros - 1
+
+var errUnknownDistro = errors.New("unknown distro")
+
+// With DISTRO_LEARN distros that aren't in the list get an id the first time
+// they're seen, up to DISTRO_LEARN_MAX of them. They're saved to
+// DISTRO_LEARN_FILE so they keep their ids across restarts.
+var distroLearn = envBool("DISTRO_LEARN", false)
+var distroLearnMax = envInt("DISTRO_LEARN_MAX", 64)
+var distroLearnFile = envString("DISTRO_LEARN_FILE", "distros.learned")
+
+// Distros learned so far and their ids, kept across reloads
+var learnedDistros = make(map[string]int)
+var learnedLoaded bool
+
+// Names that look like a distro, anything else is path garbage not worth an id
+var reDistroName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var distrosLearned = expvar.NewInt("distros_learned")
+var distroUnknownLines = expvar.NewInt("distro_unknown")
+
+// Names folded into another distro before anything else sees them, from
+// DISTRO_ALIASES like "archlinux32=archlinux,debian-cd=debian"
+var distroAliases map[string]string
+
+// initDistroAliases parses DISTRO_ALIASES
+func initDistroAliases() error {
+	distroAliases = make(map[string]string)
+	aliases := os.Getenv("DISTRO_ALIASES")
+	if aliases == "" {
+		return nil
+	}
+
+	for _, pair := range strings.Split(aliases, ",") {
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" || from == to {
+			return fmt.Errorf("invalid DISTRO_ALIASES entry %q", pair)
+		}
+		distroAliases[from] = to
+	}
+	for from, to := range distroAliases {
+		if _, ok := distroAliases[to]; ok {
+			return fmt.Errorf("DISTRO_ALIASES maps %s to %s, which is an alias itself", from, to)
+		}
+	}
+	return nil
+}
+
+// canonicalDistro folds an alias into the distro it belongs to
+func canonicalDistro(name string) string {
+	if to, ok := distroAliases[name]; ok {
+		return to
+	}
+	return name
+}
+
+// initDistros loads the distro list, from DISTRO_FILE if it's set, along with
+// any learned ones
+func initDistros() error {
+	names, err := readDistros()
+	if err != nil {
+		return err
+	}
+	if distroAliases == nil {
+		if err := initDistroAliases(); err != nil {
+			return err
+		}
+	}
+	if distroLearn && !learnedLoaded {
+		if err := loadLearnedDistros(); err != nil {
+			return err
+		}
+		learnedLoaded = true
+	}
+	_, before := distrosJSON()
+	if err := applyDistros(names); err != nil {
+		return err
+	}
+	if _, after := distrosJSON(); after != before {
+		sendControl(controlDistros, nil)
+	}
+
+	// Ids of learned distros can move when the list changes
+	if distroLearn {
+		distros_lock.Lock()
+		defer distros_lock.Unlock()
+		return saveLearnedDistros()
+	}
+	return nil
+}
+
+// loadLearnedDistros reads back the ids saved by saveLearnedDistros
+func loadLearnedDistros() error {
+	f, err := os.Open(distroLearnFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var id int
+		var name string
+		if _, err := fmt.Sscan(scanner.Text(), &id, &name); err != nil || id < 0 || id >= distroUnknown {
+			return fmt.Errorf("invalid line in %s: %q", distroLearnFile, scanner.Text())
+		}
+		learnedDistros[name] = id
+	}
+	return scanner.Err()
+}
+
+// saveLearnedDistros writes every learned distro and its id, one per line.
+// Called with distros_lock held.
+func saveLearnedDistros() error {
+	var b strings.Builder
+	for name, id := range learnedDistros {
+		fmt.Fprintf(&b, "%d %s\n", id, name)
+	}
+
+	// Write then rename so a crash can't leave half a file
+	tmp := distroLearnFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, distroLearnFile)
+}
+
+// readDistros reads DISTRO_FILE, one name per line with # comments
+func readDistros() ([]string, error) {
+	path := os.Getenv("DISTRO_FILE")
+	if path == "" {
+		return defaultDistros, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%s has no distros in it", path)
+	}
+	return names, nil
+}
+
+// applyDistros replaces the loaded distros with names. Names that were already
+// loaded keep their id so connected clients keep decoding them correctly, new
+// ones get the next unused id and removed ones stop matching.
+func applyDistros(names []string) error {
+	distros_lock.Lock()
+	defer distros_lock.Unlock()
+
+	list := make([]string, len(distList))
+	ids := make(map[string]int)
+	var added []string
+	for _, name := range names {
+		if _, ok := ids[name]; ok {
+			continue
+		}
+		if id, ok := distMap[name]; ok {
+			list[id] = name
+			ids[name] = id
+			delete(learnedDistros, name)
+		} else {
+			added = append(added, name)
+		}
+	}
+	for _, name := range added {
+		if id, ok := learnedDistros[name]; ok {
+			// It's in the list now so it no longer counts as learned
+			delete(learnedDistros, name)
+			if id < len(list) && list[id] == "" && id != parse.DistroOther {
+				list[id] = name
+				ids[name] = id
+				continue
+			}
+		}
+		list, ids[name] = appendDistro(list, name)
+	}
+
+	// Learned distros go back where they were if nothing took their place
+	learned := make([]string, 0, len(learnedDistros))
+	for name := range learnedDistros {
+		learned = append(learned, name)
+	}
+	sort.Slice(learned, func(i, j int) bool {
+		return learnedDistros[learned[i]] < learnedDistros[learned[j]]
+	})
+	for _, name := range learned {
+		id := learnedDistros[name]
+		for id >= len(list) {
+			list = append(list, "")
+		}
+		if list[id] != "" || id == parse.DistroOther {
+			list, id = appendDistro(list, "")
+		}
+		list[id] = name
+		ids[name] = id
+		learnedDistros[name] = id
+	}
+
+	if len(list) > distroUnknown {
+		return fmt.Errorf("too many distros, ids only go up to %d", distroUnknown-1)
+	}
+
+	if len(list) > parse.DistroOther && len(distList) <= parse.DistroOther {
+		log.Printf("More than %d distros, clients need wide frames to tell the rest apart", parse.DistroOther)
+	}
+
+	distList = list
+	distMap = ids
+	distFold = make(map[string]int)
+	for name, id := range ids {
+		foldDistro(name, id)
+	}
+	return nil
+}
+
+// appendDistro adds name to list with the next id, skipping
+// parse.DistroOther which one byte ids can't tell apart from the ones after it
+func appendDistro(list []string, name string) ([]string, int) {
+	if len(list) == parse.DistroOther {
+		list = append(list, "")
+	}
+	id := len(list)
+	return append(list, name), id
+}
+
+// foldDistro adds a name to distFold, called with distros_lock held
+func foldDistro(name string, id int) {
+	lower := strings.ToLower(name)
+	if other, ok := distFold[lower]; ok && other != id {
+		distFold[lower] = -1
+	} else {
+		distFold[lower] = id
+	}
+}
+
+// lookupDistro finds a distro by its exact name, or failing that ignoring
+// case. Called with distros_lock held.
+func lookupDistro(name string) (int, bool) {
+	if id, ok := distMap[name]; ok {
+		return id, true
+	}
+	if id, ok := distFold[strings.ToLower(name)]; ok && id >= 0 {
+		return id, true
+	}
+	return 0, false
+}
+
+// resolveDistro finds the id for a distro, learning it when DISTRO_LEARN is on
+func resolveDistro(name string) (int, bool) {
+	if id, ok := distroID(name); ok || !distroLearn {
+		return id, ok
+	}
+
+	distros_lock.Lock()
+	defer distros_lock.Unlock()
+	if id, ok := lookupDistro(name); ok {
+		return id, true
+	}
+	if !reDistroName.MatchString(name) || len(learnedDistros) >= distroLearnMax || len(distList) >= distroUnknown {
+		distroUnknownLines.Add(1)
+		return distroUnknown, true
+	}
+
+	var id int
+	distList, id = appendDistro(distList, name)
+	distMap[name] = id
+	foldDistro(name, id)
+	learnedDistros[name] = id
+	distrosLearned.Add(1)
+	log.Printf("Learned new distro %s, id %d", name, id)
+	// Not while holding distros_lock, encoding events takes it
+	go sendControl(controlDistros, nil)
+	if err := saveLearnedDistros(); err != nil {
+		log.Printf("Error saving learned distros: %s", err)
+	}
+	return id, true
+}
+
+// distroID looks up the id sent to clients for a distro
+func distroID(name string) (int, bool) {
+	distros_lock.RLock()
+	id, ok := lookupDistro(name)
+	distros_lock.RUnlock()
+	return id, ok
+}
+
+// distroName finds the name of a distro id for display
+func distroName(id int) string {
+	if id == distroUnknown {
+		return "unknown"
+	}
+	distros_lock.RLock()
+	defer distros_lock.RUnlock()
+	if id < len(distList) && distList[id] != "" {
+		return distList[id]
+	}
+	return strconv.Itoa(id)
+}
+
+// randomDistro picks the id of any loaded distro
+func randomDistro() int {
+	distros_lock.RLock()
+	defer distros_lock.RUnlock()
+	for {
+		id := rand.Intn(len(distList))
+		if _, alias := distroAliases[distList[id]]; distList[id] != "" && !alias {
+			return id
+		}
+	}
+}
+
+// distroEntry is how a distro is listed at /map/distros
+type distroEntry struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// distrosJSON is what distrosHandler sends, with an ETag that changes
+// whenever it does
+func distrosJSON() ([]byte, string) {
+	distros := []distroEntry{}
+	distros_lock.RLock()
+	for id, name := range distList {
+		// Aliases never get sent so there's no point naming them
+		if _, alias := distroAliases[name]; name != "" && !alias {
+			distros = append(distros, distroEntry{id, name})
+		}
+	}
+	distros_lock.RUnlock()
+	if distroLearn {
+		distros = append(distros, distroEntry{distroUnknown, "unknown"})
+	}
+
+	// In id order, unknown being past them all, so the same mapping is the
+	// same bytes
+	body, _ := json.Marshal(distros)
+	sum := sha256.Sum256(body)
+	return body, fmt.Sprintf(`"%x"`, sum[:8])
+}
+
+// etagMatches reports whether an If-None-Match header has etag in it, weak
+// or not
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// distrosHandler sends the id of every loaded distro so clients can name them
+func distrosHandler(w http.ResponseWriter, r *http.Request) {
+	body, etag := distrosJSON()
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(304)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
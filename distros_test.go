@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+)
+
+// useDistros loads names on top of the current distros until the end of the test
+func useDistros(t *testing.T, names ...string) {
+	t.Helper()
+	distros_lock.RLock()
+	oldList, oldMap, oldFold := distList, distMap, distFold
+	distros_lock.RUnlock()
+	t.Cleanup(func() {
+		distros_lock.Lock()
+		distList, distMap, distFold = oldList, oldMap, oldFold
+		distros_lock.Unlock()
+	})
+	if err := applyDistros(append(append([]string(nil), oldList...), names...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Each call gets an address of its own so dedup leaves it alone
+var nextTestIP int
+
+func testIP() string {
+	nextTestIP++
+	return fmt.Sprintf("198.18.%d.%d", nextTestIP/250, 1+nextTestIP%250)
+}
+
+// pathDistro is the distro id a download of path is sent with
+func pathDistro(path string) (int, error) {
+	p, ok, err := prepareLine(Line{Text: logLine(testIP(), path, "200", 1)})
+	if !ok {
+		return -1, err
+	}
+	return p.distro, nil
+}
+
+func TestDistroMatching(t *testing.T) {
+	id := func(name string) int {
+		distros_lock.RLock()
+		defer distros_lock.RUnlock()
+		return distMap[name]
+	}
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/ubuntu/dists/jammy/InRelease", id("ubuntu")},
+		{"/Ubuntu/dists/jammy/InRelease", id("ubuntu")},
+		{"/UBUNTU/ls-lR.gz", id("ubuntu")},
+		{"/archlinux/lastsync?foo=bar", id("archlinux")},
+		{"/archlinux?foo=bar", id("archlinux")},
+		{"/debian./README", id("debian")},
+		{"/Linuxmint#top", id("linuxmint")},
+		// The list's own spelling and any other case
+		{"/RebornOS/repo/x.db", id("RebornOS")},
+		{"/rebornos/repo/x.db", id("RebornOS")},
+		{"/nosuchdistro/x.iso", -1},
+		{"/ubuntux/x.iso", -1},
+	}
+	for _, tt := range tests {
+		before := mapValue(linesSkipped, skipUnknownDistro)
+		got, err := pathDistro(tt.path)
+		if got != tt.want {
+			t.Errorf("%s got id %d, want %d", tt.path, got, tt.want)
+		}
+		if tt.want < 0 {
+			// Counted, never sent as whatever has id 0
+			if err != errUnknownDistro || mapValue(linesSkipped, skipUnknownDistro) != before+1 {
+				t.Errorf("%s wasn't counted as an unknown distro: %v", tt.path, err)
+			}
+		}
+	}
+}
+
+// Names in the list that only differ by case each keep their own id, and a
+// request matching neither exactly can't be placed
+func TestDistroCaseCollision(t *testing.T) {
+	useDistros(t, "rebornos")
+	distros_lock.RLock()
+	upper, lower := distMap["RebornOS"], distMap["rebornos"]
+	distros_lock.RUnlock()
+	if upper == lower {
+		t.Fatal("RebornOS and rebornos have the same id")
+	}
+
+	for path, want := range map[string]int{
+		"/RebornOS/x.db": upper,
+		"/rebornos/x.db": lower,
+		"/REBORNOS/x.db": -1,
+		"/Rebornos/x.db": -1,
+	} {
+		if got, _ := pathDistro(path); got != want {
+			t.Errorf("%s got id %d, want %d", path, got, want)
+		}
+	}
+}
+
+// servedDistros fetches /map/distros, checking it lists every id in order
+// the way events are sent, and gives its ETag
+func servedDistros(t *testing.T) (map[int]string, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	distrosHandler(w, httptest.NewRequest("GET", "/map/distros", nil))
+	var list []distroEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(map[int]string)
+	for i, d := range list {
+		if i > 0 && d.ID <= list[i-1].ID {
+			t.Errorf("%d listed after %d", d.ID, list[i-1].ID)
+		}
+		served[d.ID] = d.Name
+		var j jsonEvent
+		if err := json.Unmarshal(encodeJSON(event{Distro: d.ID, Lat: 1, Long: 1, Time: time.Now()}), &j); err != nil {
+			t.Fatal(err)
+		}
+		if j.ID != d.ID || j.Distro != d.Name {
+			t.Errorf("%d is %s at /map/distros, sent as %d %s", d.ID, d.Name, j.ID, j.Distro)
+		}
+	}
+	distros_lock.RLock()
+	defer distros_lock.RUnlock()
+	for id, name := range distList {
+		if _, alias := distroAliases[name]; name != "" && !alias && served[id] != name {
+			t.Errorf("%s is sent as %d but /map/distros has %q", name, id, served[id])
+		}
+	}
+	return served, w.Header().Get("ETag")
+}
+
+// nextControl waits for a control message for c
+func nextControl(t *testing.T, c *client) string {
+	t.Helper()
+	select {
+	case msg := <-c.ch:
+		var m clientMessage
+		if err := json.Unmarshal(msg.data, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m.Type
+	case <-time.After(5 * time.Second):
+		t.Fatal("no control message")
+		return ""
+	}
+}
+
+// /map/distros follows the mapping events are sent with as it changes, from
+// the file and from learning
+func TestDistrosEndpointFollowsMapping(t *testing.T) {
+	useDistros(t)
+	oldLearn, oldFile, oldLearned := distroLearn, distroLearnFile, learnedDistros
+	t.Cleanup(func() {
+		distroLearn, distroLearnFile, learnedDistros = oldLearn, oldFile, oldLearned
+	})
+	control := registerClient(t, "format=json&control=true")
+
+	_, etag := servedDistros(t)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/map/distros", nil)
+	r.Header.Set("If-None-Match", etag)
+	distrosHandler(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("matching ETag got %d", w.Code)
+	}
+	for _, header := range []string{"W/" + etag, `"other", ` + etag, `W/"other",W/` + etag, "*"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/map/distros", nil)
+		r.Header.Set("If-None-Match", header)
+		distrosHandler(w, r)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match: %s got %d", header, w.Code)
+		}
+	}
+
+	// From DISTRO_FILE, with a new distro at the front. It's added at the end
+	// so the others keep their ids.
+	file := filepath.Join(t.TempDir(), "distros")
+	names := append([]string{"newdistro"}, defaultDistros...)
+	if err := os.WriteFile(file, []byte(strings.Join(names, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DISTRO_FILE", file)
+	if err := initDistros(); err != nil {
+		t.Fatal(err)
+	}
+	if kind := nextControl(t, control); kind != "distros" {
+		t.Errorf("got a %s control message", kind)
+	}
+	served, fileETag := servedDistros(t)
+	newID, _ := distroID("newdistro")
+	if fileETag == etag || served[newID] != "newdistro" || served[0] != defaultDistros[0] {
+		t.Errorf("ETag %s after loading the file, before %s, served %v", fileETag, etag, served)
+	}
+	w = httptest.NewRecorder()
+	distrosHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("old ETag got %d", w.Code)
+	}
+	// Loading the same again changes nothing
+	if err := initDistros(); err != nil {
+		t.Fatal(err)
+	}
+	if len(control.ch) > 0 {
+		t.Error("control message without a change")
+	}
+
+	// Learned
+	distroLearn, distroLearnFile, learnedDistros = true, filepath.Join(t.TempDir(), "learned"), make(map[string]int)
+	id, err := pathDistro("/learneddistro/x.iso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind := nextControl(t, control); kind != "distros" {
+		t.Errorf("got a %s control message", kind)
+	}
+	served, learnETag := servedDistros(t)
+	if learnETag == fileETag || served[id] != "learneddistro" || served[distroUnknown] != "unknown" {
+		t.Errorf("ETag %s after learning, %s before, served %v", learnETag, fileETag, served)
+	}
+}
+
+// With 300 distros, legacy clients get parse.DistroOther for the ones past
+// 254 and wide clients get every id. No distro gets 255 itself.
+func TestWideDistroIDs(t *testing.T) {
+	var names []string
+	distros_lock.RLock()
+	for i := len(distList); i < 300; i++ {
+		names = append(names, fmt.Sprintf("distro%d", i))
+	}
+	distros_lock.RUnlock()
+	useDistros(t, names...)
+	useTestDB(t, testNetwork{"198.18.0.0/15", cityRecord(52.5, 13.4, "DE", "Berlin")})
+	distros_lock.RLock()
+	other, n := distList[parse.DistroOther], len(distList)
+	distros_lock.RUnlock()
+	if other != "" || n != 301 {
+		t.Fatalf("%q has id %d, %d ids in all", other, parse.DistroOther, n)
+	}
+
+	legacy := registerClient(t, "")
+	framed := registerClient(t, "framed=true")
+	wide := registerClient(t, "framed=true&wide=true")
+	js := registerClient(t, "format=json")
+
+	for _, id := range []int{0, 254, 256, 300} {
+		name := distroName(id)
+		readLines(newSliceSource(logLine(testIP(), "/"+name+"/x.iso", "200", 1)))
+
+		ev, err := parse.DecodeEvent((<-legacy.ch).data)
+		want := id
+		if id >= parse.DistroOther {
+			want = parse.DistroOther
+		}
+		if err != nil || ev.Distro != want {
+			t.Errorf("legacy client got %d for %d: %v", ev.Distro, id, err)
+		}
+		ev, _, err = parse.DecodeFrame((<-framed.ch).data)
+		if err != nil || ev.Distro != want {
+			t.Errorf("framed client got %d for %d: %v", ev.Distro, id, err)
+		}
+		ev, _, err = parse.DecodeFrame((<-wide.ch).data)
+		if err != nil || ev.Distro != id {
+			t.Errorf("wide client got %d for %d: %v", ev.Distro, id, err)
+		}
+		var j jsonEvent
+		if err := json.Unmarshal((<-js.ch).data, &j); err != nil || j.ID != id || j.Distro != name {
+			t.Errorf("json client got %d %s for %d %s: %v", j.ID, j.Distro, id, name, err)
+		}
+	}
+}
+
+// Learned distros skip parse.DistroOther too, including ones that had it
+// before it was kept free
+func TestLearnSkipsDistroOther(t *testing.T) {
+	var names []string
+	distros_lock.RLock()
+	for i := len(distList); i < parse.DistroOther; i++ {
+		names = append(names, fmt.Sprintf("distro%d", i))
+	}
+	distros_lock.RUnlock()
+	useDistros(t, names...)
+	oldLearn, oldFile, oldLearned := distroLearn, distroLearnFile, learnedDistros
+	t.Cleanup(func() {
+		distroLearn, distroLearnFile, learnedDistros = oldLearn, oldFile, oldLearned
+	})
+	distroLearn, distroLearnFile, learnedDistros = true, filepath.Join(t.TempDir(), "learned"), make(map[string]int)
+
+	id, err := pathDistro("/learneddistro/x.iso")
+	if err != nil || id != parse.DistroOther+1 {
+		t.Errorf("learned as %d: %v", id, err)
+	}
+
+	learnedDistros = map[string]int{"olddistro": parse.DistroOther}
+	distros_lock.RLock()
+	list := append([]string(nil), distList[:parse.DistroOther]...)
+	distros_lock.RUnlock()
+	if err := applyDistros(list); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := distroID("olddistro"); id == parse.DistroOther {
+		t.Error("learned distro kept its id of 255")
+	}
+	if err := applyDistros(append(list, "olddistro")); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := distroID("olddistro"); id == parse.DistroOther {
+		t.Error("learned distro added to the list kept its id of 255")
+	}
+}
@@ -0,0 +1,74 @@
+// evict.go
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Messages each client can have waiting before it starts missing them.
+// Batch clients get room for at least two batches.
+var clientBuffer = envInt("CLIENT_BUFFER", 10)
+
+// A client that misses EVICT_CONSECUTIVE_DROPS messages in a row, or
+// EVICT_DROPS within EVICT_WINDOW, is disconnected so it can come back and
+// start afresh. 0 turns either off.
+var evictConsecutive = envInt("EVICT_CONSECUTIVE_DROPS", 0)
+var evictDrops = envInt("EVICT_DROPS", 0)
+var evictWindow = envDuration("EVICT_WINDOW", time.Minute)
+
+// Messages missed by every client together and clients disconnected for it
+var clientsDropped = expvar.NewInt("clients_dropped")
+var clientsEvicted = expvar.NewInt("clients_evicted")
+
+// initEvict checks the client buffer and eviction settings
+func initEvict() error {
+	if clientBuffer < 1 {
+		return fmt.Errorf("CLIENT_BUFFER must be at least 1")
+	}
+	if evictConsecutive < 0 || evictDrops < 0 {
+		return fmt.Errorf("EVICT_CONSECUTIVE_DROPS and EVICT_DROPS can't be negative")
+	}
+	if pauseBuffer < 0 || pauseBuffer > clientBuffer {
+		return fmt.Errorf("PAUSE_BUFFER must be between 0 and CLIENT_BUFFER")
+	}
+	if evictDrops > 0 && evictWindow <= 0 {
+		return fmt.Errorf("EVICT_WINDOW must be more than 0")
+	}
+	return nil
+}
+
+// send queues msg for c without waiting. When c is full the message is
+// counted as dropped, and c is removed once it's dropped too many. Called
+// with the lock held for writing.
+func (h *Hub) send(id string, c *client, msg message) {
+	select {
+	case c.ch <- msg:
+		c.streak = 0
+		return
+	default:
+	}
+	if c.detached {
+		// It gets what fits if it reconnects, missing the rest isn't its
+		// fault
+		return
+	}
+	c.dropped.Add(1)
+	clientsDropped.Add(1)
+
+	c.streak++
+	now := time.Now()
+	if now.Sub(c.windowStart) > evictWindow {
+		c.windowStart = now
+		c.windowDrops = 0
+	}
+	c.windowDrops++
+	if (evictConsecutive > 0 && c.streak >= evictConsecutive) || (evictDrops > 0 && c.windowDrops >= evictDrops) {
+		log.Printf("%s isn't keeping up, disconnecting it", id)
+		clientsEvicted.Add(1)
+		c.evicted = true
+		h.remove(id, c)
+	}
+}
@@ -0,0 +1,65 @@
+// Command subscribe prints the events a MirrorMap server sends over gRPC, as
+// a starting point for backends that want them.
+//
+//	go run ./examples/subscribe -addr localhost:9001 -distros debian,ubuntu
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Spud304/MirrorMap/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:9001", "GRPC_SUBSCRIBE_ADDR of the server")
+	token := flag.String("token", "", "GRPC_SUBSCRIBE_TOKEN of the server, if it has one")
+	distros := flag.String("distros", "", "comma separated distros to get, all of them when empty")
+	sample := flag.Float64("sample", 0, "fraction of events to get, 0 for all of them")
+	flag.Parse()
+
+	ctx := context.Background()
+	if *token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+*token)
+	}
+	req := &pb.SubscribeRequest{Sample: *sample}
+	if *distros != "" {
+		req.Distros = strings.Split(*distros, ",")
+	}
+	log.Fatal(run(ctx, *addr, req, os.Stdout))
+}
+
+// run prints the events the server at addr sends for req to out, one per
+// line, until the stream ends
+func run(ctx context.Context, addr string, req *pb.SubscribeRequest, out io.Writer) error {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stream, err := pb.NewEventServiceClient(conn).Subscribe(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if ev.Lat == nil {
+			fmt.Fprintf(out, "%d %s somewhere\n", ev.Seq, ev.Distro)
+			continue
+		}
+		fmt.Fprintf(out, "%d %s %.3f %.3f %s\n", ev.Seq, ev.Distro, ev.GetLat(), ev.GetLon(), ev.Country)
+	}
+}
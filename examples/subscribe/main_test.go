@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Spud304/MirrorMap/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeServer sends events to every subscriber, remembering what it was asked
+// for
+type fakeServer struct {
+	pb.UnimplementedEventServiceServer
+	events []*pb.Event
+	req    *pb.SubscribeRequest
+	auth   []string
+}
+
+func (s *fakeServer) Subscribe(req *pb.SubscribeRequest, stream pb.EventService_SubscribeServer) error {
+	s.req = req
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	s.auth = md.Get("authorization")
+	for _, ev := range s.events {
+		if err := stream.Send(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	fake := &fakeServer{events: []*pb.Event{
+		{Seq: 1, DistroId: 12, Distro: "debian", Lat: proto.Float64(48.1372), Lon: proto.Float64(11.5756), Country: "DE"},
+		{Seq: 2, DistroId: 38, Distro: "ubuntu"},
+	}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	pb.RegisterEventServiceServer(server, fake)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+	var out bytes.Buffer
+	err = run(ctx, l.Addr().String(), &pb.SubscribeRequest{Distros: []string{"debian", "ubuntu"}, Sample: 0.5}, &out)
+	if err != io.EOF {
+		t.Errorf("ended with %v", err)
+	}
+
+	want := "1 debian 48.137 11.576 DE\n2 ubuntu somewhere\n"
+	if out.String() != want {
+		t.Errorf("printed\n%s\nwant\n%s", out.String(), want)
+	}
+	if len(fake.req.GetDistros()) != 2 || fake.req.GetSample() != 0.5 {
+		t.Errorf("asked for %v", fake.req)
+	}
+	if len(fake.auth) != 1 || fake.auth[0] != "Bearer secret" {
+		t.Errorf("sent authorization %v", fake.auth)
+	}
+}
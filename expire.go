@@ -0,0 +1,67 @@
+// expire.go
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Clients that register but don't connect a websocket or poll within
+// REGISTER_TTL are forgotten. 0 keeps them forever.
+var registerTTL = envDuration("REGISTER_TTL", 2*time.Minute)
+
+// Ids forgotten that way and when, kept for another REGISTER_TTL so they can
+// be told apart from ids that never existed
+var expiredIDs = make(map[string]time.Time)
+var expiredIDs_lock sync.Mutex
+
+// expireRegistrations forgets clients that never connected
+func expireRegistrations() {
+	if registerTTL <= 0 {
+		return
+	}
+	for now := range time.Tick(registerTTL / 2) {
+		forgetUnconnected(now)
+	}
+}
+
+// forgetUnconnected removes clients registered more than registerTTL before
+// now that were never connected or polled
+func forgetUnconnected(now time.Time) {
+	var ids []string
+	expired := hub.Evict(func(id string, c *client) bool {
+		if !c.attached && !c.created.IsZero() && now.Sub(c.created) > registerTTL {
+			ids = append(ids, id)
+			return true
+		}
+		return false
+	})
+	expiredIDs_lock.Lock()
+	for _, id := range ids {
+		expiredIDs[id] = now
+	}
+	for id, t := range expiredIDs {
+		if now.Sub(t) > registerTTL {
+			delete(expiredIDs, id)
+		}
+	}
+	expiredIDs_lock.Unlock()
+	if expired > 0 {
+		log.Printf("Forgot %d clients that registered but never connected", expired)
+	}
+}
+
+// unknownID answers a request for a client that isn't registered, with 410
+// if it was and expired
+func unknownID(w http.ResponseWriter, id string) {
+	expiredIDs_lock.Lock()
+	_, expired := expiredIDs[id]
+	expiredIDs_lock.Unlock()
+	if expired {
+		http.Error(w, "id expired, register again", 410)
+		return
+	}
+	http.Error(w, "unknown id", 404)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Registering 10k ids and connecting none of them doesn't leave them around
+func TestUnconnectedExpire(t *testing.T) {
+	url := socketServer(t)
+	before := hub.Len()
+	t.Cleanup(func() {
+		expiredIDs_lock.Lock()
+		expiredIDs = make(map[string]time.Time)
+		expiredIDs_lock.Unlock()
+	})
+
+	var ids []string
+	for i := 0; i < 10000; i++ {
+		w := httptest.NewRecorder()
+		id, _, ok := register(w, httptest.NewRequest("POST", "/register", nil))
+		if !ok {
+			t.Fatalf("registering %d got %d", i, w.Code)
+		}
+		ids = append(ids, id)
+	}
+	// One that connected and one that polled stay
+	conn, connected := dialClient(t, url, "")
+	defer conn.Close()
+	waitFor(t, "connecting", func() bool {
+		var attached bool
+		hub.Update(func() { attached = connected.attached })
+		return attached
+	})
+	pollID, polled := registerID(t, "")
+	hub.Update(func() { polled.attached = true })
+	if hub.Len() != before+10002 {
+		t.Fatalf("%d clients after registering", hub.Len()-before)
+	}
+
+	// Not yet
+	forgetUnconnected(time.Now())
+	if hub.Len() != before+10002 {
+		t.Fatalf("%d clients forgotten before REGISTER_TTL", before+10002-hub.Len())
+	}
+	forgetUnconnected(time.Now().Add(registerTTL + time.Second))
+	if hub.Len() != before+2 {
+		t.Fatalf("%d clients left, want 2", hub.Len()-before)
+	}
+	if _, ok := hub.Lookup(pollID); !ok {
+		t.Error("polling client was forgotten")
+	}
+
+	// Expired ids get told so, until they've been forgotten too
+	_, resp, err := websocket.DefaultDialer.Dial(url+"/"+ids[0], nil)
+	if err != websocket.ErrBadHandshake || resp.StatusCode != http.StatusGone {
+		t.Errorf("expired id got %v", err)
+	}
+	forgetUnconnected(time.Now().Add(3*registerTTL + time.Second))
+	_, resp, err = websocket.DefaultDialer.Dial(url+"/"+ids[0], nil)
+	if err != websocket.ErrBadHandshake || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("long expired id got %v", err)
+	}
+}
+
+// Requests to an id's socket that never get upgraded don't count as
+// connecting
+func TestFailedConnectStillExpires(t *testing.T) {
+	url := socketServer(t)
+	id, c := registerID(t, "")
+
+	resp, err := http.Get("http" + strings.TrimPrefix(url, "ws") + "/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain GET got %d", resp.StatusCode)
+	}
+	_, resp, err = websocket.DefaultDialer.Dial(url+"/"+id+"?format=nosuchformat", nil)
+	if err != websocket.ErrBadHandshake || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown format got %v", err)
+	}
+	var attached bool
+	hub.Update(func() { attached = c.attached })
+	if attached {
+		t.Fatal("counted as connected")
+	}
+
+	t.Cleanup(func() {
+		expiredIDs_lock.Lock()
+		expiredIDs = make(map[string]time.Time)
+		expiredIDs_lock.Unlock()
+	})
+	forgetUnconnected(time.Now().Add(registerTTL + time.Second))
+	if _, ok := hub.Lookup(id); ok {
+		t.Error("id was kept after REGISTER_TTL")
+	}
+}
@@ -0,0 +1,246 @@
+// filter.go
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Lines seen per status code, "unknown" when the status couldn't be read
+var statusCodes = expvar.NewMap("status_codes")
+
+// Lines dropped because of their status code
+var statusFiltered = expvar.NewInt("status_filtered")
+
+// Status codes and classes ("2xx") that get plotted, nil when everything does
+var statusAllow map[string]bool
+
+// Whether lines without a readable status are plotted
+var statusUnknownAllowed bool
+
+// Lines dropped per request method. Methods come straight from the log, so
+// any that aren't standard HTTP ones are counted together as "other".
+var methodDropped = expvar.NewMap("method_dropped")
+
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true,
+	http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true,
+	http.MethodConnect: true, http.MethodOptions: true, http.MethodTrace: true,
+}
+
+// Request methods that get plotted
+var methodAllow map[string]bool
+
+// Lines dropped per category of address that can't be placed on a map
+var bogonDropped = expvar.NewMap("bogon_dropped")
+
+// Addresses that never come from the internet, by category
+var bogonRanges = map[string][]string{
+	"private":     {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+	"loopback":    {"127.0.0.0/8", "::1/128"},
+	"link-local":  {"169.254.0.0/16", "fe80::/10"},
+	"cgnat":       {"100.64.0.0/10"},
+	"multicast":   {"224.0.0.0/4", "ff00::/8"},
+	"unspecified": {"0.0.0.0/8", "::/128"},
+}
+
+type bogonNet struct {
+	category string
+	net      *net.IPNet
+}
+
+// Ranges checked before the geo lookup, empty when BOGON_FILTER is off
+var bogonNets []bogonNet
+
+// Lines dropped because of their path
+var pathsIgnored = expvar.NewInt("paths_ignored")
+
+// Requests that are never downloads, from IGNORE_PATHS. Entries starting with
+// * match the end of the path ("*/" is any directory listing), entries with
+// other wildcards match the whole path and anything else matches the start.
+const defaultIgnorePaths = "/favicon.ico,/robots.txt,/health,/server-status,*/"
+
+var ignorePaths []string
+var ignorePaths_lock sync.RWMutex
+
+// initIgnorePaths reads IGNORE_PATHS and IGNORE_PATHS_FILE, one entry per
+// line, which is reread on SIGHUP
+func initIgnorePaths() error {
+	entries := strings.Split(envString("IGNORE_PATHS", defaultIgnorePaths), ",")
+	if file := os.Getenv("IGNORE_PATHS_FILE"); file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, strings.Split(string(b), "\n")...)
+	}
+
+	var paths []string
+	for _, p := range entries {
+		p = strings.TrimSpace(p)
+		if p == "" || p == "none" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid IGNORE_PATHS entry %q: %s", p, err)
+		}
+		paths = append(paths, p)
+	}
+
+	ignorePaths_lock.Lock()
+	ignorePaths = paths
+	ignorePaths_lock.Unlock()
+	return nil
+}
+
+// pathAllowed reports whether a request path could be a download
+func pathAllowed(p string) bool {
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+
+	ignorePaths_lock.RLock()
+	defer ignorePaths_lock.RUnlock()
+	for _, ignore := range ignorePaths {
+		var match bool
+		switch {
+		case strings.HasPrefix(ignore, "*"):
+			match = strings.HasSuffix(p, ignore[1:])
+		case strings.ContainsAny(ignore, "*?["):
+			match, _ = path.Match(ignore, p)
+		default:
+			match = strings.HasPrefix(p, ignore)
+		}
+		if match {
+			pathsIgnored.Add(1)
+			return false
+		}
+	}
+	return true
+}
+
+// initFilters reads the settings deciding which lines are worth plotting
+func initFilters() error {
+	allow := envString("STATUS_ALLOW", "2xx")
+	if allow == "all" {
+		statusAllow = nil
+	} else {
+		statusAllow = make(map[string]bool)
+		for _, s := range strings.Split(allow, ",") {
+			s = strings.ToLower(strings.TrimSpace(s))
+			if len(s) != 3 || s[0] < '1' || s[0] > '5' {
+				return fmt.Errorf("invalid STATUS_ALLOW entry %q", s)
+			}
+			statusAllow[s] = true
+		}
+	}
+
+	switch os.Getenv("STATUS_UNKNOWN") {
+	case "", "include":
+		statusUnknownAllowed = true
+	case "exclude":
+		statusUnknownAllowed = false
+	default:
+		return fmt.Errorf("STATUS_UNKNOWN must be include or exclude")
+	}
+
+	// Monitoring HEADs and the like aren't downloads
+	methodAllow = make(map[string]bool)
+	for _, m := range strings.Split(envString("METHOD_ALLOW", "GET"), ",") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m == "" {
+			return fmt.Errorf("empty METHOD_ALLOW entry")
+		}
+		methodAllow[m] = true
+	}
+
+	bogonNets = nil
+	if envBool("BOGON_FILTER", true) {
+		for category, cidrs := range bogonRanges {
+			for _, cidr := range cidrs {
+				_, n, _ := net.ParseCIDR(cidr)
+				bogonNets = append(bogonNets, bogonNet{category, n})
+			}
+		}
+	}
+	// Our own monitoring and the like, filtered even with BOGON_FILTER off
+	if ignore := os.Getenv("IGNORE_CIDRS"); ignore != "" {
+		for _, cidr := range strings.Split(ignore, ",") {
+			_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return fmt.Errorf("invalid IGNORE_CIDRS entry: %s", err)
+			}
+			bogonNets = append(bogonNets, bogonNet{"ignored", n})
+		}
+	}
+
+	if err := initIgnorePaths(); err != nil {
+		return err
+	}
+	if err := initSampling(); err != nil {
+		return err
+	}
+	return initDedup()
+}
+
+// validStatus checks a status is three digits, as every HTTP status is
+func validStatus(status string) bool {
+	if len(status) != 3 {
+		return false
+	}
+	for i := 0; i < 3; i++ {
+		if status[i] < '0' || status[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// statusAllowed counts the status of a line and reports whether it should be plotted
+func statusAllowed(status string) bool {
+	if !validStatus(status) {
+		statusCodes.Add("unknown", 1)
+		if !statusUnknownAllowed {
+			statusFiltered.Add(1)
+			return false
+		}
+		return true
+	}
+
+	statusCodes.Add(status, 1)
+	if statusAllow == nil || statusAllow[status] || statusAllow[status[:1]+"xx"] {
+		return true
+	}
+	statusFiltered.Add(1)
+	return false
+}
+
+// methodAllowed reports whether a line with this request method should be
+// plotted. Formats that don't record the method let everything through.
+func methodAllowed(method string) bool {
+	if method == "" || methodAllow[method] {
+		return true
+	}
+	if !knownMethods[method] {
+		method = "other"
+	}
+	methodDropped.Add(method, 1)
+	return false
+}
+
+// addressAllowed reports whether ip could be a real client somewhere on the map
+func addressAllowed(ip net.IP) bool {
+	for _, b := range bogonNets {
+		if b.net.Contains(ip) {
+			bogonDropped.Add(b.category, 1)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMethodDroppedKeys(t *testing.T) {
+	head, other := mapValue(methodDropped, "HEAD"), mapValue(methodDropped, "other")
+	for _, m := range []string{"GET", "", "HEAD", "FOO", strings.Repeat("X", 50), "head"} {
+		methodAllowed(m)
+	}
+	if got := mapValue(methodDropped, "HEAD") - head; got != 1 {
+		t.Errorf("HEAD went up by %d, want 1", got)
+	}
+	if got := mapValue(methodDropped, "other") - other; got != 3 {
+		t.Errorf("other went up by %d, want 3", got)
+	}
+	for _, key := range []string{"FOO", "head", "GET"} {
+		if methodDropped.Get(key) != nil {
+			t.Errorf("%s has an entry of its own", key)
+		}
+	}
+}
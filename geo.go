@@ -0,0 +1,376 @@
+// geo.go
+package main
+
+import (
+	"container/list"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// The GeoIP database, from GEOIP_DB_PATH, and the optional ASN database from
+// GEOIP_ASN_DB. Lookups hold geoDB_lock for reading so a reload can wait for
+// them before closing the old databases.
+var geoDB *geoip2.Reader
+var asnDB *geoip2.Reader
+var geoDB_lock sync.RWMutex
+var geoDBPath = envString("GEOIP_DB_PATH", envString("GEOIP_DB", "GeoLite2-City.mmdb"))
+var asnDBPath = os.Getenv("GEOIP_ASN_DB")
+
+// Lines seen per AS number
+var asnLines = expvar.NewMap("asn_lines")
+
+// Set when there's no database and no way of downloading one, lines are still
+// sent but without a location
+var geoPassThrough atomic.Bool
+
+func init() {
+	registerHealth("geoip", func() interface{} {
+		if geoPassThrough.Load() {
+			return "unavailable"
+		}
+		geoDB_lock.RLock()
+		defer geoDB_lock.RUnlock()
+		if geoDB == nil {
+			return nil
+		}
+		status := map[string]interface{}{
+			"city":    dbInfo(geoDB),
+			"lookups": lookupInfo(),
+		}
+		if asnDB != nil {
+			status["asn"] = dbInfo(asnDB)
+		}
+		return status
+	})
+}
+
+// dbInfo describes a database for /health
+func dbInfo(db *geoip2.Reader) map[string]interface{} {
+	meta := db.Metadata()
+	return map[string]interface{}{
+		"type":        meta.DatabaseType,
+		"built":       time.Unix(int64(meta.BuildEpoch), 0).UTC(),
+		"build_epoch": meta.BuildEpoch,
+	}
+}
+
+// Lookups since we started that found the address, failed outright, and found
+// it without coordinates (before any country fallback)
+var geoLookupsOK = expvar.NewInt("geoip_lookups")
+var geoLookupsFailed = expvar.NewInt("geoip_lookup_errors")
+var geoLookupsEmpty = expvar.NewInt("geoip_lookup_empty")
+
+// lookupInfo sums up how lookups are going for /health
+func lookupInfo() map[string]interface{} {
+	ok, empty := geoLookupsOK.Value(), geoLookupsEmpty.Value()
+	var emptyFraction float64
+	if ok > 0 {
+		emptyFraction = float64(empty) / float64(ok)
+	}
+	return map[string]interface{}{
+		"ok":             ok,
+		"failed":         geoLookupsFailed.Value(),
+		"empty_fraction": emptyFraction,
+	}
+}
+
+// openGeoDB opens the databases for the first time
+func openGeoDB() error {
+	db, err := geoip2.Open(geoDBPath)
+	if err != nil {
+		// Relative paths are the usual mistake so say where we actually looked
+		path, _ := filepath.Abs(geoDBPath)
+		return fmt.Errorf("%w, can't open %s (set GEOIP_DB_PATH): %s", errNoGeoDB, path, err)
+	}
+	var asn *geoip2.Reader
+	if asnDBPath != "" {
+		if asn, err = geoip2.Open(asnDBPath); err != nil {
+			db.Close()
+			return err
+		}
+	}
+
+	geoDB_lock.Lock()
+	geoDB = db
+	asnDB = asn
+	geoDB_lock.Unlock()
+	return nil
+}
+
+// geoReady reports whether lines can be looked up yet, either with a database
+// or without GeoIP
+func geoReady() bool {
+	if geoPassThrough.Load() {
+		return true
+	}
+	geoDB_lock.RLock()
+	defer geoDB_lock.RUnlock()
+	return geoDB != nil
+}
+
+// reloadGeoDB swaps in fresh copies of the databases. One that can't be opened
+// stays as it was. Without GeoIP it has another go at opening them, otherwise
+// nothing happens when no database was ever opened, like in demo mode.
+func reloadGeoDB() error {
+	geoDB_lock.RLock()
+	loaded := geoDB != nil
+	geoDB_lock.RUnlock()
+	if !loaded {
+		if !geoPassThrough.Load() {
+			return nil
+		}
+		if err := openGeoDB(); err != nil {
+			return err
+		}
+		geoPassThrough.Store(false)
+		log.Printf("Opened %s, locating clients again", geoDBPath)
+		return nil
+	}
+
+	var errs []error
+	if err := swapDB(&geoDB, geoDBPath); err != nil {
+		errs = append(errs, err)
+	}
+	if asnDBPath != "" {
+		if err := swapDB(&asnDB, asnDBPath); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Cached answers came from the old database
+	if geoLookups != nil {
+		geoLookups.clear()
+	}
+	return errors.Join(errs...)
+}
+
+// swapDB replaces *db with a freshly opened copy of path
+func swapDB(db **geoip2.Reader, path string) error {
+	fresh, err := geoip2.Open(path)
+	if err != nil {
+		return err
+	}
+
+	// Taking the write lock waits for lookups using the old database
+	geoDB_lock.Lock()
+	old := *db
+	*db = fresh
+	geoDB_lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	built := time.Unix(int64(fresh.Metadata().BuildEpoch), 0).UTC()
+	log.Printf("Reloaded %s built %s", path, built.Format(time.RFC3339))
+	return nil
+}
+
+// Lookups answered from the cache and ones that went to the database
+var geoCacheHits = expvar.NewInt("geoip_cache_hits")
+var geoCacheMisses = expvar.NewInt("geoip_cache_misses")
+
+var errNoGeoDB = errors.New("no GeoIP database loaded")
+
+// geoResult is what we keep from a GeoIP lookup
+type geoResult struct {
+	Lat     float64
+	Long    float64
+	Country string
+	// 0 and "" without an ASN database or when it doesn't know the address
+	ASN uint32
+	Org string
+	// The database only knew the country, Lat and Long are its centre
+	CountryLevel bool
+	// English name of the city, "" when unknown
+	City string
+	// How far off Lat and Long could be in km, 0 when unknown
+	Radius uint16
+}
+
+// geoCache remembers the last GEOIP_CACHE_SIZE lookups, the same clients show
+// up over and over so most lookups never reach the database
+type geoCache struct {
+	size  int
+	lock  sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+}
+
+type geoCacheEntry struct {
+	key    string
+	result geoResult
+}
+
+// nil when GEOIP_CACHE_SIZE is 0. Set once before any lookups and never
+// replaced, a reload only clears it.
+var geoLookups *geoCache
+
+// initGeoCache sets up the lookup cache from GEOIP_CACHE_SIZE, once at start
+func initGeoCache() {
+	size := envInt("GEOIP_CACHE_SIZE", 50000)
+	if size <= 0 {
+		geoLookups = nil
+		return
+	}
+	geoLookups = &geoCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Accuracy radius given to locations that are the middle of a country
+const countryRadius = 1000
+
+// Lines by accuracy radius of their location
+var accuracyRadii = expvar.NewMap("accuracy_radius")
+
+// countRadius adds a radius to accuracyRadii, bucketed so it stays small
+func countRadius(radius uint16) {
+	switch {
+	case radius == 0:
+		accuracyRadii.Add("unknown", 1)
+	case radius < 10:
+		accuracyRadii.Add("under_10km", 1)
+	case radius < 50:
+		accuracyRadii.Add("under_50km", 1)
+	case radius < 100:
+		accuracyRadii.Add("under_100km", 1)
+	case radius < 500:
+		accuracyRadii.Add("under_500km", 1)
+	default:
+		accuracyRadii.Add("500km_and_over", 1)
+	}
+}
+
+// geoCacheKey is what a lookup for ip is cached under
+func geoCacheKey(ip net.IP) string {
+	return anonKey(string(ip.To16()))
+}
+
+// geoLookup finds where ip is, from the cache when it can
+func geoLookup(ip net.IP) (geoResult, error) {
+	if geoPassThrough.Load() {
+		return geoResult{Lat: math.NaN(), Long: math.NaN()}, nil
+	}
+
+	r, err := cachedLookup(ip)
+	if err != nil {
+		geoLookupsFailed.Add(1)
+		return r, err
+	}
+	geoLookupsOK.Add(1)
+	if r.CountryLevel || (r.Lat == 0 && r.Long == 0) {
+		geoLookupsEmpty.Add(1)
+	}
+	return r, nil
+}
+
+// cachedLookup asks the cache about ip, then the database
+func cachedLookup(ip net.IP) (geoResult, error) {
+	key := geoCacheKey(ip)
+	if geoLookups != nil {
+		if r, ok := geoLookups.get(key); ok {
+			geoCacheHits.Add(1)
+			return r, nil
+		}
+		geoCacheMisses.Add(1)
+	}
+
+	geoDB_lock.RLock()
+	if geoDB == nil {
+		// Still waiting for a download, or it failed to open
+		geoDB_lock.RUnlock()
+		return geoResult{}, errNoGeoDB
+	}
+	city, err := geoDB.City(ip)
+	var asn *geoip2.ASN
+	if err == nil && asnDB != nil {
+		// Not knowing the network isn't worth dropping the line over
+		asn, _ = asnDB.ASN(ip)
+	}
+	geoDB_lock.RUnlock()
+	if err != nil {
+		return geoResult{}, err
+	}
+	r := geoResult{
+		Lat:     city.Location.Latitude,
+		Long:    city.Location.Longitude,
+		Country: city.Country.IsoCode,
+		City:    city.City.Names["en"],
+		Radius:  city.Location.AccuracyRadius,
+	}
+	if r.Country == "" {
+		r.Country = city.RegisteredCountry.IsoCode
+	}
+	if r.Lat == 0 && r.Long == 0 {
+		// No city, put it in the middle of the country instead of the Gulf of
+		// Guinea. Unknown countries stay at 0,0 for the caller to drop.
+		if c, ok := countryCentroids[r.Country]; ok {
+			r.Lat, r.Long = c[0], c[1]
+			r.Radius = countryRadius
+			r.CountryLevel = true
+		}
+	}
+	if asn != nil {
+		r.ASN = uint32(asn.AutonomousSystemNumber)
+		r.Org = asn.AutonomousSystemOrganization
+	}
+
+	if geoLookups != nil {
+		geoLookups.add(key, r)
+	}
+	if r.Lat == 0 && r.Long == 0 {
+		// Maybe GEOIP_API_URL knows, for next time. Queued after caching so
+		// its answer isn't overwritten.
+		queueGeoAPI(ip)
+	}
+	return r, nil
+}
+
+func (c *geoCache) get(key string) (geoResult, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return geoResult{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*geoCacheEntry).result, true
+}
+
+func (c *geoCache) add(key string, r geoResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value.(*geoCacheEntry).result = r
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&geoCacheEntry{key: key, result: r})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*geoCacheEntry).key)
+	}
+}
+
+// clear forgets every lookup, for when the database changes
+func (c *geoCache) clear() {
+	c.lock.Lock()
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+	c.lock.Unlock()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// Without a database lines pass through, and the cache and API resolver are
+// already there for when one turns up on SIGHUP
+func TestGeoPassThroughReload(t *testing.T) {
+	oldPath, oldURL := geoDBPath, geoAPIURL
+	geoDBPath = filepath.Join(t.TempDir(), "missing.mmdb")
+	geoAPIURL = "http://127.0.0.1:1/{ip}"
+	t.Cleanup(func() {
+		geoDBPath, geoAPIURL = oldPath, oldURL
+		geoPassThrough.Store(false)
+	})
+
+	if err := initIngest(); err != nil {
+		t.Fatal(err)
+	}
+	if !geoPassThrough.Load() {
+		t.Fatal("not passing lines through without a database")
+	}
+	if geoLookups == nil || geoAPIQueue == nil {
+		t.Fatal("cache or API resolver missing in pass-through mode")
+	}
+	r, err := geoLookup(net.ParseIP("192.0.2.1"))
+	if err != nil || !math.IsNaN(r.Lat) {
+		t.Errorf("pass-through lookup gave %+v, %v", r, err)
+	}
+
+	cache := geoLookups
+	if err := reloadGeoDB(); !errors.Is(err, errNoGeoDB) {
+		t.Errorf("reload without a database gave %v", err)
+	}
+	if geoLookups != cache {
+		t.Error("reload replaced the cache")
+	}
+	if !geoPassThrough.Load() {
+		t.Error("failed reload stopped passing lines through")
+	}
+}
+
+// testNetwork is a network in a test database and the City record a lookup
+// in it finds
+type testNetwork struct {
+	cidr   string
+	record map[string]interface{}
+}
+
+// cityRecord is a City record at lat, long in country
+func cityRecord(lat, long float64, country, city string) map[string]interface{} {
+	r := map[string]interface{}{
+		"location": map[string]interface{}{"latitude": lat, "longitude": long, "accuracy_radius": uint16(20)},
+		"country":  map[string]interface{}{"iso_code": country},
+	}
+	if city != "" {
+		r["city"] = map[string]interface{}{"names": map[string]interface{}{"en": city}}
+	}
+	return r
+}
+
+// useTestDB opens an IPv4 only City database of networks for the rest of the
+// test, written the way MaxMind's are so lookups go through geoip2
+func useTestDB(t testing.TB, networks ...testNetwork) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buildTestDB(t, networks), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := geoDBPath
+	geoDBPath = path
+	if err := openGeoDB(); err != nil {
+		t.Fatal(err)
+	}
+	if geoLookups != nil {
+		geoLookups.clear()
+	}
+	t.Cleanup(func() {
+		geoDB_lock.Lock()
+		geoDB.Close()
+		geoDB = nil
+		geoDB_lock.Unlock()
+		geoDBPath = oldPath
+		if geoLookups != nil {
+			geoLookups.clear()
+		}
+	})
+}
+
+// buildTestDB lays out a MaxMind DB: a binary tree over the address bits with
+// 24 bit records, 16 zero bytes, the data and then the metadata
+func buildTestDB(t testing.TB, networks []testNetwork) []byte {
+	t.Helper()
+	// Records are node numbers, empty (-1) or -2-offset into the data
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	var data []byte
+	for _, n := range networks {
+		_, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := ipnet.IP.To4()
+		bits, _ := ipnet.Mask.Size()
+		record := -2 - len(data)
+		data = append(data, mmdbValue(n.record)...)
+
+		node := 0
+		for i := 0; i < bits; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if i == bits-1 {
+				nodes[node][bit] = record
+				break
+			}
+			next := nodes[node][bit]
+			if next < 0 {
+				next = len(nodes)
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = next
+			}
+			node = next
+		}
+	}
+
+	count := len(nodes)
+	var db []byte
+	for _, n := range nodes {
+		for _, r := range n {
+			switch {
+			case r == empty:
+				r = count
+			case r < empty:
+				r = count + 16 + (-2 - r)
+			}
+			db = append(db, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	return append(db, mmdbValue(map[string]interface{}{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               "GeoLite2-City",
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1760500000),
+		"description":                 map[string]interface{}{"en": "MirrorMap test data"},
+	})...)
+}
+
+// mmdbValue encodes v in the MaxMind DB data format
+func mmdbValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(mmdbControl(2, len(v)), v...)
+	case float64:
+		return binary.BigEndian.AppendUint64(mmdbControl(3, 8), math.Float64bits(v))
+	case uint16:
+		return binary.BigEndian.AppendUint16(mmdbControl(5, 2), v)
+	case uint32:
+		return binary.BigEndian.AppendUint32(mmdbControl(6, 4), v)
+	case uint64:
+		return binary.BigEndian.AppendUint64(mmdbControl(9, 8), v)
+	case []interface{}:
+		b := mmdbControl(11, len(v))
+		for _, e := range v {
+			b = append(b, mmdbValue(e)...)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b := mmdbControl(7, len(v))
+		for _, k := range keys {
+			b = append(b, mmdbValue(k)...)
+			b = append(b, mmdbValue(v[k])...)
+		}
+		return b
+	}
+	panic(fmt.Sprintf("can't encode a %T", v))
+}
+
+// mmdbControl is the control byte for a value of type typ and size, types
+// past 7 are extended and take a byte of their own
+func mmdbControl(typ, size int) []byte {
+	var b []byte
+	if typ <= 7 {
+		b = []byte{byte(typ << 5)}
+	} else {
+		b = []byte{0, byte(typ - 7)}
+	}
+	switch {
+	case size < 29:
+		b[0] |= byte(size)
+	case size < 29+256:
+		b[0] |= 29
+		b = append(b, byte(size-29))
+	default:
+		b[0] |= 30
+		b = binary.BigEndian.AppendUint16(b, uint16(size-285))
+	}
+	return b
+}
+
+// replayAddresses is a log's worth of client addresses, a few busy clients
+// and a long tail the way a mirror sees them
+func replayAddresses(n int) []net.IP {
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.2, 1, 20000)
+	ips := make([]net.IP, n)
+	for i := range ips {
+		c := zipf.Uint64()
+		ips[i] = net.IPv4(81, 2, byte(c>>8), byte(c))
+	}
+	return ips
+}
+
+func benchmarkGeoLookup(b *testing.B, cacheSize string) {
+	useTestDB(b, testNetwork{"81.2.0.0/16", cityRecord(51.5, -0.1, "GB", "London")})
+	old := geoLookups
+	b.Setenv("GEOIP_CACHE_SIZE", cacheSize)
+	initGeoCache()
+	b.Cleanup(func() { geoLookups = old })
+
+	ips := replayAddresses(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := geoLookup(ips[i%len(ips)])
+		if err != nil || r.City != "London" {
+			b.Fatalf("got %+v, %v", r, err)
+		}
+	}
+}
+
+func BenchmarkGeoLookupUncached(b *testing.B) { benchmarkGeoLookup(b, "0") }
+func BenchmarkGeoLookupCached(b *testing.B)   { benchmarkGeoLookup(b, "50000") }
+
+// A new database on reload takes effect even for cached addresses
+func TestReloadClearsCache(t *testing.T) {
+	old := geoLookups
+	initGeoCache()
+	t.Cleanup(func() { geoLookups = old })
+	useTestDB(t, testNetwork{"81.2.0.0/16", cityRecord(51.5, -0.1, "GB", "London")})
+	ip := net.ParseIP("81.2.69.142")
+	for i := 0; i < 2; i++ {
+		if r, _ := geoLookup(ip); r.City != "London" {
+			t.Fatalf("got %+v before the reload", r)
+		}
+	}
+
+	db := buildTestDB(t, []testNetwork{{"81.2.0.0/16", cityRecord(48.9, 2.4, "FR", "Paris")}})
+	if err := os.WriteFile(geoDBPath, db, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadGeoDB(); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := geoLookup(ip); r.City != "Paris" {
+		t.Errorf("got %+v after the reload", r)
+	}
+}
@@ -0,0 +1,207 @@
+// geoapi.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With GEOIP_API_URL addresses the database can't place are looked up with an
+// ip-api.com style JSON API, {ip} in the URL is replaced by the address. That
+// sends client addresses to someone else so it's off unless asked for.
+//
+// Lookups happen in the background and the answer goes into the GeoIP cache,
+// so the line that missed is still dropped but later ones from the same client
+// get placed. A slow or broken API can't hold up ingest: at most
+// GEOIP_API_BUDGET requests a minute are made, each gets GEOIP_API_TIMEOUT,
+// and after GEOIP_API_FAILURES failures in a row it's left alone for
+// GEOIP_API_COOLDOWN.
+var geoAPIURL = os.Getenv("GEOIP_API_URL")
+var geoAPIBudget = envInt("GEOIP_API_BUDGET", 40)
+var geoAPITimeout = envDuration("GEOIP_API_TIMEOUT", 2*time.Second)
+var geoAPIFailures = envInt("GEOIP_API_FAILURES", 5)
+var geoAPICooldown = envDuration("GEOIP_API_COOLDOWN", time.Minute)
+
+var geoAPILookups = expvar.NewInt("geoip_api_lookups")
+var geoAPIErrors = expvar.NewInt("geoip_api_errors")
+
+// Addresses never sent because of the budget, the breaker or a full queue
+var geoAPIDropped = expvar.NewInt("geoip_api_dropped")
+
+// Addresses waiting for the API, and the ones already queued so a busy client
+// isn't asked about twice
+var geoAPIQueue chan net.IP
+var geoAPIPending = make(map[string]bool)
+var geoAPIPending_lock sync.Mutex
+
+// When the breaker closes again, zero while it's closed
+var geoAPIOpenUntil time.Time
+var geoAPIOpen_lock sync.Mutex
+
+var geoAPIClient *http.Client
+
+// initGeoAPI starts the API resolver when GEOIP_API_URL is set
+func initGeoAPI() error {
+	if geoAPIURL == "" {
+		return nil
+	}
+	if privacyMode {
+		return fmt.Errorf("GEOIP_API_URL sends client addresses elsewhere, it can't be used with PRIVACY_MODE")
+	}
+	if geoAPIBudget < 1 {
+		return fmt.Errorf("GEOIP_API_BUDGET must be at least 1")
+	}
+	if geoLookups == nil {
+		return fmt.Errorf("GEOIP_API_URL needs the GeoIP cache, GEOIP_CACHE_SIZE can't be 0")
+	}
+	geoAPIClient = &http.Client{Timeout: geoAPITimeout}
+	geoAPIQueue = make(chan net.IP, geoAPIBudget)
+	registerHealth("geoip_api", func() interface{} {
+		geoAPIOpen_lock.Lock()
+		defer geoAPIOpen_lock.Unlock()
+		if time.Now().Before(geoAPIOpenUntil) {
+			return map[string]interface{}{"state": "open", "until": geoAPIOpenUntil}
+		}
+		return map[string]interface{}{"state": "closed"}
+	})
+	log.Printf("Looking up addresses GeoIP can't place with %s", geoAPIHost())
+	go geoAPIResolver()
+	return nil
+}
+
+// geoAPIHost is the API's host, for logging without the rest of the URL which
+// may hold a key
+func geoAPIHost() string {
+	host := strings.TrimPrefix(strings.TrimPrefix(geoAPIURL, "https://"), "http://")
+	if i := strings.IndexByte(host, '/'); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// queueGeoAPI asks the API about ip in the background, never waiting
+func queueGeoAPI(ip net.IP) {
+	if geoAPIQueue == nil {
+		return
+	}
+	key := string(ip.To16())
+	geoAPIPending_lock.Lock()
+	defer geoAPIPending_lock.Unlock()
+	if geoAPIPending[key] {
+		return
+	}
+	select {
+	// A copy, the caller's can be zeroed once its lookup is done
+	case geoAPIQueue <- net.IP(key):
+		geoAPIPending[key] = true
+	default:
+		geoAPIDropped.Add(1)
+	}
+}
+
+// geoAPIResolver works through the queue within the budget
+func geoAPIResolver() {
+	var window time.Time
+	var used, failures int
+	for ip := range geoAPIQueue {
+		now := time.Now()
+		if now.Sub(window) >= time.Minute {
+			window, used = now, 0
+		}
+
+		geoAPIOpen_lock.Lock()
+		open := now.Before(geoAPIOpenUntil)
+		geoAPIOpen_lock.Unlock()
+		if open || used >= geoAPIBudget {
+			geoAPIDropped.Add(1)
+			geoAPIDone(ip)
+			continue
+		}
+
+		used++
+		geoAPILookups.Add(1)
+		r, err := geoAPILookup(ip)
+		if err != nil {
+			geoAPIErrors.Add(1)
+			if failures++; failures >= geoAPIFailures {
+				log.Printf("GeoIP API failed %d times in a row, leaving it for %s: %s", failures, geoAPICooldown, err)
+				geoAPIOpen_lock.Lock()
+				geoAPIOpenUntil = time.Now().Add(geoAPICooldown)
+				geoAPIOpen_lock.Unlock()
+				failures = 0
+			}
+		} else {
+			failures = 0
+			if r.Lat != 0 || r.Long != 0 {
+				// Keep the network the ASN database found
+				key := geoCacheKey(ip)
+				if old, ok := geoLookups.get(key); ok {
+					r.ASN, r.Org = old.ASN, old.Org
+				}
+				geoLookups.add(key, r)
+			}
+		}
+		geoAPIDone(ip)
+	}
+}
+
+func geoAPIDone(ip net.IP) {
+	geoAPIPending_lock.Lock()
+	delete(geoAPIPending, string(ip.To16()))
+	geoAPIPending_lock.Unlock()
+}
+
+// geoAPIResponse is the part of an ip-api.com style answer we use
+type geoAPIResponse struct {
+	Status      string  `json:"status"`
+	Lat         float64 `json:"lat"`
+	Lon         float64 `json:"lon"`
+	CountryCode string  `json:"countryCode"`
+	City        string  `json:"city"`
+}
+
+var errGeoAPIStatus = errors.New("GeoIP API request failed")
+
+// geoAPILookup asks the API where ip is. An address it doesn't know isn't an
+// error, it just comes back without a location.
+func geoAPILookup(ip net.IP) (geoResult, error) {
+	u := geoAPIURL
+	if strings.Contains(u, "{ip}") {
+		u = strings.ReplaceAll(u, "{ip}", ip.String())
+	} else {
+		u = strings.TrimSuffix(u, "/") + "/" + ip.String()
+	}
+
+	resp, err := geoAPIClient.Get(u)
+	if err != nil {
+		// The URL may have a key in it, don't log that
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return geoResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return geoResult{}, fmt.Errorf("%w: %s", errGeoAPIStatus, resp.Status)
+	}
+
+	var answer geoAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return geoResult{}, err
+	}
+	if answer.Status != "" && answer.Status != "success" {
+		return geoResult{}, nil
+	}
+	return geoResult{Lat: answer.Lat, Long: answer.Lon, Country: answer.CountryCode, City: answer.City}, nil
+}
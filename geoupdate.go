@@ -0,0 +1,189 @@
+// geoupdate.go
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// With MAXMIND_LICENSE_KEY the GeoIP database is downloaded to GEOIP_DB_PATH when
+// it's missing and refreshed every GEOIP_UPDATE_INTERVAL
+var maxmindLicenseKey = os.Getenv("MAXMIND_LICENSE_KEY")
+var maxmindEdition = envString("MAXMIND_EDITION", "GeoLite2-City")
+var geoUpdateInterval = envDuration("GEOIP_UPDATE_INTERVAL", 24*time.Hour)
+
+const maxmindURL = "https://download.maxmind.com/app/geoip_download"
+
+// Checksum of the last archive downloaded, so an unchanged one isn't reloaded
+var geoDBSum string
+
+// ensureGeoDB downloads the database if there isn't one yet, retrying until it
+// works. Ingest waits for it, which /health reports.
+func ensureGeoDB() {
+	if _, err := os.Stat(geoDBPath); err == nil {
+		return
+	}
+
+	b := newBackoff()
+	for {
+		_, err := downloadGeoDB()
+		if err == nil {
+			return
+		}
+		log.Printf("Error downloading the GeoIP database: %s", err)
+		setIngestState("waiting", fmt.Errorf("no GeoIP database yet: %w", err))
+		time.Sleep(b.next())
+	}
+}
+
+// refreshGeoDB keeps the database up to date, a failed download leaves the
+// current one in place until the next try
+func refreshGeoDB() {
+	for range time.Tick(geoUpdateInterval) {
+		changed, err := downloadGeoDB()
+		if err != nil {
+			log.Printf("Error updating the GeoIP database, keeping the current one: %s", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := reloadGeoDB(); err != nil {
+			log.Printf("Error loading the updated GeoIP database: %s", err)
+		}
+	}
+}
+
+// downloadGeoDB fetches the latest database, checks it against MaxMind's
+// checksum and puts it at geoDBPath. It reports whether the database changed.
+func downloadGeoDB() (bool, error) {
+	q := url.Values{}
+	q.Set("edition_id", maxmindEdition)
+	q.Set("license_key", maxmindLicenseKey)
+
+	q.Set("suffix", "tar.gz.sha256")
+	sumBody, err := maxmindGet(maxmindURL + "?" + q.Encode())
+	if err != nil {
+		return false, err
+	}
+	sumText, err := io.ReadAll(io.LimitReader(sumBody, 1024))
+	sumBody.Close()
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(string(sumText))
+	if len(fields) == 0 {
+		return false, errors.New("empty checksum from MaxMind")
+	}
+	want := strings.ToLower(fields[0])
+	if want == geoDBSum {
+		return false, nil
+	}
+
+	// Download next to the database, the directory is known to be writable
+	archive := geoDBPath + ".tar.gz.tmp"
+	defer os.Remove(archive)
+
+	q.Set("suffix", "tar.gz")
+	body, err := maxmindGet(maxmindURL + "?" + q.Encode())
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Create(archive)
+	if err != nil {
+		body.Close()
+		return false, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), body)
+	body.Close()
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+	defer f.Close()
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return false, fmt.Errorf("checksum mismatch, got %s want %s", got, want)
+	}
+
+	if err := extractMMDB(f, geoDBPath); err != nil {
+		return false, err
+	}
+	geoDBSum = want
+	log.Printf("Downloaded %s to %s", maxmindEdition, geoDBPath)
+	return true, nil
+}
+
+// maxmindGet makes a request, turning error statuses into errors
+func maxmindGet(u string) (io.ReadCloser, error) {
+	client := http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Get(u)
+	if err != nil {
+		// The URL has the license key in it, don't log that
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("MaxMind answered %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// extractMMDB copies the .mmdb file out of a MaxMind tar.gz to dest
+func extractMMDB(r io.Reader, dest string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return errors.New("no .mmdb file in the download")
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(hdr.Name, ".mmdb") {
+			continue
+		}
+
+		// Write then rename so a reload never sees half a file
+		tmp := dest + ".tmp"
+		out, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, tr); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return err
+		}
+		if err := out.Close(); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return os.Rename(tmp, dest)
+	}
+}
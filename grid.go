@@ -0,0 +1,177 @@
+// grid.go
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+)
+
+// Clients registered with aggregate=true don't get events, they get the
+// number of events per distro in each GRID_CELL degree square of the map over
+// the last GRID_WINDOW, every GRID_INTERVAL. At most GRID_MAX_CELLS squares
+// are counted at once, events in new ones are dropped past that.
+var gridCell = envFloat("GRID_CELL", 1)
+var gridWindow = envDuration("GRID_WINDOW", time.Minute)
+var gridInterval = envDuration("GRID_INTERVAL", 5*time.Second)
+var gridMaxCells = envInt("GRID_MAX_CELLS", 10000)
+
+// Events not counted because too many cells were
+var gridDropped = expvar.NewInt("grid_dropped")
+
+// Events for the grid, read by runGrid
+var gridEvents = make(chan event, 1000)
+
+// gridKey is a cell, the south west corner divided by gridCell
+type gridKey struct {
+	lat, long int32
+}
+
+// initGrid checks the grid settings
+func initGrid() error {
+	if gridCell <= 0 || gridCell > 90 {
+		return fmt.Errorf("GRID_CELL must be more than 0 and at most 90")
+	}
+	if gridInterval <= 0 || gridWindow < gridInterval {
+		return fmt.Errorf("GRID_INTERVAL must be more than 0 and GRID_WINDOW at least as long")
+	}
+	if gridMaxCells < 1 {
+		return fmt.Errorf("GRID_MAX_CELLS must be at least 1")
+	}
+	return nil
+}
+
+// addToGrid passes ev on to runGrid if it has a place on the map
+func addToGrid(ev event) {
+	if ev.Flags&parse.FlagUnlocated != 0 || math.IsNaN(ev.Lat) || math.IsNaN(ev.Long) {
+		return
+	}
+	select {
+	case gridEvents <- ev:
+	default:
+		gridDropped.Add(1)
+	}
+}
+
+// runGrid counts every event from gridEvents and sends the counts to the
+// aggregate clients every gridInterval. One slot of counts is kept per
+// interval of the window, the oldest is thrown away each time.
+func runGrid() {
+	slots := make([]map[gridKey]map[int]uint32, int(gridWindow/gridInterval))
+	for i := range slots {
+		slots[i] = make(map[gridKey]map[int]uint32)
+	}
+	var current, cells int
+	ticker := time.NewTicker(gridInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev := <-gridEvents:
+			key := gridKey{int32(math.Floor(ev.Lat / gridCell)), int32(math.Floor(ev.Long / gridCell))}
+			counts, ok := slots[current][key]
+			if !ok {
+				if cells >= gridMaxCells {
+					gridDropped.Add(1)
+					continue
+				}
+				counts = make(map[int]uint32)
+				slots[current][key] = counts
+				cells++
+			}
+			counts[ev.Distro]++
+		case <-ticker.C:
+			sendGrid(slots)
+			current = (current + 1) % len(slots)
+			cells -= len(slots[current])
+			slots[current] = make(map[gridKey]map[int]uint32)
+		}
+	}
+}
+
+// sendGrid adds up the slots and sends them to every aggregate client, JSON
+// clients get it as JSON and the rest in binary
+func sendGrid(slots []map[gridKey]map[int]uint32) {
+	total := make(map[gridKey]map[int]uint32)
+	for _, slot := range slots {
+		for key, counts := range slot {
+			t, ok := total[key]
+			if !ok {
+				t = make(map[int]uint32)
+				total[key] = t
+			}
+			for id, n := range counts {
+				t[id] += n
+			}
+		}
+	}
+
+	var text, bin []byte
+	hub.Range(func(id string, c *client) {
+		if !c.aggregate || c.paused || c.shared {
+			return
+		}
+		var msg []byte
+		if messageFormats[c.format].text {
+			if text == nil {
+				text = encodeGridJSON(total)
+			}
+			msg = text
+		} else {
+			if bin == nil {
+				bin = encodeGrid(total)
+			}
+			msg = bin
+		}
+		hub.send(id, c, message{data: msg})
+	})
+}
+
+type jsonGridCell struct {
+	Lat    float64           `json:"lat"`
+	Lon    float64           `json:"lon"`
+	Counts map[string]uint32 `json:"counts"`
+}
+
+// encodeGridJSON writes the cells with their south west corner and the
+// counts by distro id
+func encodeGridJSON(total map[gridKey]map[int]uint32) []byte {
+	cells := make([]jsonGridCell, 0, len(total))
+	for key, counts := range total {
+		c := jsonGridCell{Lat: float64(key.lat) * gridCell, Lon: float64(key.long) * gridCell, Counts: make(map[string]uint32)}
+		for id, n := range counts {
+			c.Counts[strconv.Itoa(id)] = n
+		}
+		cells = append(cells, c)
+	}
+	msg, _ := json.Marshal(struct {
+		Cell   float64        `json:"cell"`
+		Window int            `json:"window"`
+		Cells  []jsonGridCell `json:"cells"`
+	}{gridCell, int(gridWindow / time.Second), cells})
+	return msg
+}
+
+// encodeGrid writes the number of cells as a little endian uint32, then for
+// each the latitude and longitude of its south west corner as little endian
+// float64s, the number of distros as a little endian uint16 and each distro
+// id and count as a little endian uint16 and uint32
+func encodeGrid(total map[gridKey]map[int]uint32) []byte {
+	msg := binary.LittleEndian.AppendUint32(nil, uint32(len(total)))
+	for key, counts := range total {
+		msg = binary.LittleEndian.AppendUint64(msg, math.Float64bits(float64(key.lat)*gridCell))
+		msg = binary.LittleEndian.AppendUint64(msg, math.Float64bits(float64(key.long)*gridCell))
+		msg = binary.LittleEndian.AppendUint16(msg, uint16(len(counts)))
+		for id, n := range counts {
+			msg = binary.LittleEndian.AppendUint16(msg, uint16(id))
+			msg = binary.LittleEndian.AppendUint32(msg, n)
+		}
+	}
+	return msg
+}
@@ -0,0 +1,112 @@
+// grpc_ingest.go
+package main
+
+import (
+	"crypto/subtle"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Spud304/MirrorMap/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Where the gRPC ingest service listens, it's off unless this is set
+var grpcIngestAddr = os.Getenv("GRPC_INGEST_ADDR")
+
+// grpcIngest implements pb.IngestServiceServer
+type grpcIngest struct {
+	pb.UnimplementedIngestServiceServer
+	token string
+}
+
+// startGRPCIngest serves the ingest service on its own port
+func startGRPCIngest() error {
+	token := os.Getenv("GRPC_INGEST_TOKEN")
+	if token == "" {
+		return errMissingSetting("GRPC_INGEST_TOKEN")
+	}
+
+	l, err := net.Listen("tcp", grpcIngestAddr)
+	if err != nil {
+		return err
+	}
+
+	g := &grpcIngest{token: token}
+	server := grpc.NewServer(grpc.StreamInterceptor(g.authenticate))
+	pb.RegisterIngestServiceServer(server, g)
+	grpcIngestServer = server
+
+	log.Printf("Serving gRPC ingest on %s", grpcIngestAddr)
+	go func() {
+		if err := server.Serve(l); err != nil {
+			log.Printf("gRPC ingest stopped: %s", err)
+		}
+	}()
+	return nil
+}
+
+// authenticate requires "authorization: Bearer <token>" metadata on every stream
+func (g *grpcIngest) authenticate(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	var given string
+	if auth := md.Get("authorization"); len(auth) > 0 {
+		given = strings.TrimPrefix(auth[0], "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(g.token)) != 1 {
+		return status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return handler(srv, ss)
+}
+
+func (g *grpcIngest) Ingest(stream pb.IngestService_IngestServer) error {
+	if !geoReady() {
+		return status.Error(codes.Unavailable, "ingest is not running")
+	}
+
+	origin := "grpc"
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		host, _, _ := net.SplitHostPort(p.Addr.String())
+		origin = "grpc:" + host
+	}
+
+	var summary pb.Summary
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&summary)
+		}
+		if err != nil {
+			return err
+		}
+
+		if ingestMessage(msg, origin) != nil {
+			summary.Rejected++
+		} else {
+			summary.Accepted++
+		}
+	}
+}
+
+// ingestMessage handles a single raw line or resolved event
+func ingestMessage(msg *pb.LogLine, origin string) error {
+	switch kind := msg.Kind.(type) {
+	case *pb.LogLine_Raw:
+		return processLine(Line{Text: kind.Raw, Origin: origin})
+	case *pb.LogLine_Event:
+		id, ok := resolveDistro(canonicalDistro(kind.Event.Distro))
+		if !ok {
+			return errUnknownDistro
+		}
+		hub.Broadcast(event{Distro: id, Lat: kind.Event.Lat, Long: kind.Event.Long, Time: time.Now()})
+		return nil
+	}
+	return errMalformed
+}
@@ -0,0 +1,141 @@
+// grpc_subscribe.go
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/Spud304/MirrorMap/pb"
+	"github.com/thanhpk/randstr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	protoenc "google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Where the gRPC event service listens, it's off unless this is set. With
+// GRPC_SUBSCRIBE_TOKEN set subscribers need it like ingest clients do.
+var grpcSubscribeAddr = os.Getenv("GRPC_SUBSCRIBE_ADDR")
+
+// How many events can wait for each subscriber before it misses some
+var grpcSubscribeBuffer = envInt("GRPC_SUBSCRIBE_BUFFER", 100)
+
+// grpcSubscribe implements pb.EventServiceServer
+type grpcSubscribe struct {
+	pb.UnimplementedEventServiceServer
+	token string
+}
+
+// startGRPCSubscribe serves the event service on its own port
+func startGRPCSubscribe() error {
+	if grpcSubscribeBuffer < 1 {
+		return fmt.Errorf("GRPC_SUBSCRIBE_BUFFER must be at least 1")
+	}
+	l, err := net.Listen("tcp", grpcSubscribeAddr)
+	if err != nil {
+		return err
+	}
+
+	server := newSubscribeServer(os.Getenv("GRPC_SUBSCRIBE_TOKEN"))
+	grpcSubscribeServer = server
+
+	log.Printf("Serving gRPC events on %s", grpcSubscribeAddr)
+	go func() {
+		if err := server.Serve(l); err != nil {
+			log.Printf("gRPC events stopped: %s", err)
+		}
+	}()
+	return nil
+}
+
+// newSubscribeServer builds a gRPC server for the event service, sending
+// events as the hub encoded them
+func newSubscribeServer(token string) *grpc.Server {
+	g := &grpcSubscribe{token: token}
+	server := grpc.NewServer(
+		grpc.StreamInterceptor(g.authenticate),
+		grpc.ForceServerCodecV2(encodedCodec{encoding.GetCodecV2(protoenc.Name)}),
+	)
+	pb.RegisterEventServiceServer(server, g)
+	return server
+}
+
+// encodedEvent is a pb.Event the hub has already marshalled, once for every
+// subscriber
+type encodedEvent []byte
+
+// encodedCodec is the proto codec, except that it sends encodedEvents as
+// they are
+type encodedCodec struct {
+	encoding.CodecV2
+}
+
+func (c encodedCodec) Marshal(v any) (mem.BufferSlice, error) {
+	if e, ok := v.(encodedEvent); ok {
+		return mem.BufferSlice{mem.SliceBuffer(e)}, nil
+	}
+	return c.CodecV2.Marshal(v)
+}
+
+// authenticate requires "authorization: Bearer <token>" metadata when there's a token
+func (g *grpcSubscribe) authenticate(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if g.token == "" {
+		return handler(srv, ss)
+	}
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	var given string
+	if auth := md.Get("authorization"); len(auth) > 0 {
+		given = strings.TrimPrefix(auth[0], "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(g.token)) != 1 {
+		return status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return handler(srv, ss)
+}
+
+// Subscribe registers the stream as a format=proto client and sends it
+// everything it's given until it goes away, without decoding it again
+func (g *grpcSubscribe) Subscribe(req *pb.SubscribeRequest, stream pb.EventService_SubscribeServer) error {
+	var boxes [][]float64
+	for _, b := range req.GetBbox() {
+		boxes = append(boxes, []float64{b.South, b.West, b.North, b.East})
+	}
+	filter, err := newClientFilter(req.Distros, boxes, req.Sample)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	id := "grpc-" + randstr.Hex(16)
+	c := &client{ch: make(chan message, grpcSubscribeBuffer), format: formatProto, filter: filter}
+	if err := hub.Register(id, c); err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	log.Printf("%s subscribed", id)
+	defer hub.Unregister(id, c)
+
+	for {
+		select {
+		case msg, ok := <-c.ch:
+			if !ok {
+				var evicted bool
+				hub.Update(func() { evicted = c.evicted })
+				if evicted {
+					return status.Error(codes.ResourceExhausted, "too slow")
+				}
+				return nil
+			}
+			if err := stream.SendMsg(encodedEvent(msg.data)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Spud304/MirrorMap/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// subscribeClient serves the event service and connects to it
+func subscribeClient(t *testing.T, token string) pb.EventServiceClient {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newSubscribeServer(token)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewEventServiceClient(conn)
+}
+
+func TestGRPCSubscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := subscribeClient(t, "").Subscribe(ctx, &pb.SubscribeRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep broadcasting until the subscription is registered and gets one
+	got := make(chan *pb.Event)
+	go func() {
+		ev, err := stream.Recv()
+		if err != nil {
+			t.Error(err)
+			close(got)
+			return
+		}
+		got <- ev
+	}()
+	sent := event{Distro: 2, Lat: 12.5, Long: -3.25, Country: "GB", City: "London", Bytes: 4096, Time: time.UnixMilli(1700000000000)}
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case ev := <-got:
+			if ev == nil {
+				return
+			}
+			if ev.DistroId != 2 || ev.GetLat() != 12.5 || ev.GetLon() != -3.25 || ev.Country != "GB" || ev.City != "London" || ev.Bytes != 4096 || ev.Time != 1700000000000 {
+				t.Errorf("got %v", ev)
+			}
+			return
+		case <-tick.C:
+			hub.Broadcast(sent)
+		case <-ctx.Done():
+			t.Fatal("no event")
+		}
+	}
+}
+
+func TestGRPCSubscribeToken(t *testing.T) {
+	client := subscribeClient(t, "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Subscribe(ctx, &pb.SubscribeRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("without a token got %v", err)
+	}
+}
+
+func TestGRPCSubscribeBadFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := subscribeClient(t, "").Subscribe(ctx, &pb.SubscribeRequest{Sample: 2})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("sample of 2 got %v", err)
+	}
+}
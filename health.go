@@ -0,0 +1,41 @@
+// health.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Extra fields reported by /health, each input or subsystem can add its own
+var healthChecks = make(map[string]func() interface{})
+var healthChecks_lock sync.RWMutex
+
+// registerHealth adds a field to the /health output
+func registerHealth(name string, check func() interface{}) {
+	healthChecks_lock.Lock()
+	healthChecks[name] = check
+	healthChecks_lock.Unlock()
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	// Send diagnostic information
+	status := make(map[string]interface{})
+
+	status["clients"] = hub.Len()
+
+	healthChecks_lock.RLock()
+	for name, check := range healthChecks {
+		status[name] = check()
+	}
+	healthChecks_lock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if ingestDead() {
+		// Let monitoring notice the map has gone quiet for good
+		w.WriteHeader(503)
+	} else {
+		w.WriteHeader(200)
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,66 @@
+// heartbeat.go
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// With HEARTBEAT_INTERVAL clients registered with control=true get a
+// heartbeat message whenever nothing has been sent to them for that long, so
+// a quiet mirror can be told apart from a dead connection. It comes with a
+// websocket ping, and without PING_INTERVAL the connection is closed when
+// nothing comes back for three intervals. 0 turns it off.
+var heartbeatInterval = envDuration("HEARTBEAT_INTERVAL", 0)
+
+type heartbeatData struct {
+	// Events a second over about the last minute
+	Rate    float64 `json:"rate"`
+	Clients int     `json:"clients"`
+	// Server time in unix milliseconds
+	Time int64 `json:"time"`
+}
+
+// idleTimer fires when a client hasn't been sent anything for
+// heartbeatInterval
+type idleTimer struct {
+	t *time.Timer
+}
+
+// newIdleTimer starts an idleTimer for c, one that never fires if c doesn't
+// get heartbeats
+func newIdleTimer(c *client) *idleTimer {
+	if !c.control || heartbeatInterval <= 0 {
+		return &idleTimer{}
+	}
+	return &idleTimer{t: time.NewTimer(heartbeatInterval)}
+}
+
+// C is nil when the timer never fires, which blocks forever in a select
+func (i *idleTimer) C() <-chan time.Time {
+	if i.t == nil {
+		return nil
+	}
+	return i.t.C
+}
+
+// reset starts the wait again after something was sent
+func (i *idleTimer) reset() {
+	if i.t != nil {
+		i.t.Reset(heartbeatInterval)
+	}
+}
+
+// writeHeartbeat sends c a heartbeat and a ping, failing if the client isn't
+// taking them
+func writeHeartbeat(conn *websocket.Conn, c *client, format string) error {
+	n := hub.Len()
+	now := time.Now()
+	data := heartbeatData{Rate: recentRate(now), Clients: n, Time: now.UnixNano() / int64(time.Millisecond)}
+
+	if err := writeControl(conn, c, format, controlHeartbeat, data); err != nil {
+		return err
+	}
+	return conn.WriteControl(websocket.PingMessage, nil, now.Add(writeTimeout))
+}
@@ -0,0 +1,130 @@
+// history.go
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The last HISTORY_SIZE events broadcast are kept, so a websocket client
+// registered with backfill=60 is sent the last minute of them as it connects
+// instead of starting from an empty map. Clients can't ask for more than
+// HISTORY_MAX_AGE. 0 keeps nothing.
+var historySize = envInt("HISTORY_SIZE", 5000)
+var historyMaxAge = envDuration("HISTORY_MAX_AGE", 5*time.Minute)
+
+type pastEvent struct {
+	ev event
+	at time.Time
+}
+
+// The events, used as a ring with next the index of the oldest once it's
+// full. Guarded by the hub's lock, so a connecting client gets each event
+// either in its backfill or live and never both.
+var history []pastEvent
+var historyNext int
+
+// initHistory checks the history settings
+func initHistory() error {
+	if historySize < 0 {
+		return fmt.Errorf("HISTORY_SIZE can't be negative")
+	}
+	if historyMaxAge < 0 {
+		return fmt.Errorf("HISTORY_MAX_AGE can't be negative")
+	}
+	history = make([]pastEvent, 0, historySize)
+	return nil
+}
+
+// remember keeps ev, broadcast at now, dropping the oldest event once
+// there's no room. Called with the hub's lock held for writing.
+func remember(ev event, now time.Time) {
+	if historySize == 0 {
+		return
+	}
+	if len(history) < historySize {
+		history = append(history, pastEvent{ev, now})
+		return
+	}
+	history[historyNext] = pastEvent{ev, now}
+	historyNext = (historyNext + 1) % historySize
+}
+
+// backfillFor returns the events since since that f wants, oldest first.
+// Called with the hub's lock held.
+func backfillFor(f *clientFilter, since time.Time) []event {
+	// Newest first until they get too old
+	var evs []event
+	for i := len(history) - 1; i >= 0; i-- {
+		p := history[(historyNext+i)%len(history)]
+		if p.at.Before(since) {
+			break
+		}
+		if f.wants(p.ev) {
+			evs = append(evs, p.ev)
+		}
+	}
+	for i, j := 0, len(evs)-1; i < j; i, j = i+1, j-1 {
+		evs[i], evs[j] = evs[j], evs[i]
+	}
+	return evs
+}
+
+// historyAfter returns the events after seq that f wants, oldest first, for a
+// client resuming where it left off. Called with the hub's lock held.
+func historyAfter(f *clientFilter, seq uint32) []event {
+	var evs []event
+	for i := range history {
+		p := history[(historyNext+i)%len(history)]
+		// Sequence numbers wrap around, compare the distance between them
+		if int32(p.ev.Seq-seq) > 0 && f.wants(p.ev) {
+			evs = append(evs, p.ev)
+		}
+	}
+	return evs
+}
+
+// parseBackfill reads backfill, a number of seconds, capped at
+// historyMaxAge
+func parseBackfill(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil || secs < 0 || math.IsInf(secs, 0) || math.IsNaN(secs) {
+		return 0, fmt.Errorf("backfill must be a number of seconds")
+	}
+	return min(time.Duration(secs*float64(time.Second)), historyMaxAge), nil
+}
+
+type liveData struct {
+	Backfilled int `json:"backfilled"`
+}
+
+// writeBackfill sends c the events it missed before connecting, then a live
+// message saying how many there were and that what follows is live
+func writeBackfill(conn *websocket.Conn, c *client, format string, evs []event) error {
+	msgs := make([][]byte, 0, len(evs))
+	for _, ev := range evs {
+		msgs = append(msgs, c.encodeAs(ev, format))
+	}
+	for len(msgs) > 0 {
+		n := 1
+		if c.batch {
+			n = min(len(msgs), batchMax)
+		}
+		msg := msgs[0]
+		if c.batch {
+			msg = encodeBatch(msgs[:n], format)
+		}
+		if err := writeMessage(conn, messageType(format), msg); err != nil {
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return writeControl(conn, c, format, controlLive, liveData{len(evs)})
+}
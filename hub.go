@@ -0,0 +1,215 @@
+// hub.go
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Hub holds the registered clients of every kind. Anything that reads or
+// changes them, or sends to their channels, holds lock while it does.
+type Hub struct {
+	lock    sync.RWMutex
+	clients map[string]*client
+	// Set once shutting down starts, no new clients are taken after that
+	shuttingDown bool
+}
+
+var hub = newHub()
+
+func newHub() *Hub {
+	return &Hub{clients: make(map[string]*client)}
+}
+
+// Register adds c as id, unless the server is shutting down or has as many
+// clients as it takes
+func (h *Hub) Register(id string, c *client) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.shuttingDown {
+		return errShuttingDown
+	}
+	if h.full() {
+		return errTooManyClients
+	}
+	h.clients[id] = c
+	return nil
+}
+
+// Unregister forgets id if it's still c and closes its channel. Anything
+// sending to the channel holds the lock, so once it's out of clients nothing
+// can.
+func (h *Hub) Unregister(id string, c *client) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.remove(id, c)
+}
+
+// remove is Unregister with the lock already held for writing
+func (h *Hub) remove(id string, c *client) {
+	if h.clients[id] == c {
+		delete(h.clients, id)
+		close(c.ch)
+	}
+}
+
+// Shutdown stops new clients being taken, the ones there are stay until
+// they're evicted
+func (h *Hub) Shutdown() {
+	h.lock.Lock()
+	h.shuttingDown = true
+	h.lock.Unlock()
+}
+
+// ShuttingDown reports whether Shutdown has been called
+func (h *Hub) ShuttingDown() bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.shuttingDown
+}
+
+// Full reports whether there are as many clients as the limit allows
+func (h *Hub) Full() bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.full()
+}
+
+// full is Full with the lock already held
+func (h *Hub) full() bool {
+	max := maxClients.Load()
+	return max > 0 && int64(len(h.clients)) >= max
+}
+
+// Range calls f for every client with the lock held for writing, so f can
+// send to them and change them but can't call any other Hub method that
+// takes the lock
+func (h *Hub) Range(f func(id string, c *client)) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for id, c := range h.clients {
+		f(id, c)
+	}
+}
+
+// Evict removes every client f picks and closes their channels, returning how
+// many there were. f is called with the lock held like in Range.
+func (h *Hub) Evict(f func(id string, c *client) bool) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	n := 0
+	for id, c := range h.clients {
+		if f(id, c) {
+			delete(h.clients, id)
+			close(c.ch)
+			n++
+		}
+	}
+	return n
+}
+
+// Update runs f with the lock held for writing, for changing the options of
+// a client that events are being sent to
+func (h *Hub) Update(f func()) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	f()
+}
+
+// Len is the number of clients
+func (h *Hub) Len() int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.clients)
+}
+
+// Lookup returns client id, if there is one
+func (h *Hub) Lookup(id string) (*client, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	c, ok := h.clients[id]
+	return c, ok
+}
+
+// Snapshot describes every client as it is now, for the admin API
+func (h *Hub) Snapshot() []clientInfo {
+	now := time.Now()
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	list := make([]clientInfo, 0, len(h.clients))
+	for id, c := range h.clients {
+		list = append(list, c.info(id, now))
+	}
+	return list
+}
+
+// Broadcast sends an event to every registered client, encoding it once per
+// format that's actually in use
+func (h *Hub) Broadcast(ev event) {
+	now := time.Now()
+	encoded := make(map[string]message)
+	var aggregate bool
+
+	h.lock.Lock()
+	// Under the lock so clients get events in Seq order
+	ev.Seq = countRecent(ev.Distro, now)
+	remember(ev, now)
+	// send the message to each client
+	for id, c := range h.clients {
+		if c.shared {
+			// Its connections get it
+			continue
+		}
+		if c.aggregate {
+			aggregate = true
+			continue
+		}
+		if !c.filter.wants(ev) {
+			continue
+		}
+		if !c.throttle.allow(now) {
+			c.throttled.Add(1)
+			continue
+		}
+		if c.poll != nil {
+			// Polled events are always JSON
+			msg, ok := encoded[formatJSON]
+			if !ok {
+				msg = message{data: encodeJSON(ev), seq: ev.Seq}
+				encoded[formatJSON] = msg
+			}
+			if !c.poll.add(ev.Seq, msg.data) {
+				c.dropped.Add(1)
+			}
+			continue
+		}
+
+		msg, ok := encoded[c.key()]
+		if !ok {
+			msg = message{data: c.encode(ev), seq: ev.Seq}
+		}
+		if msg.prepared == nil && c.conn != nil && !c.batch {
+			// Framed once for every websocket with the same key. Batches
+			// are joined up so they can't be.
+			msg.prepared, _ = websocket.NewPreparedMessage(messageType(c.format), msg.data)
+		}
+		encoded[c.key()] = msg
+
+		if c.paused {
+			c.hold(msg)
+			continue
+		}
+		// if the client is blocking we skip it
+		h.send(id, c, msg)
+	}
+	h.lock.Unlock()
+
+	if aggregate {
+		addToGrid(ev)
+	}
+	if mqttQueue != nil {
+		queueMQTT(ev)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// seqOf reads the seq of a JSON event
+func seqOf(t *testing.T, msg message) uint32 {
+	t.Helper()
+	var j struct {
+		Seq uint32 `json:"seq"`
+	}
+	if err := json.Unmarshal(msg.data, &j); err != nil {
+		t.Fatalf("bad event %q: %s", msg.data, err)
+	}
+	return j.Seq
+}
+
+// testClient registers a JSON client that can hold n events
+func testClient(t testing.TB, id string, n int) *client {
+	t.Helper()
+	c := &client{ch: make(chan message, n), format: formatJSON}
+	if err := hub.Register(id, c); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hub.Unregister(id, c) })
+	return c
+}
+
+func TestSeqWraparound(t *testing.T) {
+	nextSeq.Store(math.MaxUint32 - 1)
+	t.Cleanup(func() { nextSeq.Store(0) })
+	c := testClient(t, "wrap", 3)
+
+	for i := 0; i < 3; i++ {
+		hub.Broadcast(event{Lat: math.NaN(), Long: math.NaN(), Time: time.Now()})
+	}
+	want := []uint32{math.MaxUint32 - 1, math.MaxUint32, 0}
+	p := newPollBuffer()
+	for _, w := range want {
+		msg := <-c.ch
+		if got := seqOf(t, msg); got != w {
+			t.Fatalf("got seq %d, want %d", got, w)
+		}
+		p.add(w, msg.data)
+	}
+
+	// Seq 0 comes after the highest one, not before everything
+	msgs, _ := p.after(math.MaxUint32, true)
+	if len(msgs) != 1 || seqOf(t, message{data: msgs[0]}) != 0 {
+		t.Fatalf("after the wrap got %q", msgs)
+	}
+	if msgs, _ := p.after(math.MaxUint32-2, true); len(msgs) != 3 {
+		t.Fatalf("got %d events from before the wrap, want 3", len(msgs))
+	}
+}
+
+func TestBroadcastSeqOrder(t *testing.T) {
+	const workers, each = 8, 200
+	c := testClient(t, "order", workers*each)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				hub.Broadcast(event{Lat: math.NaN(), Long: math.NaN(), Time: time.Now()})
+			}
+		}()
+	}
+	wg.Wait()
+
+	last := seqOf(t, <-c.ch)
+	for i := 1; i < workers*each; i++ {
+		seq := seqOf(t, <-c.ch)
+		if seq != last+1 {
+			t.Fatalf("seq %d came after %d", seq, last)
+		}
+		last = seq
+	}
+}
+
+// Run with -race
+func TestHubConcurrent(t *testing.T) {
+	h := newHub()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				h.Broadcast(event{Lat: math.NaN(), Long: math.NaN(), Time: time.Now()})
+			}
+		}()
+	}
+
+	var clients sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for j := 0; j < 50; j++ {
+				id := fmt.Sprintf("c%d-%d", i, j)
+				c := &client{ch: make(chan message, 2), format: formatJSON}
+				if err := h.Register(id, c); err != nil {
+					t.Error(err)
+					return
+				}
+				// Read a little, then go while events are still coming
+				select {
+				case <-c.ch:
+				case <-time.After(time.Millisecond):
+				}
+				h.Unregister(id, c)
+				// Closed once it's gone, with whatever was left in it
+				for range c.ch {
+				}
+			}
+		}()
+	}
+	clients.Wait()
+	close(stop)
+	wg.Wait()
+	if n := h.Len(); n != 0 {
+		t.Errorf("%d clients left", n)
+	}
+}
+
+// Snapshot, Range and Lookup see every client that's registered while events
+// are going out, and a client that's full misses events without holding up
+// the others
+func TestHubSnapshotWhileBroadcasting(t *testing.T) {
+	h := newHub()
+	full := &client{ch: make(chan message), format: formatJSON}
+	if err := h.Register("full", full); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	sent := 0
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			h.Broadcast(event{Lat: math.NaN(), Long: math.NaN(), Time: time.Now()})
+			sent++
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("c%d", i)
+		c := &client{ch: make(chan message, 1), format: formatJSON}
+		if err := h.Register(id, c); err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+		for _, info := range h.Snapshot() {
+			if info.ID == id {
+				found = info.Format == formatJSON
+			}
+		}
+		if !found {
+			t.Fatalf("%s isn't in the snapshot", id)
+		}
+		n := 0
+		h.Range(func(string, *client) { n++ })
+		if n != 2 {
+			t.Fatalf("ranged over %d clients, want 2", n)
+		}
+		if got, ok := h.Lookup(id); !ok || got != c {
+			t.Fatalf("looking up %s gave %v", id, ok)
+		}
+
+		h.Unregister(id, c)
+		if _, ok := h.Lookup(id); ok {
+			t.Fatalf("%s is still there after unregistering", id)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	list := h.Snapshot()
+	if len(list) != 1 || list[0].ID != "full" {
+		t.Fatalf("left with %+v", list)
+	}
+	if list[0].Dropped != uint64(sent) {
+		t.Errorf("full client dropped %d of %d", list[0].Dropped, sent)
+	}
+}
+
+func TestHubEvictAndShutdown(t *testing.T) {
+	h := newHub()
+	keep := &client{ch: make(chan message, 1)}
+	drop := &client{ch: make(chan message, 1), poll: newPollBuffer()}
+	h.Register("keep", keep)
+	h.Register("drop", drop)
+
+	n := h.Evict(func(id string, c *client) bool { return c.poll != nil })
+	if n != 1 || h.Len() != 1 {
+		t.Fatalf("evicted %d leaving %d, want 1 and 1", n, h.Len())
+	}
+	if _, ok := <-drop.ch; ok {
+		t.Error("evicted client's channel is still open")
+	}
+	if _, ok := h.Lookup("keep"); !ok {
+		t.Error("wrong client evicted")
+	}
+
+	// Unregistering something that's gone does nothing
+	h.Unregister("drop", drop)
+
+	h.Shutdown()
+	if !h.ShuttingDown() {
+		t.Error("not shutting down")
+	}
+	if err := h.Register("late", &client{ch: make(chan message)}); err != errShuttingDown {
+		t.Errorf("registering while shutting down gave %v", err)
+	}
+}
+
+func TestHubFull(t *testing.T) {
+	old := maxClients.Load()
+	maxClients.Store(1)
+	t.Cleanup(func() { maxClients.Store(old) })
+
+	h := newHub()
+	if err := h.Register("a", &client{ch: make(chan message)}); err != nil {
+		t.Fatal(err)
+	}
+	if !h.Full() {
+		t.Error("one client out of one isn't full")
+	}
+	if err := h.Register("b", &client{ch: make(chan message)}); err != errTooManyClients {
+		t.Errorf("registering past the limit gave %v", err)
+	}
+}
+
+// registerClient registers a client with the options in query the way
+// /register does
+func registerClient(t testing.TB, query string) *client {
+	t.Helper()
+	_, c := registerID(t, query)
+	return c
+}
+
+// registerID is registerClient that also gives the client's id
+func registerID(t testing.TB, query string) (string, *client) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	id, c, ok := register(w, httptest.NewRequest("POST", "/register?"+query, nil))
+	if !ok {
+		t.Fatalf("registering with %q: %d %s", query, w.Code, w.Body)
+	}
+	t.Cleanup(func() { hub.Unregister(id, c) })
+	return id, c
+}
+
+// socketServer serves the socket endpoints until the end of the test, giving
+// the ws:// URL of /map/socket
+func socketServer(t testing.TB) string {
+	r := mux.NewRouter()
+	r.HandleFunc("/map/socket", newSocketHandler)
+	r.HandleFunc("/map/socket/{id}", socketHandler)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/map/socket"
+}
+
+// dialClient registers a client with the options in query and connects to
+// its socket on the server at url
+func dialClient(t testing.TB, url, query string) (*websocket.Conn, *client) {
+	t.Helper()
+	id, c := registerID(t, query)
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, c
+}
+
+// The debug format is one line of text per event, whether it's picked by the
+// subprotocol or format=text, while other clients still get theirs
+func TestTextFormatOverSocket(t *testing.T) {
+	url := socketServer(t)
+	debian, ok := distroID("debian")
+	if !ok {
+		t.Fatal("no debian distro")
+	}
+
+	idSub, bySub := registerID(t, "")
+	dialer := websocket.Dialer{Subprotocols: []string{debugSubprotocol}}
+	sub, resp, err := dialer.Dial(url+"/"+idSub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if resp.Header.Get("Sec-WebSocket-Protocol") != debugSubprotocol {
+		t.Errorf("subprotocol %q agreed", resp.Header.Get("Sec-WebSocket-Protocol"))
+	}
+	idQuery, byQuery := registerID(t, "")
+	query, _, err := websocket.DefaultDialer.Dial(url+"/"+idQuery+"?format=text", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer query.Close()
+	binary, _ := dialClient(t, url, "")
+
+	// Switching format drops anything already queued, so wait until they're
+	// all connected
+	waitFor(t, "connecting", func() bool {
+		var attached bool
+		hub.Update(func() { attached = bySub.attached && byQuery.attached })
+		return attached
+	})
+	ev := event{Distro: debian, Lat: 48.137, Long: 11.575, Country: "DE", Time: time.Now()}
+	hub.Broadcast(ev)
+
+	for name, conn := range map[string]*websocket.Conn{"subprotocol": sub, "format=text": query} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		typ, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != websocket.TextMessage || string(msg) != "debian 48.137 11.575 DE" {
+			t.Errorf("%s got %d %q", name, typ, msg)
+		}
+	}
+	binary.SetReadDeadline(time.Now().Add(5 * time.Second))
+	typ, msg, err := binary.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := messageFormats[formatLegacy].encode(ev); typ != websocket.BinaryMessage || string(msg) != string(want) {
+		t.Errorf("binary client got %d %x, want %x", typ, msg, want)
+	}
+}
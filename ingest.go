@@ -0,0 +1,367 @@
+// ingest.go
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+)
+
+// Every line read from an input source, counted even while nobody is watching
+var linesReceived = expvar.NewInt("lines_received")
+
+// Bytes sent according to the logs, in total and per distro, whether or not
+// anyone is watching. Duplicates are counted too since they're still real
+// downloads. Distros that aren't known share one "other" entry.
+var bytesSent = expvar.NewInt("bytes_sent")
+var distroBytes = expvar.NewMap("distro_bytes")
+
+// Lines placed at the centre of their country because GeoIP had no city for them
+var countryFallbacks = expvar.NewInt("country_fallback")
+
+// Lines GeoIP couldn't place at all, whether or not they were sent
+var unlocatedEvents = expvar.NewInt("unlocated_events")
+
+// With SEND_UNLOCATED lines that can't be placed are still sent, flagged so
+// clients can leave them off the map, instead of being dropped
+var sendUnlocated = envBool("SEND_UNLOCATED", false)
+
+// ingestState is reported by /health so a dead input can be noticed from outside
+type ingestState struct {
+	State string    `json:"state"`
+	Error string    `json:"error,omitempty"`
+	Since time.Time `json:"since"`
+}
+
+var ingestStatus atomic.Value
+
+func setIngestState(state string, err error) {
+	s := ingestState{State: state, Since: time.Now()}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	ingestStatus.Store(s)
+}
+
+// ingestDead is true once an input source has stopped and hasn't come back
+func ingestDead() bool {
+	s, ok := ingestStatus.Load().(ingestState)
+	return ok && s.State == "dead"
+}
+
+func init() {
+	setIngestState("starting", nil)
+	registerHealth("ingest", func() interface{} {
+		return ingestStatus.Load()
+	})
+}
+
+var errMalformed = errors.New("malformed log line")
+var errBadIP = errors.New("invalid client address")
+var errLookup = errors.New("geoip lookup failed")
+var errNoLocation = errors.New("geoip has no location for the address")
+
+// initIngest opens the GeoIP database processLine needs. Without one, and
+// with no way of downloading it, lines are passed through without a location
+// rather than not at all. The cache and GEOIP_API_URL are set up either way,
+// so a database opened on SIGHUP later gets them too.
+func initIngest() error {
+	initGeoCache()
+	if err := initGeoAPI(); err != nil {
+		return err
+	}
+	err := openGeoDB()
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, errNoGeoDB) || maxmindLicenseKey != "" {
+		return err
+	}
+	log.Printf("WARNING: %s", err)
+	log.Printf("WARNING: running without GeoIP, events are sent without a location until the database is there and the server gets SIGHUP")
+	geoPassThrough.Store(true)
+	return nil
+}
+
+// fileIn feeds lines from the input source into the ingest workers. When the
+// source ends the ingest is marked dead in /health and, with INPUT_RETRY, the
+// source is recreated until it comes back.
+func fileIn(src InputSource) {
+	retry := envBool("INPUT_RETRY", false)
+	b := newBackoff()
+	setIngestState("running", nil)
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	for {
+		// Where shutdown can find it
+		ingestSource_lock.Lock()
+		ingestSource, ingestStopped = src, stopped
+		ingestSource_lock.Unlock()
+
+		err := readLines(src)
+		src.Close()
+		if err == nil {
+			if es, ok := src.(interface{ Err() error }); ok {
+				err = es.Err()
+			}
+		}
+		if err == nil {
+			err = io.EOF
+		}
+		log.Printf("Input source stopped: %s", err)
+		setIngestState("dead", err)
+
+		if !retry || hub.ShuttingDown() {
+			return
+		}
+
+		// Keep trying to bring the source back, health says dead meanwhile
+		for {
+			time.Sleep(b.next())
+			src, err = newInputSource()
+			if err == nil {
+				break
+			}
+			log.Printf("Error reopening input source: %s", err)
+			setIngestState("dead", err)
+		}
+		b.reset()
+		log.Println("Input source reopened")
+		setIngestState("running", nil)
+	}
+}
+
+// readLines queues everything from src for processing until it's exhausted
+func readLines(src InputSource) error {
+	queue, wait := startWorkers()
+	defer wait()
+	defer close(queue)
+
+	prevSkip := false
+	// Iterate through the input source
+	for l := range src.Lines() {
+		linesReceived.Add(1)
+
+		// If there are no connected clients skip the line
+		skip := hub.Len() == 0
+
+		if prevSkip != skip {
+			prevSkip = skip
+			if skip {
+				log.Println("All clients disconnected, skipping...")
+			} else {
+				log.Println("A new client connected, no longer skipping")
+			}
+		}
+
+		if skip {
+			countUnsent(l)
+			l.done()
+			continue
+		}
+
+		// Everything up to the GeoIP lookup happens here, in order, so
+		// dedup sees lines the way they were logged however many workers
+		// there are
+		p, ok, _ := prepareLine(l)
+		if !ok {
+			l.done()
+			continue
+		}
+		enqueue(queue, p)
+	}
+
+	return nil
+}
+
+// processLine parses a single log line, looks up where it came from and
+// broadcasts it. Lines that are well formed but deliberately not sent, like
+// duplicates, aren't an error.
+func processLine(l Line) error {
+	ev, ok, err := lineEvent(l)
+	if ok {
+		hub.Broadcast(ev)
+	}
+	return err
+}
+
+// lineEvent turns a log line into the event to send, ok is false when there
+// isn't one either because the line is bad or it was dropped on purpose
+func lineEvent(l Line) (ev event, ok bool, err error) {
+	p, ok, err := prepareLine(l)
+	if !ok {
+		return ev, false, err
+	}
+	return locateLine(p)
+}
+
+// preparedLine is a line that's been parsed and made it through the filters,
+// waiting for its GeoIP lookup
+type preparedLine struct {
+	Line
+	fields logFields
+	ip     string
+	addr   net.IP
+	distro int
+	size   uint64
+}
+
+// prepareLine does everything for a line short of looking up where it came
+// from. It's cheap, and dedup depends on lines going through it in order.
+func prepareLine(l Line) (p preparedLine, ok bool, err error) {
+	fields, ok := parseLine(l.Text)
+	if !ok {
+		return p, false, skipLine(skipUnmatched, l, errMalformed)
+	}
+	ip := extractIP(l.Text, fields)
+
+	// Errors and the like aren't downloads, drop them before they count for anything
+	if !statusAllowed(fields.Status) || !methodAllowed(fields.Method) || !pathAllowed(fields.Path) {
+		return p, false, nil
+	}
+
+	distro := canonicalDistro(parse.NormalizeDistro(extractDistro(fields.Path)))
+	size := parseBytes(fields.Bytes)
+	countBytes(distro, size)
+
+	if isDuplicate(l.Origin, ip, distro) {
+		// if the ip was just plotted skip the line
+		return p, false, nil
+	}
+
+	if ip == "" {
+		return p, false, skipLine(skipEmptyIP, l, errMalformed)
+	}
+
+	if distro == "" {
+		return p, false, skipLine(skipNoDistro, l, errMalformed)
+	}
+	id, ok := resolveDistro(distro)
+	if !ok {
+		return p, false, skipLine(skipUnknownDistro, l, errUnknownDistro)
+	}
+
+	// Thin out busy traffic before spending a GeoIP lookup on it
+	if !sampled(id) {
+		return p, false, nil
+	}
+
+	// Check the validity of the ip, geoip2 can't do anything with nil
+	ipNew := parse.ExtractIP(ip)
+	if ipNew == nil {
+		return p, false, skipLine(skipInvalidIP, l, errBadIP)
+	}
+	if !addressAllowed(ipNew) {
+		return p, false, nil
+	}
+	return preparedLine{Line: l, fields: fields, ip: ip, addr: ipNew, distro: id, size: size}, true, nil
+}
+
+// countBytes adds the size of a download of distro to the totals. Names come
+// from requests, so only known distros get an entry of their own.
+func countBytes(distro string, size uint64) {
+	if distro == "" {
+		return
+	}
+	bytesSent.Add(int64(size))
+	if _, ok := distroID(distro); !ok {
+		distro = "other"
+	}
+	distroBytes.Add(distro, int64(size))
+}
+
+// countUnsent counts the bytes of a line skipped because there are no
+// clients, the same as prepareLine would have
+func countUnsent(l Line) {
+	fields, ok := parseLine(l.Text)
+	if !ok || !statusAllowed(fields.Status) || !methodAllowed(fields.Method) || !pathAllowed(fields.Path) {
+		return
+	}
+	countBytes(canonicalDistro(parse.NormalizeDistro(extractDistro(fields.Path))), parseBytes(fields.Bytes))
+}
+
+// locateLine looks up where a prepared line came from and builds its event
+func locateLine(p preparedLine) (ev event, ok bool, err error) {
+	l, fields, size := p.Line, p.fields, p.size
+	jitterKey := anonKey(p.ip)
+	var loc geoResult
+	if o, ok := lookupOverride(p.addr); ok {
+		if o.label == overrideSuppress {
+			return ev, false, nil
+		}
+		loc = geoResult{Lat: o.lat, Long: o.long, Org: o.label}
+	} else {
+		loc, err = geoLookup(p.addr)
+		if err != nil {
+			return ev, false, skipLine(skipLookup, l, fmt.Errorf("%w: %s", errLookup, err))
+		}
+	}
+	if privacyMode {
+		// The address isn't needed past the lookup, don't hang on to it
+		for i := range p.addr {
+			p.addr[i] = 0
+		}
+		p.ip, p.Text, l.Text = "", "", redactIPs(l.Text)
+	}
+
+	// Checked after the country fallback so only truly unknown places are left
+	var flags uint8
+	if math.IsNaN(loc.Lat) {
+		// Running without GeoIP
+		flags |= parse.FlagUnlocated
+	} else if loc.Lat == 0 && loc.Long == 0 {
+		unlocatedEvents.Add(1)
+		if !sendUnlocated {
+			return ev, false, skipLine(skipNoLocation, l, errNoLocation)
+		}
+		flags |= parse.FlagUnlocated
+	}
+	if loc.CountryLevel {
+		countryFallbacks.Add(1)
+		flags |= parse.FlagCountry
+	}
+
+	// Fall back to when we saw the line if its timestamp can't be read
+	when, err := time.Parse(timeLayout, fields.Time)
+	if err != nil {
+		when = time.Now()
+	}
+	if flags&parse.FlagUnlocated == 0 {
+		loc.Lat, loc.Long = jitter(loc.Lat, loc.Long, jitterKey, when)
+	}
+
+	if loc.ASN != 0 {
+		asnLines.Add(strconv.FormatUint(uint64(loc.ASN), 10), 1)
+	}
+	if flags&parse.FlagUnlocated == 0 {
+		countRadius(loc.Radius)
+	}
+
+	ev = event{
+		Distro: p.distro,
+		Lat:    loc.Lat,
+		Long:   loc.Long,
+		Time:   when,
+		Bytes:  size,
+		Agent:  uint8(classifyAgent(fields.Agent)),
+		ASN:    loc.ASN,
+		Org:    loc.Org,
+		Flags:  flags,
+		Radius: loc.Radius,
+		Kind:   uint8(classifyKind(fields.Path, fields.Agent)),
+
+		Country: loc.Country,
+		City:    loc.City,
+	}
+	return ev, true, nil
+}
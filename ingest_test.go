@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"testing"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+)
+
+// sliceSource is an InputSource that sends some lines and stops
+type sliceSource struct {
+	ch chan Line
+}
+
+func newSliceSource(lines ...string) *sliceSource {
+	s := &sliceSource{ch: make(chan Line, len(lines))}
+	for _, l := range lines {
+		s.ch <- Line{Text: l}
+	}
+	close(s.ch)
+	return s
+}
+
+func (s *sliceSource) Lines() <-chan Line { return s.ch }
+func (s *sliceSource) Close() error       { return nil }
+
+// logLine is a line in the default log format
+func logLine(ip, path, status string, size int) string {
+	return fmt.Sprintf(`"%s" "15/Oct/2026:10:00:00 +0000" "GET %s HTTP/1.1" "%s" "%d" "120" "curl/8.0"`, ip, path, status, size)
+}
+
+// mapValue is the value of key in m, 0 when it isn't there
+func mapValue(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestBytesCountedWithoutClients(t *testing.T) {
+	if hub.Len() != 0 {
+		t.Fatal("test needs no clients")
+	}
+	total, ubuntu, other := bytesSent.Value(), mapValue(distroBytes, "ubuntu"), mapValue(distroBytes, "other")
+
+	readLines(newSliceSource(
+		logLine("192.0.2.1", "/ubuntu/pool/a.deb", "200", 1000),
+		logLine("192.0.2.2", "/ubuntu/pool/b.deb", "200", 500),
+		logLine("192.0.2.3", "/not-a-distro-1/x", "200", 30),
+		logLine("192.0.2.4", "/not-a-distro-2/x", "200", 20),
+		// Not a download
+		logLine("192.0.2.5", "/ubuntu/pool/c.deb", "404", 7),
+		"garbage",
+	))
+
+	if got := bytesSent.Value() - total; got != 1550 {
+		t.Errorf("bytes_sent went up by %d, want 1550", got)
+	}
+	if got := mapValue(distroBytes, "ubuntu") - ubuntu; got != 1500 {
+		t.Errorf("ubuntu went up by %d, want 1500", got)
+	}
+	if got := mapValue(distroBytes, "other") - other; got != 50 {
+		t.Errorf("other went up by %d, want 50", got)
+	}
+	if distroBytes.Get("not-a-distro-1") != nil || distroBytes.Get("not-a-distro-2") != nil {
+		t.Error("unknown distros got entries of their own")
+	}
+}
+
+func TestLineAddresses(t *testing.T) {
+	useTestDB(t, testNetwork{"192.0.2.0/24", cityRecord(48.1, 11.6, "DE", "Munich")})
+
+	tests := []struct {
+		ip  string
+		err error
+	}{
+		{"192.0.2.20", nil},
+		{"192.0.2.21:51234", nil},
+		{"::ffff:192.0.2.22", nil},
+		{"[::ffff:192.0.2.23]:443", nil},
+		// The database only has IPv4, these are lookup errors
+		{"2001:db8::1", errLookup},
+		{"[2001:db8::2]:443", errLookup},
+		{"not-an-address", errBadIP},
+		{"192.0.2.300", errBadIP},
+		{"[2001:db8::3", errBadIP},
+	}
+	for _, tt := range tests {
+		ev, ok, err := lineEvent(Line{Text: logLine(tt.ip, "/ubuntu/pool/a.deb", "200", 1)})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s gave %v, want %v", tt.ip, err, tt.err)
+			continue
+		}
+		if ok != (tt.err == nil) {
+			t.Errorf("%s gave an event %v", tt.ip, ok)
+		}
+		if ok && (ev.Lat != 48.1 || ev.Long != 11.6) {
+			t.Errorf("%s is at %v,%v", tt.ip, ev.Lat, ev.Long)
+		}
+	}
+}
+
+// A line GeoIP can't handle is skipped and the rest still go out
+func TestLookupErrorSkipsLine(t *testing.T) {
+	useTestDB(t, testNetwork{"192.0.2.0/24", cityRecord(48.1, 11.6, "DE", "Munich")})
+	c := testClient(t, "lookup-error", 4)
+	before := mapValue(linesSkipped, skipLookup)
+
+	readLines(newSliceSource(
+		logLine("192.0.2.30", "/ubuntu/pool/a.deb", "200", 1),
+		logLine("2001:db8::30", "/ubuntu/pool/a.deb", "200", 1),
+		logLine("192.0.2.31", "/ubuntu/pool/a.deb", "200", 1),
+	))
+
+	if n := len(c.ch); n != 2 {
+		t.Errorf("got %d events, want 2", n)
+	}
+	if got := mapValue(linesSkipped, skipLookup) - before; got != 1 {
+		t.Errorf("counted %d failed lookups, want 1", got)
+	}
+}
+
+func TestUnlocatedEvents(t *testing.T) {
+	useTestDB(t,
+		testNetwork{"192.0.2.0/25", cityRecord(48.1, 11.6, "DE", "Munich")},
+		// Only the country is known, it goes in the middle of it
+		testNetwork{"192.0.2.128/26", map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}}},
+		// A country there's no middle for
+		testNetwork{"192.0.2.192/26", map[string]interface{}{"country": map[string]interface{}{"iso_code": "ZZ"}}},
+	)
+	// Another address in the same network the second time round, dedup
+	// would drop the same one
+	in := func(network string) func(bool) string {
+		return func(second bool) string {
+			if second {
+				return network + "2"
+			}
+			return network + "1"
+		}
+	}
+	tests := []struct {
+		ip    func(second bool) string
+		flags uint8
+		// Dropped unless SEND_UNLOCATED is on
+		unlocated bool
+	}{
+		{in("192.0.2."), 0, false},
+		{in("192.0.2.13"), parse.FlagCountry, false},
+		{in("192.0.2.20"), parse.FlagUnlocated, true},
+		// Not in the database at all
+		{in("198.51.100."), parse.FlagUnlocated, true},
+	}
+	for _, send := range []bool{false, true} {
+		old := sendUnlocated
+		sendUnlocated = send
+		for _, tt := range tests {
+			before := unlocatedEvents.Value()
+			ev, ok, err := lineEvent(Line{Text: logLine(tt.ip(send), "/ubuntu/pool/a.deb", "200", 1)})
+			if counted := unlocatedEvents.Value() - before; counted != map[bool]int64{true: 1}[tt.unlocated] {
+				t.Errorf("%s counted %d unlocated events", tt.ip(send), counted)
+			}
+			if tt.unlocated && !send {
+				if ok || err != errNoLocation {
+					t.Errorf("%s wasn't dropped: %v", tt.ip(send), err)
+				}
+				continue
+			}
+			if !ok {
+				t.Errorf("%s with SEND_UNLOCATED=%v was dropped: %v", tt.ip(send), send, err)
+				continue
+			}
+			if ev.Flags != tt.flags {
+				t.Errorf("%s has flags %d, want %d", tt.ip(send), ev.Flags, tt.flags)
+			}
+			if ev.Flags&parse.FlagUnlocated == 0 && ev.Lat == 0 && ev.Long == 0 {
+				t.Errorf("%s was sent to 0,0", tt.ip(send))
+			}
+		}
+		sendUnlocated = old
+	}
+}
@@ -0,0 +1,204 @@
+// input.go
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Line is a raw log line along with the host or stream it came from, sources
+// that only ever have one origin can leave Origin empty
+type Line struct {
+	Text   string
+	Origin string
+	// Done, when set, is called once the line has been handled so sources
+	// can acknowledge or commit it
+	Done func()
+}
+
+// done marks the line as handled
+func (l Line) done() {
+	if l.Done != nil {
+		l.Done()
+	}
+}
+
+// InputSource produces raw log lines for fileIn to parse and broadcast
+type InputSource interface {
+	// Lines returns a channel of log lines, closed once the source is exhausted or closed
+	Lines() <-chan Line
+	// Close stops the source and releases anything it holds open
+	Close() error
+}
+
+// inputSources maps the values of INPUT_SOURCE to a constructor
+var inputSources = map[string]func() (InputSource, error){
+	"stdin":   newStdinSource,
+	"file":    newTailSource,
+	"syslog":  newSyslogSource,
+	"kafka":   newKafkaSource,
+	"redis":   newRedisSource,
+	"nats":    newNatsSource,
+	"journal": newJournalSource,
+	"udp":     newUDPSource,
+	"replay":  newReplaySource,
+	"amqp":    newAMQPSource,
+	"spool":   newSpoolSource,
+	"tcp":     newTCPSource,
+	"s3":      newS3Source,
+	"fluent":  newFluentSource,
+	"fifo":    newFIFOSource,
+}
+
+// inputTriggers lets a source be picked just by setting its main option,
+// e.g. LOG_PATH alone is enough to tail a file
+var inputTriggers = map[string]func() bool{
+	"file":    envSet("LOG_PATH"),
+	"syslog":  envSet("SYSLOG_LISTEN"),
+	"kafka":   envSet("KAFKA_BROKERS"),
+	"redis":   envSet("REDIS_ADDR"),
+	"nats":    envSet("NATS_URL"),
+	"journal": envSet("JOURNAL_UNIT"),
+	"udp":     envSet("UDP_INGEST_ADDR"),
+	"replay":  func() bool { return replayPath != "" },
+	"amqp":    envSet("AMQP_URL"),
+	"spool":   envSet("SPOOL_DIR"),
+	"tcp":     envSet("TCP_INGEST_ADDR"),
+	"s3":      envSet("S3_BUCKET"),
+	"fluent":  envSet("FLUENT_LISTEN"),
+	"fifo":    envSet("INPUT_FIFO"),
+}
+
+func envSet(key string) func() bool {
+	return func() bool {
+		return os.Getenv(key) != ""
+	}
+}
+
+// newInputSource creates the source selected by INPUT_SOURCE. When it isn't
+// set the source is inferred from inputTriggers, falling back to stdin
+func newInputSource() (InputSource, error) {
+	name := os.Getenv("INPUT_SOURCE")
+	if name == "" {
+		name = "stdin"
+		var triggered []string
+		for source, isSet := range inputTriggers {
+			if isSet() {
+				triggered = append(triggered, source)
+			}
+		}
+		if len(triggered) > 1 {
+			sort.Strings(triggered)
+			return nil, fmt.Errorf("more than one input source configured (%s), pick one with INPUT_SOURCE", strings.Join(triggered, ", "))
+		}
+		if len(triggered) == 1 {
+			name = triggered[0]
+		}
+	}
+
+	create, ok := inputSources[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown INPUT_SOURCE %q", name)
+	}
+
+	return create()
+}
+
+// Set once stdin has been handed to a source, after that it's at EOF
+var stdinUsed bool
+
+// newStdinSource reads stdin. Plain stdin can only be read once, but when it
+// is a named pipe it can be reopened by path after the writer goes away.
+func newStdinSource() (InputSource, error) {
+	if !stdinUsed {
+		stdinUsed = true
+		return newReaderSource(os.Stdin), nil
+	}
+
+	path, ok := stdinFifoPath()
+	if !ok {
+		return nil, errors.New("stdin was closed and can't be reopened")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return newReaderSource(f), nil
+}
+
+// stdinFifoPath finds the path of the named pipe stdin was redirected from
+func stdinFifoPath() (string, bool) {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		return "", false
+	}
+
+	// Anonymous pipes from a shell show up as "pipe:[1234]"
+	path, err := os.Readlink("/proc/self/fd/0")
+	if err != nil || !filepath.IsAbs(path) {
+		return "", false
+	}
+	return path, true
+}
+
+// readerSource turns any newline delimited reader into an InputSource
+type readerSource struct {
+	r     io.ReadCloser
+	lines chan Line
+	done  chan struct{}
+	once  sync.Once
+	err   error
+}
+
+func newReaderSource(r io.ReadCloser) *readerSource {
+	s := &readerSource{
+		r:     r,
+		lines: make(chan Line),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *readerSource) run() {
+	defer close(s.lines)
+
+	scanner := bufio.NewScanner(s.r)
+	for scanner.Scan() {
+		select {
+		case s.lines <- Line{Text: scanner.Text()}:
+		case <-s.done:
+			return
+		}
+	}
+
+	s.err = scanner.Err()
+	if s.err == nil {
+		s.err = io.EOF
+	}
+}
+
+// Err explains why the reader stopped, valid once Lines is closed
+func (s *readerSource) Err() error {
+	return s.err
+}
+
+func (s *readerSource) Lines() <-chan Line {
+	return s.lines
+}
+
+func (s *readerSource) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.r.Close()
+	})
+	return err
+}
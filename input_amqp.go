@@ -0,0 +1,147 @@
+// input_amqp.go
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var amqpConsumed = expvar.NewInt("amqp_consumed")
+var amqpAcked = expvar.NewInt("amqp_acked")
+var amqpRequeued = expvar.NewInt("amqp_requeued")
+
+// amqpSource consumes log lines from a RabbitMQ queue, one per delivery.
+// Deliveries are only acked once fileIn has handled them.
+type amqpSource struct {
+	url      string
+	queue    string
+	prefetch int
+
+	state atomic.Value
+	lines chan Line
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newAMQPSource() (InputSource, error) {
+	s := &amqpSource{
+		url:      os.Getenv("AMQP_URL"),
+		queue:    os.Getenv("AMQP_QUEUE"),
+		prefetch: envInt("AMQP_PREFETCH", 100),
+		lines:    make(chan Line),
+		done:     make(chan struct{}),
+	}
+	if s.url == "" {
+		return nil, errMissingSetting("AMQP_URL")
+	}
+	if s.queue == "" {
+		return nil, errMissingSetting("AMQP_QUEUE")
+	}
+
+	s.state.Store("connecting")
+	registerHealth("amqp", func() interface{} {
+		return s.state.Load()
+	})
+
+	go s.run()
+	return s, nil
+}
+
+func (s *amqpSource) run() {
+	defer close(s.lines)
+
+	b := newBackoff()
+	for {
+		err := s.consume(b)
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		s.state.Store("disconnected")
+		log.Printf("Lost amqp consumer on %s: %s", s.queue, err)
+		if !b.sleep(s.done) {
+			return
+		}
+	}
+}
+
+// consume runs a single connection until it fails
+func (s *amqpSource) consume(b *backoff) error {
+	conn, err := amqp.Dial(s.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := ch.Qos(s.prefetch, 0, false); err != nil {
+		return err
+	}
+
+	deliveries, err := ch.Consume(s.queue, "mirrormap", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Consuming from amqp queue %s", s.queue)
+	s.state.Store("connected")
+	b.reset()
+
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				if err := <-closed; err != nil {
+					return err
+				}
+				return errors.New("delivery channel closed")
+			}
+			amqpConsumed.Add(1)
+
+			line := Line{
+				Text:   string(d.Body),
+				Origin: "amqp",
+				Done: func() {
+					if err := d.Ack(false); err != nil {
+						// It'll be redelivered once the broker notices the channel is gone
+						log.Printf("Error acking amqp delivery: %s", err)
+						return
+					}
+					amqpAcked.Add(1)
+				},
+			}
+			select {
+			case s.lines <- line:
+			case <-s.done:
+				d.Nack(false, true)
+				amqpRequeued.Add(1)
+				return nil
+			}
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+func (s *amqpSource) Lines() <-chan Line {
+	return s.lines
+}
+
+func (s *amqpSource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
@@ -0,0 +1,119 @@
+// input_fifo.go
+
+//go:build !windows
+
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+)
+
+var fifoReopens = expvar.NewInt("fifo_reopens")
+
+// fifoSource reads a named pipe, reopening it every time the writer goes away
+// so the log shipper can restart without taking ingest down with it
+type fifoSource struct {
+	path string
+
+	file      *os.File
+	file_lock sync.Mutex
+
+	lines chan Line
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newFIFOSource() (InputSource, error) {
+	path := os.Getenv("INPUT_FIFO")
+	if path == "" {
+		return nil, errMissingSetting("INPUT_FIFO")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return nil, fmt.Errorf("%s is not a named pipe", path)
+	}
+
+	s := &fifoSource{
+		path:  path,
+		lines: make(chan Line),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *fifoSource) run() {
+	defer close(s.lines)
+
+	first := true
+	for {
+		// Blocks until a writer shows up
+		f, err := os.Open(s.path)
+		select {
+		case <-s.done:
+			if err == nil {
+				f.Close()
+			}
+			return
+		default:
+		}
+		if err != nil {
+			log.Printf("Error opening %s: %s", s.path, err)
+			return
+		}
+
+		if !first {
+			log.Printf("Writer reconnected to %s", s.path)
+			fifoReopens.Add(1)
+		}
+		first = false
+
+		s.file_lock.Lock()
+		s.file = f
+		s.file_lock.Unlock()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			select {
+			case s.lines <- Line{Text: scanner.Text()}:
+			case <-s.done:
+				f.Close()
+				return
+			}
+		}
+		f.Close()
+		log.Printf("Writer disconnected from %s, reopening", s.path)
+	}
+}
+
+func (s *fifoSource) Lines() <-chan Line {
+	return s.lines
+}
+
+func (s *fifoSource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+
+		s.file_lock.Lock()
+		if s.file != nil {
+			s.file.Close()
+		}
+		s.file_lock.Unlock()
+
+		// Opening the write end wakes up a reader stuck waiting in open
+		if w, err := os.OpenFile(s.path, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+			w.Close()
+		}
+	})
+	return nil
+}
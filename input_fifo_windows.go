@@ -0,0 +1,9 @@
+// input_fifo_windows.go
+package main
+
+import "errors"
+
+// Windows has no named pipes in the filesystem
+func newFIFOSource() (InputSource, error) {
+	return nil, errors.New("INPUT_FIFO is not supported on windows")
+}
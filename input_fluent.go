@@ -0,0 +1,269 @@
+// input_fluent.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+var fluentMissingField = expvar.NewInt("fluent_missing_field")
+var fluentMalformed = expvar.NewInt("fluent_malformed")
+
+// fluentSource speaks the Fluentd forward protocol so fluent-bit and fluentd
+// can ship logs straight to us. The raw log line is read from one field of
+// each record, and chunks are acknowledged when the sender asks for it.
+type fluentSource struct {
+	listener net.Listener
+	field    string
+
+	wg    sync.WaitGroup
+	lines chan Line
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newFluentSource() (InputSource, error) {
+	addr := os.Getenv("FLUENT_LISTEN")
+	if addr == "" {
+		return nil, errMissingSetting("FLUENT_LISTEN")
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Listening for fluent forward on %s", addr)
+
+	s := &fluentSource{
+		listener: l,
+		field:    envString("FLUENT_FIELD", "log"),
+		lines:    make(chan Line),
+		done:     make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.accept()
+	go func() {
+		s.wg.Wait()
+		close(s.lines)
+	}()
+	return s, nil
+}
+
+func (s *fluentSource) accept() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				log.Printf("Error accepting fluent connection: %s", err)
+			}
+			return
+		}
+
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+func (s *fluentSource) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	go func() {
+		<-s.done
+		conn.Close()
+	}()
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	dec := msgpack.NewDecoder(bufio.NewReader(conn))
+	for {
+		records, options, err := decodeForward(dec)
+		if err != nil {
+			if err != io.EOF {
+				select {
+				case <-s.done:
+				default:
+					log.Printf("Dropping fluent connection from %s: %s", host, err)
+					fluentMalformed.Add(1)
+				}
+			}
+			return
+		}
+
+		for _, record := range records {
+			line, ok := fluentField(record, s.field)
+			if !ok {
+				fluentMissingField.Add(1)
+				continue
+			}
+			select {
+			case s.lines <- Line{Text: line, Origin: host}:
+			case <-s.done:
+				return
+			}
+		}
+
+		// Acknowledge the chunk so the sender knows it doesn't need to retry
+		if chunk, ok := options["chunk"].(string); ok {
+			ack, _ := msgpack.Marshal(map[string]string{"ack": chunk})
+			if _, err := conn.Write(ack); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// decodeForward reads one event in any of the Message, Forward, PackedForward
+// or CompressedPackedForward modes
+func decodeForward(dec *msgpack.Decoder) (records []interface{}, options map[string]interface{}, err error) {
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, nil, err
+	}
+	if n < 2 || n > 4 {
+		return nil, nil, errors.New("unexpected forward event length")
+	}
+
+	// The tag isn't used for anything
+	if _, err := dec.DecodeString(); err != nil {
+		return nil, nil, err
+	}
+
+	code, err := dec.PeekCode()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	read := 2
+	switch {
+	case msgpcode.IsFixedArray(code) || code == msgpcode.Array16 || code == msgpcode.Array32:
+		// Forward: [tag, [[time, record], ...], options]
+		entries, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := 0; i < entries; i++ {
+			record, err := decodeEntry(dec)
+			if err != nil {
+				return nil, nil, err
+			}
+			records = append(records, record)
+		}
+	case msgpcode.IsBin(code) || msgpcode.IsString(code):
+		// PackedForward: [tag, msgpack stream of [time, record], options]
+		packed, err := dec.DecodeBytes()
+		if err != nil {
+			return nil, nil, err
+		}
+		if n > 2 {
+			if options, err = decodeOptions(dec); err != nil {
+				return nil, nil, err
+			}
+			read++
+		}
+		if options["compressed"] == "gzip" {
+			gz, err := gzip.NewReader(bytes.NewReader(packed))
+			if err != nil {
+				return nil, nil, err
+			}
+			if packed, err = io.ReadAll(gz); err != nil {
+				return nil, nil, err
+			}
+		}
+		inner := msgpack.NewDecoder(bytes.NewReader(packed))
+		for {
+			record, err := decodeEntry(inner)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			records = append(records, record)
+		}
+	default:
+		// Message: [tag, time, record, options]
+		if err := dec.Skip(); err != nil {
+			return nil, nil, err
+		}
+		record, err := dec.DecodeInterface()
+		if err != nil {
+			return nil, nil, err
+		}
+		records = append(records, record)
+		read++
+	}
+
+	if read < n {
+		if options, err = decodeOptions(dec); err != nil {
+			return nil, nil, err
+		}
+	}
+	return records, options, nil
+}
+
+// decodeEntry reads a [time, record] pair
+func decodeEntry(dec *msgpack.Decoder) (interface{}, error) {
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	if n != 2 {
+		return nil, errors.New("unexpected forward entry length")
+	}
+	if err := dec.Skip(); err != nil {
+		return nil, err
+	}
+	return dec.DecodeInterface()
+}
+
+func decodeOptions(dec *msgpack.Decoder) (map[string]interface{}, error) {
+	v, err := dec.DecodeInterface()
+	if err != nil {
+		return nil, err
+	}
+	options, _ := v.(map[string]interface{})
+	return options, nil
+}
+
+// fluentField pulls the raw log line out of a record
+func fluentField(record interface{}, field string) (string, bool) {
+	m, ok := record.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	switch v := m[field].(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+func (s *fluentSource) Lines() <-chan Line {
+	return s.lines
+}
+
+func (s *fluentSource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.listener.Close()
+	})
+	return nil
+}
@@ -0,0 +1,76 @@
+// input_http.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Shared secret that must be sent in the X-Ingest-Secret header, the ingest
+// endpoint is only enabled when this is set
+var ingestSecret = os.Getenv("INGEST_SECRET")
+
+// Largest request body the ingest endpoint will read
+var ingestMaxBody = int64(envInt("INGEST_MAX_BODY", 1<<20))
+
+type ingestSummary struct {
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+}
+
+// ingestHandler accepts log lines POSTed as newline delimited text or as a
+// JSON array of strings and runs them through the same path as fileIn
+func ingestHandler(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Ingest-Secret")), []byte(ingestSecret)) != 1 {
+		w.WriteHeader(401)
+		return
+	}
+
+	if !geoReady() {
+		http.Error(w, "ingest is not running", 503)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, ingestMaxBody))
+	if err != nil {
+		http.Error(w, "request body too large", 413)
+		return
+	}
+
+	var lines []string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(body, &lines); err != nil {
+			http.Error(w, "body must be a JSON array of strings", 400)
+			return
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				lines = append(lines, scanner.Text())
+			}
+		}
+	}
+
+	// Each poster gets its own dedup state
+	origin, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	var summary ingestSummary
+	for _, line := range lines {
+		if err := processLine(Line{Text: line, Origin: "http:" + origin}); err != nil {
+			summary.Rejected++
+		} else {
+			summary.Accepted++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,216 @@
+// input_journal_linux.go
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the journal cursor is written to disk
+const journalCursorFlush = time.Second
+
+// journalSource follows a systemd unit's journal through journalctl. The
+// cursor of the last handled entry is saved so a restart resumes after it
+// instead of replaying old downloads.
+type journalSource struct {
+	unit       string
+	cursorFile string
+
+	cursor atomic.Value
+	saved  string
+
+	lines chan Line
+	done  chan struct{}
+	once  sync.Once
+
+	cmd      *exec.Cmd
+	cmd_lock sync.Mutex
+}
+
+func newJournalSource() (InputSource, error) {
+	unit := os.Getenv("JOURNAL_UNIT")
+	if unit == "" {
+		return nil, errMissingSetting("JOURNAL_UNIT")
+	}
+
+	if _, err := exec.LookPath("journalctl"); err != nil {
+		log.Printf("journalctl is not available (%s), falling back to stdin", err)
+		return newReaderSource(os.Stdin), nil
+	}
+
+	s := &journalSource{
+		unit:       unit,
+		cursorFile: envString("JOURNAL_CURSOR_FILE", "journal.cursor"),
+		lines:      make(chan Line),
+		done:       make(chan struct{}),
+	}
+
+	if b, err := os.ReadFile(s.cursorFile); err == nil {
+		s.saved = strings.TrimSpace(string(b))
+	}
+	s.cursor.Store(s.saved)
+
+	go s.run()
+	go s.flushCursor()
+	return s, nil
+}
+
+func (s *journalSource) run() {
+	defer close(s.lines)
+
+	b := newBackoff()
+	for {
+		started := time.Now()
+		err := s.follow()
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		log.Printf("journalctl for %s exited: %v", s.unit, err)
+		if time.Since(started) > time.Minute {
+			b.reset()
+		}
+		if !b.sleep(s.done) {
+			return
+		}
+	}
+}
+
+// follow runs journalctl until it exits
+func (s *journalSource) follow() error {
+	args := []string{"--follow", "--output=json", "--unit=" + s.unit}
+	if c := s.cursor.Load().(string); c != "" {
+		args = append(args, "--after-cursor="+c)
+	} else {
+		// Nothing to resume from, only show new entries
+		args = append(args, "--lines=0")
+	}
+
+	cmd := exec.Command("journalctl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	s.cmd_lock.Lock()
+	s.cmd = cmd
+	s.cmd_lock.Unlock()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry struct {
+			Cursor  string          `json:"__CURSOR"`
+			Message json.RawMessage `json:"MESSAGE"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+
+		msg, ok := journalMessage(entry.Message)
+		if !ok {
+			continue
+		}
+
+		cursor := entry.Cursor
+		line := Line{
+			Text:   msg,
+			Origin: "journal",
+			Done: func() {
+				s.cursor.Store(cursor)
+			},
+		}
+		select {
+		case s.lines <- line:
+		case <-s.done:
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+// journalMessage decodes MESSAGE, which journalctl writes as an array of
+// bytes instead of a string when it isn't valid UTF-8
+func journalMessage(raw json.RawMessage) (string, bool) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, true
+	}
+
+	var bytes []byte
+	var ints []int
+	if err := json.Unmarshal(raw, &ints); err != nil {
+		return "", false
+	}
+	for _, i := range ints {
+		bytes = append(bytes, byte(i))
+	}
+	return string(bytes), true
+}
+
+// flushCursor periodically saves the cursor of the last handled entry
+func (s *journalSource) flushCursor() {
+	ticker := time.NewTicker(journalCursorFlush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.saveCursor()
+		case <-s.done:
+			s.saveCursor()
+			return
+		}
+	}
+}
+
+func (s *journalSource) saveCursor() {
+	c := s.cursor.Load().(string)
+	if c == s.saved {
+		return
+	}
+
+	tmp := s.cursorFile + ".tmp"
+	err := os.WriteFile(tmp, []byte(c+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(tmp, s.cursorFile)
+	}
+	if err != nil {
+		log.Printf("Error saving journal cursor: %s", err)
+		return
+	}
+	s.saved = c
+}
+
+func (s *journalSource) Lines() <-chan Line {
+	return s.lines
+}
+
+func (s *journalSource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.cmd_lock.Lock()
+		if s.cmd != nil && s.cmd.Process != nil {
+			s.cmd.Process.Kill()
+		}
+		s.cmd_lock.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,16 @@
+// input_journal_other.go
+
+//go:build !linux
+
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// The journal only exists on Linux, everywhere else JOURNAL_UNIT falls back to stdin
+func newJournalSource() (InputSource, error) {
+	log.Printf("The systemd journal is not supported on this platform, falling back to stdin")
+	return newReaderSource(os.Stdin), nil
+}
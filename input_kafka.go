@@ -0,0 +1,163 @@
+// input_kafka.go
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaSource consumes log lines from a Kafka topic as part of a consumer
+// group. Workers finish lines out of order, so an offset is only committed
+// once fileIn is done with it and every line before it in its partition, and
+// a restart picks up where processing actually stopped.
+type kafkaSource struct {
+	config kafka.ReaderConfig
+	lines  chan Line
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newKafkaSource() (InputSource, error) {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		return nil, errMissingSetting("KAFKA_BROKERS")
+	}
+	topic := os.Getenv("KAFKA_TOPIC")
+	if topic == "" {
+		return nil, errMissingSetting("KAFKA_TOPIC")
+	}
+
+	s := &kafkaSource{
+		config: kafka.ReaderConfig{
+			Brokers:        strings.Split(brokers, ","),
+			Topic:          topic,
+			GroupID:        envString("KAFKA_GROUP", "mirrormap"),
+			CommitInterval: time.Second,
+		},
+		lines: make(chan Line),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	go s.run()
+	return s, nil
+}
+
+func (s *kafkaSource) run() {
+	defer close(s.lines)
+
+	b := newBackoff()
+	reader := kafka.NewReader(s.config)
+	pending := newOffsetTracker()
+	defer func() {
+		reader.Close()
+	}()
+
+	for {
+		msg, err := reader.FetchMessage(s.ctx)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+
+			// The reader deals with rebalances itself, anything that makes it
+			// here is worth starting over with a fresh connection for
+			log.Printf("Error reading from kafka: %s", err)
+			reader.Close()
+			if !b.sleep(s.ctx.Done()) {
+				return
+			}
+			reader = kafka.NewReader(s.config)
+			// Lines from the old reader can't be committed through the new one
+			pending = newOffsetTracker()
+			continue
+		}
+		b.reset()
+
+		// Records keyed by host get their own dedup state
+		origin := "kafka"
+		if len(msg.Key) > 0 {
+			origin = string(msg.Key)
+		}
+
+		r, tracker := reader, pending
+		p := tracker.start(msg.Partition, msg.Offset)
+		line := Line{
+			Text:   strings.TrimRight(string(msg.Value), "\r\n"),
+			Origin: origin,
+			Done: func() {
+				offset, ok := tracker.finish(msg.Partition, p)
+				if !ok {
+					// Waiting on an earlier line
+					return
+				}
+				done := kafka.Message{Topic: msg.Topic, Partition: msg.Partition, Offset: offset}
+				if err := r.CommitMessages(s.ctx, done); err != nil && s.ctx.Err() == nil {
+					log.Printf("Error committing kafka offset: %s", err)
+				}
+			},
+		}
+
+		select {
+		case s.lines <- line:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *kafkaSource) Lines() <-chan Line {
+	return s.lines
+}
+
+func (s *kafkaSource) Close() error {
+	s.cancel()
+	return nil
+}
+
+// pendingOffset is a message being processed
+type pendingOffset struct {
+	offset int64
+	done   bool
+}
+
+// offsetTracker keeps the offsets being processed in each partition in the
+// order they were fetched, which is the order they're in
+type offsetTracker struct {
+	lock       sync.Mutex
+	partitions map[int][]*pendingOffset
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[int][]*pendingOffset)}
+}
+
+// start notes that offset in partition is being processed
+func (t *offsetTracker) start(partition int, offset int64) *pendingOffset {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p := &pendingOffset{offset: offset}
+	t.partitions[partition] = append(t.partitions[partition], p)
+	return p
+}
+
+// finish marks p as done and returns the highest offset in partition that
+// can be committed now, with ok false while anything before it is still
+// going
+func (t *offsetTracker) finish(partition int, p *pendingOffset) (offset int64, ok bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p.done = true
+	q := t.partitions[partition]
+	for len(q) > 0 && q[0].done {
+		offset, ok = q[0].offset, true
+		q = q[1:]
+	}
+	t.partitions[partition] = q
+	return offset, ok
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestOffsetTrackerCommitsInOrder(t *testing.T) {
+	tr := newOffsetTracker()
+	// Offsets can have gaps, say after compaction
+	p10 := tr.start(0, 10)
+	p11 := tr.start(0, 11)
+	p13 := tr.start(0, 13)
+	q5 := tr.start(1, 5)
+
+	if _, ok := tr.finish(0, p13); ok {
+		t.Error("13 committable while 10 and 11 are going")
+	}
+	if off, ok := tr.finish(1, q5); !ok || off != 5 {
+		t.Errorf("other partition got %d %v, want 5", off, ok)
+	}
+	if off, ok := tr.finish(0, p10); !ok || off != 10 {
+		t.Errorf("finishing 10 got %d %v, want 10", off, ok)
+	}
+	if off, ok := tr.finish(0, p11); !ok || off != 13 {
+		t.Errorf("finishing 11 got %d %v, want 13", off, ok)
+	}
+	if n := len(tr.partitions[0]); n != 0 {
+		t.Errorf("%d offsets left", n)
+	}
+}
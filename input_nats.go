@@ -0,0 +1,97 @@
+// input_nats.go
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsSource subscribes to a NATS subject where every message is a log line.
+// With NATS_QUEUE set, instances sharing the queue group split the messages.
+type natsSource struct {
+	conn  *nats.Conn
+	state atomic.Value
+	lines chan Line
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newNatsSource() (InputSource, error) {
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		return nil, errMissingSetting("NATS_URL")
+	}
+	subject := os.Getenv("NATS_SUBJECT")
+	if subject == "" {
+		return nil, errMissingSetting("NATS_SUBJECT")
+	}
+
+	s := &natsSource{
+		lines: make(chan Line),
+		done:  make(chan struct{}),
+	}
+	s.state.Store("connecting")
+	registerHealth("nats", func() interface{} {
+		return s.state.Load()
+	})
+
+	// Keep reconnecting forever, losing NATS should only pause the map
+	conn, err := nats.Connect(url,
+		nats.Name("mirrormap"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ConnectHandler(func(*nats.Conn) {
+			log.Printf("Connected to nats at %s", url)
+			s.state.Store("connected")
+		}),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("Disconnected from nats: %v", err)
+			s.state.Store("disconnected")
+		}),
+		nats.ReconnectHandler(func(*nats.Conn) {
+			log.Printf("Reconnected to nats")
+			s.state.Store("connected")
+		}),
+		// Only called once the connection is drained, so no handler can still be sending
+		nats.ClosedHandler(func(*nats.Conn) {
+			s.state.Store("closed")
+			close(s.lines)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if conn.IsConnected() {
+		s.state.Store("connected")
+	}
+
+	_, err = conn.QueueSubscribe(subject, os.Getenv("NATS_QUEUE"), func(msg *nats.Msg) {
+		select {
+		case s.lines <- Line{Text: string(msg.Data), Origin: "nats"}:
+		case <-s.done:
+		}
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s.conn = conn
+	return s, nil
+}
+
+func (s *natsSource) Lines() <-chan Line {
+	return s.lines
+}
+
+func (s *natsSource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.conn.Drain()
+	})
+	return nil
+}
@@ -0,0 +1,147 @@
+// input_redis.go
+package main
+
+import (
+	"expvar"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// How often an idle subscription is pinged to notice a dead connection
+const redisPingInterval = 30 * time.Second
+
+var redisMessages = expvar.NewInt("redis_messages")
+
+// redisSource subscribes to a Redis pub/sub channel where every message is a log line
+type redisSource struct {
+	addr    string
+	channel string
+
+	state atomic.Value
+	lines chan Line
+	done  chan struct{}
+	once  sync.Once
+
+	conn      redis.Conn
+	conn_lock sync.Mutex
+}
+
+func newRedisSource() (InputSource, error) {
+	s := &redisSource{
+		addr:    os.Getenv("REDIS_ADDR"),
+		channel: os.Getenv("REDIS_CHANNEL"),
+		lines:   make(chan Line),
+		done:    make(chan struct{}),
+	}
+	if s.addr == "" {
+		return nil, errMissingSetting("REDIS_ADDR")
+	}
+	if s.channel == "" {
+		return nil, errMissingSetting("REDIS_CHANNEL")
+	}
+
+	s.state.Store("connecting")
+	registerHealth("redis", func() interface{} {
+		return s.state.Load()
+	})
+
+	go s.run()
+	return s, nil
+}
+
+func (s *redisSource) run() {
+	defer close(s.lines)
+
+	b := newBackoff()
+	for {
+		err := s.subscribe(b)
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		s.state.Store("disconnected")
+		log.Printf("Lost redis subscription to %s: %s", s.channel, err)
+		if !b.sleep(s.done) {
+			return
+		}
+	}
+}
+
+// subscribe runs a single connection until it fails
+func (s *redisSource) subscribe(b *backoff) error {
+	conn, err := redis.Dial("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	s.conn_lock.Lock()
+	s.conn = conn
+	s.conn_lock.Unlock()
+	defer conn.Close()
+
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(s.channel); err != nil {
+		return err
+	}
+
+	// Keep pinging so a silently dropped connection shows up as a receive error
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(redisPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * redisPingInterval).(type) {
+		case redis.Message:
+			redisMessages.Add(1)
+			select {
+			case s.lines <- Line{Text: string(v.Data), Origin: "redis"}:
+			case <-s.done:
+				return nil
+			}
+		case redis.Subscription:
+			if v.Kind == "subscribe" {
+				log.Printf("Subscribed to redis channel %s", v.Channel)
+				s.state.Store("connected")
+				b.reset()
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+func (s *redisSource) Lines() <-chan Line {
+	return s.lines
+}
+
+func (s *redisSource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.conn_lock.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.conn_lock.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,165 @@
+// input_replay.go
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Replay settings, given on the command line
+var replayPath string
+var replaySpeed float64
+var replayLoop bool
+var replayRate float64
+
+func init() {
+	flag.StringVar(&replayPath, "replay", "", "replay an archived access log (plain or gzip) instead of reading live input")
+	flag.Float64Var(&replaySpeed, "speed", 1, "how many times faster than real time to replay")
+	flag.BoolVar(&replayLoop, "loop", false, "start the replay over when the file ends")
+	flag.Float64Var(&replayRate, "replay-rate", 10, "lines per second for replayed lines without a timestamp")
+}
+
+// Matches $time_local, e.g. 02/Jan/2006:15:04:05 -0700
+var reTimeLocal = regexp.MustCompile(`\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}`)
+
+// replaySource plays back an archived log, spacing lines out the way they
+// originally arrived sped up by replaySpeed
+type replaySource struct {
+	lines chan Line
+	done  chan struct{}
+	once  sync.Once
+	err   error
+}
+
+func newReplaySource() (InputSource, error) {
+	if replaySpeed <= 0 {
+		replaySpeed = 1
+	}
+	if replayRate <= 0 {
+		replayRate = 10
+	}
+
+	// Make sure the file is there before starting up
+	f, err := os.Open(replayPath)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	s := &replaySource{
+		lines: make(chan Line),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *replaySource) run() {
+	defer close(s.lines)
+
+	for {
+		log.Printf("Replaying %s at %gx", replayPath, replaySpeed)
+		if s.err = s.play(); s.err != nil || !replayLoop {
+			return
+		}
+	}
+}
+
+// play goes through the file once
+func (s *replaySource) play() error {
+	f, err := os.Open(replayPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := openMaybeGzip(f)
+	if err != nil {
+		return err
+	}
+
+	var first time.Time
+	var start time.Time
+	last := time.Now()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		var wait time.Duration
+		if ts, ok := parseTimeLocal(line); ok {
+			if first.IsZero() {
+				first, start = ts, time.Now()
+			}
+			// Time since the first line, scaled, is when this one is due
+			due := start.Add(time.Duration(float64(ts.Sub(first)) / replaySpeed))
+			wait = time.Until(due)
+		} else {
+			wait = time.Until(last.Add(time.Duration(float64(time.Second) / replayRate)))
+		}
+
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-s.done:
+				return nil
+			}
+		}
+		last = time.Now()
+
+		select {
+		case s.lines <- Line{Text: line, Origin: "replay"}:
+		case <-s.done:
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
+
+// openMaybeGzip transparently decompresses gzip files, sniffing the magic
+// number instead of trusting the extension
+func openMaybeGzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// parseTimeLocal finds the nginx $time_local timestamp in a line
+func parseTimeLocal(line string) (time.Time, bool) {
+	match := reTimeLocal.FindString(line)
+	if match == "" {
+		return time.Time{}, false
+	}
+	ts, err := time.Parse(timeLocalLayout, match)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
+func (s *replaySource) Lines() <-chan Line {
+	return s.lines
+}
+
+// Err is nil when the replay simply finished
+func (s *replaySource) Err() error {
+	return s.err
+}
+
+func (s *replaySource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
@@ -0,0 +1,199 @@
+// input_s3.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// How often backfill progress is logged
+const s3ProgressInterval = 30 * time.Second
+
+// s3Source backfills archived logs from an S3 compatible bucket. Every object
+// under the prefix is streamed through the pipeline at a limited rate, and
+// finished keys are recorded in a state file so running it again skips them.
+type s3Source struct {
+	client    *minio.Client
+	bucket    string
+	prefix    string
+	rate      int
+	stateFile string
+
+	processed map[string]bool
+	linesDone int64
+
+	lines  chan Line
+	ctx    context.Context
+	cancel context.CancelFunc
+	err    error
+}
+
+func newS3Source() (InputSource, error) {
+	endpoint := envString("S3_ENDPOINT", "s3.amazonaws.com")
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, errMissingSetting("S3_BUCKET")
+	}
+
+	// Fall back to the usual AWS environment variables for credentials
+	creds := credentials.NewEnvAWS()
+	if key := os.Getenv("S3_ACCESS_KEY"); key != "" {
+		creds = credentials.NewStaticV4(key, os.Getenv("S3_SECRET_KEY"), "")
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: envBool("S3_SECURE", true),
+		Region: os.Getenv("S3_REGION"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &s3Source{
+		client:    client,
+		bucket:    bucket,
+		prefix:    os.Getenv("S3_PREFIX"),
+		rate:      envInt("S3_RATE", 100),
+		stateFile: envString("S3_STATE_FILE", "backfill.state"),
+		processed: make(map[string]bool),
+		lines:     make(chan Line),
+	}
+	if s.rate <= 0 {
+		s.rate = 100
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	if b, err := os.ReadFile(s.stateFile); err == nil {
+		for _, key := range strings.Split(string(b), "\n") {
+			if key != "" {
+				s.processed[key] = true
+			}
+		}
+	}
+
+	go s.run()
+	return s, nil
+}
+
+func (s *s3Source) run() {
+	defer close(s.lines)
+
+	var keys []string
+	for obj := range s.client.ListObjects(s.ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix, Recursive: true}) {
+		if obj.Err != nil {
+			s.err = obj.Err
+			return
+		}
+		if !s.processed[obj.Key] && !strings.HasSuffix(obj.Key, "/") {
+			keys = append(keys, obj.Key)
+		}
+	}
+	log.Printf("Backfilling %d objects from s3://%s/%s (%d already done)", len(keys), s.bucket, s.prefix, len(s.processed))
+
+	var done int64
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(s3ProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d := atomic.LoadInt64(&done)
+				log.Printf("Backfill progress: %d/%d objects done, %d remaining, %d lines processed", d, len(keys), int64(len(keys))-d, atomic.LoadInt64(&s.linesDone))
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// Space lines out evenly so connected clients aren't flooded
+	ticker := time.NewTicker(time.Second / time.Duration(s.rate))
+	defer ticker.Stop()
+
+	for _, key := range keys {
+		if err := s.object(key, ticker); err != nil {
+			if s.ctx.Err() == nil {
+				s.err = err
+			}
+			return
+		}
+		atomic.AddInt64(&done, 1)
+	}
+	log.Printf("Backfill finished, %d objects and %d lines", len(keys), atomic.LoadInt64(&s.linesDone))
+}
+
+// object streams a single object and records it as processed
+func (s *s3Source) object(key string, ticker *time.Ticker) error {
+	obj, err := s.client.GetObject(s.ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	r, err := openMaybeGzip(obj)
+	if err != nil {
+		return err
+	}
+
+	var pending sync.WaitGroup
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+
+		pending.Add(1)
+		line := Line{
+			Text:   scanner.Text(),
+			Origin: "s3",
+			Done: func() {
+				atomic.AddInt64(&s.linesDone, 1)
+				pending.Done()
+			},
+		}
+		select {
+		case s.lines <- line:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// Only record the key once every line has been handled
+	pending.Wait()
+	f, err := os.OpenFile(s.stateFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(key + "\n")
+	return err
+}
+
+func (s *s3Source) Lines() <-chan Line {
+	return s.lines
+}
+
+func (s *s3Source) Err() error {
+	return s.err
+}
+
+func (s *s3Source) Close() error {
+	s.cancel()
+	return nil
+}
@@ -0,0 +1,271 @@
+// input_spool.go
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Suffix given to spool files once they've been ingested
+const spoolDoneSuffix = ".processed"
+
+// Name of the file tracking how far into the current spool file we got
+const spoolProgressFile = ".mirrormap-progress"
+
+// spoolSource watches a directory that rotated logs are dropped into and
+// ingests each new file once it has stopped changing. Finished files are
+// renamed with spoolDoneSuffix, and the line reached in the current file is
+// saved so a restart doesn't broadcast it all over again.
+type spoolSource struct {
+	dir    string
+	poll   time.Duration
+	settle time.Duration
+
+	// Size and mtime of files we're waiting on to settle
+	seen map[string]spoolSeen
+
+	// Progress through the current file, handled is bumped by Line.Done
+	current       string
+	handled       int64
+	saved         int64
+	progress_lock sync.Mutex
+
+	lines chan Line
+	done  chan struct{}
+	once  sync.Once
+}
+
+type spoolSeen struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+type spoolProgress struct {
+	File string `json:"file"`
+	Line int64  `json:"line"`
+}
+
+func newSpoolSource() (InputSource, error) {
+	s := &spoolSource{
+		dir:    os.Getenv("SPOOL_DIR"),
+		poll:   envDuration("SPOOL_POLL", 10*time.Second),
+		settle: envDuration("SPOOL_SETTLE", 30*time.Second),
+		seen:   make(map[string]spoolSeen),
+		lines:  make(chan Line),
+		done:   make(chan struct{}),
+	}
+	if s.dir == "" {
+		return nil, errMissingSetting("SPOOL_DIR")
+	}
+	if _, err := os.Stat(s.dir); err != nil {
+		return nil, err
+	}
+
+	go s.run()
+	go s.flushProgress()
+	return s, nil
+}
+
+func (s *spoolSource) run() {
+	defer close(s.lines)
+
+	ticker := time.NewTicker(s.poll)
+	defer ticker.Stop()
+	for {
+		for _, path := range s.ready() {
+			if !s.ingest(path) {
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// ready lists the files that have settled, oldest first
+func (s *spoolSource) ready() []string {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("Error reading spool directory: %s", err)
+		return nil
+	}
+
+	now := time.Now()
+	var ready []os.FileInfo
+	present := make(map[string]bool)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, spoolDoneSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// Gone since it was listed
+			continue
+		}
+		present[name] = true
+
+		// A file counts as fully written once it hasn't changed for the settle delay
+		prev, ok := s.seen[name]
+		if !ok || prev.size != info.Size() || !prev.modTime.Equal(info.ModTime()) {
+			s.seen[name] = spoolSeen{size: info.Size(), modTime: info.ModTime(), since: now}
+			continue
+		}
+		if now.Sub(prev.since) >= s.settle {
+			ready = append(ready, info)
+		}
+	}
+
+	for name := range s.seen {
+		if !present[name] {
+			delete(s.seen, name)
+		}
+	}
+
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].ModTime().Before(ready[j].ModTime())
+	})
+
+	var paths []string
+	for _, info := range ready {
+		paths = append(paths, filepath.Join(s.dir, info.Name()))
+	}
+	return paths
+}
+
+// ingest sends every line of a file and marks it processed, returning false if closed
+func (s *spoolSource) ingest(path string) bool {
+	name := filepath.Base(path)
+
+	// Pick up where we left off if we crashed part way through this file
+	skip := int64(0)
+	if p, ok := s.loadProgress(); ok && p.File == name {
+		skip = p.Line
+		log.Printf("Resuming %s from line %d", name, skip)
+	} else {
+		log.Printf("Ingesting %s", name)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Error opening spool file: %s", err)
+		return true
+	}
+	defer f.Close()
+
+	r, err := openMaybeGzip(f)
+	if err != nil {
+		log.Printf("Error reading spool file %s: %s", name, err)
+		return true
+	}
+
+	s.progress_lock.Lock()
+	s.current = name
+	s.saved = -1
+	atomic.StoreInt64(&s.handled, skip)
+	s.progress_lock.Unlock()
+
+	var pending sync.WaitGroup
+	n := int64(0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if n++; n <= skip {
+			continue
+		}
+
+		pending.Add(1)
+		line := Line{
+			Text:   scanner.Text(),
+			Origin: "spool",
+			Done: func() {
+				atomic.AddInt64(&s.handled, 1)
+				pending.Done()
+			},
+		}
+		select {
+		case s.lines <- line:
+		case <-s.done:
+			return false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading spool file %s: %s", name, err)
+	}
+
+	// Only mark the file done once its last line has actually been handled
+	pending.Wait()
+	if err := os.Rename(path, path+spoolDoneSuffix); err != nil {
+		log.Printf("Error marking %s processed: %s", name, err)
+	}
+	s.progress_lock.Lock()
+	os.Remove(filepath.Join(s.dir, spoolProgressFile))
+	s.current = ""
+	s.progress_lock.Unlock()
+	delete(s.seen, name)
+	return true
+}
+
+func (s *spoolSource) loadProgress() (spoolProgress, bool) {
+	var p spoolProgress
+	b, err := os.ReadFile(filepath.Join(s.dir, spoolProgressFile))
+	if err != nil || json.Unmarshal(b, &p) != nil {
+		return p, false
+	}
+	return p, true
+}
+
+// flushProgress periodically saves how far into the current file we are
+func (s *spoolSource) flushProgress() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		s.saveProgress()
+	}
+}
+
+func (s *spoolSource) saveProgress() {
+	s.progress_lock.Lock()
+	defer s.progress_lock.Unlock()
+
+	handled := atomic.LoadInt64(&s.handled)
+	if s.current == "" || handled == s.saved {
+		return
+	}
+
+	b, _ := json.Marshal(spoolProgress{File: s.current, Line: handled})
+	tmp := filepath.Join(s.dir, spoolProgressFile+".tmp")
+	if err := os.WriteFile(tmp, b, 0644); err == nil {
+		os.Rename(tmp, filepath.Join(s.dir, spoolProgressFile))
+		s.saved = handled
+	}
+}
+
+func (s *spoolSource) Lines() <-chan Line {
+	return s.lines
+}
+
+func (s *spoolSource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
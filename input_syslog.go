@@ -0,0 +1,325 @@
+// input_syslog.go
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest syslog frame we accept, anything bigger is treated as malformed
+const syslogMaxFrame = 64 * 1024
+
+var syslogMalformed = expvar.NewInt("syslog_malformed")
+
+// syslogSource listens for syslog messages over UDP and/or TCP and hands the
+// message body of each one to the parser. The sending host is used as the
+// origin so several mirrors can log to the same listener.
+type syslogSource struct {
+	lines chan Line
+	done  chan struct{}
+	once  sync.Once
+	wg    sync.WaitGroup
+
+	closers []io.Closer
+}
+
+// newSyslogSource starts a listener for every address in SYSLOG_LISTEN, a comma
+// separated list like "udp://:5514,tcp://:5514". Addresses without a scheme are UDP.
+func newSyslogSource() (InputSource, error) {
+	listen := os.Getenv("SYSLOG_LISTEN")
+	if listen == "" {
+		return nil, errMissingSetting("SYSLOG_LISTEN")
+	}
+
+	s := &syslogSource{
+		lines: make(chan Line),
+		done:  make(chan struct{}),
+	}
+
+	for _, addr := range strings.Split(listen, ",") {
+		addr = strings.TrimSpace(addr)
+		network := "udp"
+		if i := strings.Index(addr, "://"); i >= 0 {
+			network, addr = addr[:i], addr[i+3:]
+		}
+
+		switch network {
+		case "udp":
+			pc, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			s.closers = append(s.closers, pc)
+			s.wg.Add(1)
+			go s.serveUDP(pc)
+		case "tcp":
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			s.closers = append(s.closers, l)
+			s.wg.Add(1)
+			go s.serveTCP(l)
+		default:
+			s.Close()
+			return nil, fmt.Errorf("unsupported syslog network %q", network)
+		}
+		log.Printf("Listening for syslog on %s://%s", network, addr)
+	}
+
+	go func() {
+		s.wg.Wait()
+		close(s.lines)
+	}()
+
+	return s, nil
+}
+
+func (s *syslogSource) serveUDP(pc net.PacketConn) {
+	defer s.wg.Done()
+
+	buf := make([]byte, syslogMaxFrame)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				log.Printf("Error reading syslog datagram: %s", err)
+			}
+			return
+		}
+
+		// Some senders pack several messages into one datagram
+		for _, frame := range strings.Split(strings.TrimRight(string(buf[:n]), "\n"), "\n") {
+			if !s.handle(frame, addr) {
+				return
+			}
+		}
+	}
+}
+
+func (s *syslogSource) serveTCP(l net.Listener) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				log.Printf("Error accepting syslog connection: %s", err)
+			}
+			return
+		}
+
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *syslogSource) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	// Make sure Close can interrupt a read on an idle connection
+	go func() {
+		<-s.done
+		conn.Close()
+	}()
+
+	r := bufio.NewReaderSize(conn, syslogMaxFrame)
+	for {
+		frame, err := readSyslogFrame(r)
+		if err == errSyslogFrame {
+			syslogMalformed.Add(1)
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		if !s.handle(frame, conn.RemoteAddr()) {
+			return
+		}
+	}
+}
+
+// handle parses a single frame and passes it on, returning false once the source is closed
+func (s *syslogSource) handle(frame string, addr net.Addr) bool {
+	host, msg, ok := parseSyslog(frame)
+	if !ok {
+		syslogMalformed.Add(1)
+		return true
+	}
+
+	// Fall back to the sender's address when the header has no hostname
+	if host == "" || host == "-" {
+		host = addr.String()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+
+	select {
+	case s.lines <- Line{Text: msg, Origin: host}:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *syslogSource) Lines() <-chan Line {
+	return s.lines
+}
+
+func (s *syslogSource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		for _, c := range s.closers {
+			c.Close()
+		}
+	})
+	return nil
+}
+
+var errSyslogFrame = fmt.Errorf("malformed syslog frame")
+
+// Most digits an octet count can have, more than syslogMaxFrame can need
+const maxSyslogDigits = 10
+
+// readSyslogFrame reads one message from a TCP stream, supporting both octet
+// counted (RFC 6587 "123 <34>...") and newline delimited framing
+func readSyslogFrame(r *bufio.Reader) (string, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	if first[0] >= '0' && first[0] <= '9' {
+		// The length and the space after it, read a byte at a time so a peer
+		// that never sends the space can't make it buffer forever
+		n := 0
+		for digits := 0; ; digits++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			if b == ' ' && digits > 0 {
+				break
+			}
+			if b < '0' || b > '9' || digits == maxSyslogDigits {
+				return "", errSyslogFrame
+			}
+			n = n*10 + int(b-'0')
+		}
+		if n <= 0 || n > syslogMaxFrame {
+			return "", errSyslogFrame
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	}
+
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errSyslogFrame
+	}
+	if err != nil && len(line) == 0 {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// parseSyslog strips the priority and header off an RFC 3164 or RFC 5424
+// message, returning the hostname from the header and the message body
+func parseSyslog(frame string) (host string, msg string, ok bool) {
+	if len(frame) < 3 || frame[0] != '<' {
+		return "", "", false
+	}
+	end := strings.IndexByte(frame, '>')
+	if end < 2 || end > 4 {
+		return "", "", false
+	}
+	pri, err := strconv.Atoi(frame[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return "", "", false
+	}
+	rest := frame[end+1:]
+
+	if strings.HasPrefix(rest, "1 ") {
+		// RFC 5424: VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+		fields := strings.SplitN(rest, " ", 7)
+		if len(fields) < 7 {
+			return "", "", false
+		}
+		host = fields[2]
+		msg, ok = skipStructuredData(fields[6])
+		if !ok {
+			return "", "", false
+		}
+		msg = strings.TrimPrefix(msg, "\ufeff")
+	} else {
+		// RFC 3164: "Mmm dd hh:mm:ss HOSTNAME TAG: MSG", all of it optional in practice
+		if len(rest) > len(time.Stamp) {
+			if _, err := time.Parse(time.Stamp, rest[:len(time.Stamp)]); err == nil {
+				rest = strings.TrimLeft(rest[len(time.Stamp):], " ")
+				if i := strings.IndexByte(rest, ' '); i > 0 {
+					host, rest = rest[:i], rest[i+1:]
+				}
+			}
+		}
+		// Drop the "nginx[123]: " style tag
+		if i := strings.Index(rest, ": "); i > 0 && i <= 48 && !strings.ContainsAny(rest[:i], " \"") {
+			rest = rest[i+2:]
+		}
+		msg = rest
+	}
+
+	if strings.TrimSpace(msg) == "" {
+		return "", "", false
+	}
+	return host, msg, true
+}
+
+// skipStructuredData removes the STRUCTURED-DATA part of an RFC 5424 message
+func skipStructuredData(s string) (string, bool) {
+	if strings.HasPrefix(s, "-") {
+		return strings.TrimPrefix(s[1:], " "), true
+	}
+
+	for strings.HasPrefix(s, "[") {
+		escaped := false
+		i := 1
+		for ; i < len(s); i++ {
+			if escaped {
+				escaped = false
+				continue
+			}
+			if s[i] == '\\' {
+				escaped = true
+			} else if s[i] == ']' {
+				break
+			}
+		}
+		if i == len(s) {
+			return "", false
+		}
+		s = s[i+1:]
+	}
+
+	return strings.TrimPrefix(s, " "), true
+}
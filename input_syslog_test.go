@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadSyslogFrame(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("11 <34>hello\n\n<34>world\r\n5 <1>ab"))
+	for _, want := range []string{"<34>hello", "<34>world", "<1>ab"} {
+		got, err := readSyslogFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if _, err := readSyslogFrame(r); err != io.EOF {
+		t.Errorf("got %v at the end, want EOF", err)
+	}
+}
+
+func TestReadSyslogFrameBadCount(t *testing.T) {
+	for _, in := range []string{
+		// Never sends the space
+		strings.Repeat("9", 1<<20),
+		"12345678901 <34>x",
+		"0 ",
+		"70000 <34>x",
+		"12a <34>x",
+	} {
+		_, err := readSyslogFrame(bufio.NewReader(strings.NewReader(in)))
+		if err != errSyslogFrame {
+			t.Errorf("%.20q gave %v, want errSyslogFrame", in, err)
+		}
+	}
+}
+
+func TestParseSyslog(t *testing.T) {
+	tests := []struct {
+		frame, host, msg string
+		ok               bool
+	}{
+		{"<34>Oct 15 10:00:00 web1 nginx[123]: GET /", "web1", "GET /", true},
+		{"<165>1 2026-10-15T10:00:00Z web2 nginx 99 - - GET /", "web2", "GET /", true},
+		{"<165>1 2026-10-15T10:00:00Z web2 nginx 99 - [x a=\"b\"] GET /", "web2", "GET /", true},
+		{"<34>just a message", "", "just a message", true},
+		{"<999>too high", "", "", false},
+		{"no priority", "", "", false},
+		{"<34>", "", "", false},
+	}
+	for _, tt := range tests {
+		host, msg, ok := parseSyslog(tt.frame)
+		if host != tt.host || msg != tt.msg || ok != tt.ok {
+			t.Errorf("parseSyslog(%q) = %q, %q, %v, want %q, %q, %v", tt.frame, host, msg, ok, tt.host, tt.msg, tt.ok)
+		}
+	}
+}
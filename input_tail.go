@@ -0,0 +1,150 @@
+// input_tail.go
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the tailed file is checked for new data, truncation and rotation
+const tailPollInterval = 250 * time.Millisecond
+
+// tailSource follows a log file the way `tail -F` does, reopening it when
+// logrotate truncates or replaces it
+type tailSource struct {
+	path      string
+	fromStart bool
+	grace     time.Duration
+
+	lines chan Line
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newTailSource() (InputSource, error) {
+	t := &tailSource{
+		path:      os.Getenv("LOG_PATH"),
+		fromStart: envBool("LOG_FROM_START", false),
+		grace:     envDuration("LOG_MISSING_GRACE", 30*time.Second),
+		lines:     make(chan Line),
+		done:      make(chan struct{}),
+	}
+	if t.path == "" {
+		return nil, errMissingSetting("LOG_PATH")
+	}
+
+	go t.run()
+	return t, nil
+}
+
+func (t *tailSource) run() {
+	defer close(t.lines)
+
+	var f *os.File
+	var reader *bufio.Reader
+	var offset int64
+	var partial string
+	var missingSince time.Time
+	warned := false
+	// Only a file that is there at startup honors fromStart, one that appears
+	// later or replaces it after a rotation is new and read from the beginning
+	seekEnd := !t.fromStart
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if f == nil {
+			var err error
+			f, err = os.Open(t.path)
+			if err != nil {
+				f = nil
+				seekEnd = false
+				if missingSince.IsZero() {
+					missingSince = time.Now()
+				}
+				if !warned && time.Since(missingSince) > t.grace {
+					log.Printf("Warning: %s has been missing for over %s: %s", t.path, t.grace, err)
+					warned = true
+				}
+			} else {
+				if warned {
+					log.Printf("%s is back, resuming", t.path)
+				}
+				missingSince = time.Time{}
+				warned = false
+
+				offset = 0
+				if seekEnd {
+					offset, _ = f.Seek(0, io.SeekEnd)
+				}
+				seekEnd = false
+				reader = bufio.NewReader(f)
+			}
+		}
+
+		if f != nil {
+			// Read every complete line written since the last poll
+			for {
+				chunk, err := reader.ReadString('\n')
+				offset += int64(len(chunk))
+				if err != nil {
+					// Hold on to half written lines until the rest arrives
+					partial += chunk
+					break
+				}
+
+				line := strings.TrimRight(partial+chunk, "\r\n")
+				partial = ""
+				select {
+				case t.lines <- Line{Text: line}:
+				case <-t.done:
+					f.Close()
+					return
+				}
+			}
+
+			openInfo, err := f.Stat()
+			pathInfo, perr := os.Stat(t.path)
+			if err != nil || perr != nil || !os.SameFile(openInfo, pathInfo) {
+				// The file was renamed or removed, everything left in the
+				// old one has been read so switch over to the new one
+				log.Printf("%s was rotated, reopening", t.path)
+				f.Close()
+				f = nil
+				partial = ""
+			} else if pathInfo.Size() < offset {
+				log.Printf("%s was truncated, reading from the start", t.path)
+				f.Seek(0, io.SeekStart)
+				reader.Reset(f)
+				offset = 0
+				partial = ""
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			if f != nil {
+				f.Close()
+			}
+			return
+		}
+	}
+}
+
+func (t *tailSource) Lines() <-chan Line {
+	return t.lines
+}
+
+func (t *tailSource) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+	})
+	return nil
+}
@@ -0,0 +1,165 @@
+// input_tcp.go
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var tcpDisconnected = expvar.NewInt("tcp_disconnected")
+
+// tcpSource accepts any number of connections that each write newline
+// delimited log lines. Connections that go quiet for too long or send lines
+// longer than the limit are dropped.
+type tcpSource struct {
+	listener    net.Listener
+	idleTimeout time.Duration
+	maxLine     int
+
+	conns      map[net.Conn]*tcpConn
+	conns_lock sync.Mutex
+	wg         sync.WaitGroup
+
+	lines chan Line
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Per connection stats for /health
+type tcpConn struct {
+	Addr  string    `json:"addr"`
+	Since time.Time `json:"since"`
+	Lines int64     `json:"lines"`
+}
+
+func newTCPSource() (InputSource, error) {
+	addr := os.Getenv("TCP_INGEST_ADDR")
+	if addr == "" {
+		return nil, errMissingSetting("TCP_INGEST_ADDR")
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Listening for log lines on tcp %s", addr)
+
+	s := &tcpSource{
+		listener:    l,
+		idleTimeout: envDuration("TCP_INGEST_IDLE_TIMEOUT", 5*time.Minute),
+		maxLine:     envInt("TCP_INGEST_MAX_LINE", 16*1024),
+		conns:       make(map[net.Conn]*tcpConn),
+		lines:       make(chan Line),
+		done:        make(chan struct{}),
+	}
+	registerHealth("tcp", s.health)
+
+	s.wg.Add(1)
+	go s.accept()
+	go func() {
+		s.wg.Wait()
+		close(s.lines)
+	}()
+	return s, nil
+}
+
+func (s *tcpSource) accept() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				log.Printf("Error accepting tcp connection: %s", err)
+			}
+			return
+		}
+
+		s.conns_lock.Lock()
+		s.conns[conn] = &tcpConn{Addr: conn.RemoteAddr().String(), Since: time.Now()}
+		s.conns_lock.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+func (s *tcpSource) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		conn.Close()
+		s.conns_lock.Lock()
+		delete(s.conns, conn)
+		s.conns_lock.Unlock()
+	}()
+
+	s.conns_lock.Lock()
+	stats := s.conns[conn]
+	s.conns_lock.Unlock()
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), s.maxLine)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		if !scanner.Scan() {
+			break
+		}
+		atomic.AddInt64(&stats.Lines, 1)
+
+		select {
+		case s.lines <- Line{Text: scanner.Text(), Origin: host}:
+		case <-s.done:
+			return
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		// Too long a line, an idle timeout or a broken connection
+		select {
+		case <-s.done:
+		default:
+			log.Printf("Dropping tcp connection from %s: %s", conn.RemoteAddr(), err)
+			tcpDisconnected.Add(1)
+		}
+	}
+}
+
+func (s *tcpSource) health() interface{} {
+	s.conns_lock.Lock()
+	defer s.conns_lock.Unlock()
+
+	conns := make([]tcpConn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, tcpConn{Addr: c.Addr, Since: c.Since, Lines: atomic.LoadInt64(&c.Lines)})
+	}
+	return map[string]interface{}{
+		"connections": len(conns),
+		"peers":       conns,
+	}
+}
+
+func (s *tcpSource) Lines() <-chan Line {
+	return s.lines
+}
+
+func (s *tcpSource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.listener.Close()
+		s.conns_lock.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.conns_lock.Unlock()
+	})
+	return nil
+}
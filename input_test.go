@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReaderSource(t *testing.T) {
+	s := newReaderSource(io.NopCloser(strings.NewReader("one\ntwo\r\n\nthree")))
+	var got []string
+	for l := range s.Lines() {
+		got = append(got, l.Text)
+	}
+	if want := []string{"one", "two", "", "three"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+	if s.Err() != io.EOF {
+		t.Errorf("stopped with %v, want EOF", s.Err())
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReaderSourceClose(t *testing.T) {
+	r, w := io.Pipe()
+	s := newReaderSource(r)
+	go io.WriteString(w, "one\ntwo\n")
+	if l := <-s.Lines(); l.Text != "one" {
+		t.Fatalf("got %q", l.Text)
+	}
+	s.Close()
+	// Whatever was on its way, the channel is closed and nothing blocks
+	for range s.Lines() {
+	}
+	// Closing twice is fine
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewInputSource(t *testing.T) {
+	// Record which constructor is picked instead of opening anything
+	var picked string
+	old := inputSources
+	inputSources = make(map[string]func() (InputSource, error))
+	for name := range old {
+		inputSources[name] = func() (InputSource, error) {
+			picked = name
+			return newSliceSource(), nil
+		}
+	}
+	t.Cleanup(func() { inputSources = old })
+
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+		err  string
+	}{
+		{want: "stdin"},
+		{env: map[string]string{"LOG_PATH": "/var/log/nginx/access.log"}, want: "file"},
+		{env: map[string]string{"INPUT_SOURCE": "syslog"}, want: "syslog"},
+		// Naming the source settles it when several are configured
+		{env: map[string]string{"INPUT_SOURCE": "kafka", "LOG_PATH": "x", "KAFKA_BROKERS": "x"}, want: "kafka"},
+		{env: map[string]string{"LOG_PATH": "x", "KAFKA_BROKERS": "x"}, err: "more than one input source configured (file, kafka)"},
+		{env: map[string]string{"INPUT_SOURCE": "carrier-pigeon"}, err: `unknown INPUT_SOURCE "carrier-pigeon"`},
+	} {
+		t.Run(tt.want+tt.err, func(t *testing.T) {
+			for _, key := range triggerVars {
+				t.Setenv(key, "")
+			}
+			t.Setenv("INPUT_SOURCE", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			picked = ""
+
+			src, err := newInputSource()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			src.Close()
+			if picked != tt.want {
+				t.Errorf("picked %q, want %q", picked, tt.want)
+			}
+		})
+	}
+}
+
+// triggerVars are the variables in inputTriggers, cleared so whatever the
+// tests run with doesn't pick a source
+var triggerVars = []string{
+	"LOG_PATH", "SYSLOG_LISTEN", "KAFKA_BROKERS", "REDIS_ADDR", "NATS_URL",
+	"JOURNAL_UNIT", "UDP_INGEST_ADDR", "AMQP_URL", "SPOOL_DIR",
+	"TCP_INGEST_ADDR", "S3_BUCKET", "FLUENT_LISTEN", "INPUT_FIFO",
+}
+
+// Any source can drive the whole pipeline, here one that's just a list
+func TestFakeSourceBroadcasts(t *testing.T) {
+	geoPassThrough.Store(true)
+	t.Cleanup(func() { geoPassThrough.Store(false) })
+	c := testClient(t, "fake-source", 4)
+
+	readLines(newSliceSource(
+		logLine("192.0.2.10", "/ubuntu/pool/a.deb", "200", 100),
+		"not a log line",
+		logLine("192.0.2.11", "/debian/pool/b.deb", "200", 100),
+	))
+
+	var got []string
+	for len(c.ch) > 0 {
+		var j jsonEvent
+		if err := json.Unmarshal((<-c.ch).data, &j); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, j.Distro)
+	}
+	// Workers finish in any order
+	sort.Strings(got)
+	if strings.Join(got, ",") != "debian,ubuntu" {
+		t.Errorf("got events for %q, want ubuntu and debian", got)
+	}
+}
+
+// readTailed waits for the next line from s
+func readTailed(t *testing.T, s InputSource) string {
+	t.Helper()
+	select {
+	case l := <-s.Lines():
+		return l.Text
+	case <-time.After(5 * time.Second):
+		t.Fatal("no line")
+		return ""
+	}
+}
+
+// Lines already in LOG_PATH at startup are skipped, but a file that only
+// appears later is read from the start
+func TestTailSourceStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	t.Setenv("LOG_PATH", path)
+	if err := os.WriteFile(path, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newTailSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	time.Sleep(2 * tailPollInterval)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, "new\n")
+	f.Close()
+	if got := readTailed(t, s); got != "new" {
+		t.Errorf("got %q from a file there at startup, want new", got)
+	}
+
+	missing := filepath.Join(t.TempDir(), "access.log")
+	t.Setenv("LOG_PATH", missing)
+	s, err = newTailSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	time.Sleep(2 * tailPollInterval)
+	if err := os.WriteFile(missing, []byte("first\nsecond\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"first", "second"} {
+		if got := readTailed(t, s); got != want {
+			t.Errorf("got %q from a file that appeared later, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// input_udp.go
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+var udpDropped = expvar.NewInt("udp_dropped")
+var udpOversized = expvar.NewInt("udp_oversized")
+
+// udpSource reads one log line per datagram. Reading never waits on the rest
+// of the pipeline, when the queue is full datagrams are dropped and counted
+// so senders never feel any backpressure.
+type udpSource struct {
+	conn    net.PacketConn
+	maxSize int
+	lines   chan Line
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newUDPSource() (InputSource, error) {
+	addr := os.Getenv("UDP_INGEST_ADDR")
+	if addr == "" {
+		return nil, errMissingSetting("UDP_INGEST_ADDR")
+	}
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Listening for log datagrams on %s", addr)
+
+	s := &udpSource{
+		conn:    conn,
+		maxSize: envInt("UDP_INGEST_MAX_DATAGRAM", 8192),
+		lines:   make(chan Line, envInt("UDP_INGEST_QUEUE", 1024)),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *udpSource) run() {
+	defer close(s.lines)
+
+	// One spare byte so anything over the limit can be told apart
+	buf := make([]byte, s.maxSize+1)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				log.Printf("Error reading log datagram: %s", err)
+			}
+			return
+		}
+
+		if n > s.maxSize {
+			// A cut off line would only parse into garbage
+			udpOversized.Add(1)
+			continue
+		}
+
+		host, _, _ := net.SplitHostPort(addr.String())
+		line := Line{Text: strings.TrimRight(string(buf[:n]), "\r\n"), Origin: host}
+		select {
+		case s.lines <- line:
+		default:
+			udpDropped.Add(1)
+		}
+	}
+}
+
+func (s *udpSource) Lines() <-chan Line {
+	return s.lines
+}
+
+func (s *udpSource) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,24 @@
+// distro.go
+package parse
+
+import "strings"
+
+// ExtractDistro takes the first segment of a request path, "/ubuntu/dists/..."
+// is ubuntu
+func ExtractDistro(path string) string {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.IndexAny(path, "/?#"); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// NormalizeDistro cleans up an extracted distro name, dropping any query
+// string or fragment and trailing punctuation. Case is left alone, matching
+// it against known names is up to the caller.
+func NormalizeDistro(name string) string {
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.TrimRight(name, ".,;:!'\")")
+}
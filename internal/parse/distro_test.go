@@ -0,0 +1,41 @@
+package parse
+
+import "testing"
+
+func TestExtractDistro(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"/ubuntu/dists/jammy/InRelease", "ubuntu"},
+		{"/archlinux/core/os/x86_64/core.db", "archlinux"},
+		{"debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb", "debian"},
+		{"/fedora?arch=x86_64", "fedora"},
+		{"/alpine#top", "alpine"},
+		{"/", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := ExtractDistro(tt.path); got != tt.want {
+			t.Errorf("ExtractDistro(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeDistro(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"ubuntu", "ubuntu"},
+		{"Ubuntu", "Ubuntu"},
+		{"ubuntu?x=1", "ubuntu"},
+		{"ubuntu#frag", "ubuntu"},
+		{"debian.", "debian"},
+		{"\"mint\")", "\"mint"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeDistro(tt.name); got != tt.want {
+			t.Errorf("NormalizeDistro(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
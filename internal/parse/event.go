@@ -0,0 +1,280 @@
+// event.go
+
+// Package parse holds the parts of line handling that don't depend on how
+// the server is configured: reading client addresses and distros out of a
+// request, and the wire encoding of events sent to clients.
+package parse
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
+)
+
+// Event is a single download to show on the map
+type Event struct {
+	Distro int
+	Lat    float64
+	Long   float64
+	// When the download happened according to the log
+	Time time.Time
+	// Size of the response, 0 when unknown
+	Bytes uint64
+	// What kind of client made the request
+	Agent uint8
+	// Network the client is on, 0 and "" when unknown
+	ASN uint32
+	Org string
+	// Flag bits describing the event
+	Flags uint8
+	// What sort of traffic it was, like a package or an image
+	Kind uint8
+	// How far off the location could be in km, 0 when unknown
+	Radius uint16
+	// Two letter ISO code of the client's country and the name of its city,
+	// "" when unknown
+	Country string
+	City    string
+	// Position in the stream of events sent, the same for every client. It
+	// wraps around to 0 after the largest uint32.
+	Seq uint32
+}
+
+// Bits of Event.Flags
+const (
+	// Only the country is known, the coordinates are its centre
+	FlagCountry uint8 = 1 << iota
+	// Nothing is known about where the client is, the coordinates mean nothing
+	FlagUnlocated
+)
+
+// Format is one of the message layouts clients can ask for
+type Format int
+
+const (
+	// The distro id followed by the latitude and longitude as little endian float64s
+	Legacy Format = iota
+	// Legacy, then the time in unix milliseconds, the size, the agent class,
+	// the AS number, the flags, the accuracy radius and the kind
+	Extended
+	// Extended, then the length of the network's name and the name itself
+	Full
+	// Full, then the two letter country code (zeros when unknown), the
+	// length of the city's name and the name itself
+	Place
+)
+
+// Wide added to a format sends the distro id as a little endian uint16
+// instead of a byte, moving everything after it along by one. Only framed
+// messages can be wide.
+const Wide Format = 4
+
+// The distro id sent in a byte for distros whose id doesn't fit in one
+const DistroOther = 255
+
+// Sizes of the fixed length messages. Extended messages from older versions
+// were shorter, they're still accepted by DecodeEvent.
+const (
+	LegacySize   = 17
+	ExtendedSize = 42
+)
+
+// Longest name sent, it has to fit its length in a byte
+const maxName = 255
+
+// EncodeEvent builds the message for ev in the given format
+func EncodeEvent(ev Event, format Format) []byte {
+	if format&Wide != 0 {
+		narrow := EncodeEvent(ev, format&^Wide)
+		msg := make([]byte, len(narrow)+1)
+		binary.LittleEndian.PutUint16(msg, uint16(ev.Distro))
+		copy(msg[2:], narrow[1:])
+		return msg
+	}
+	if format == Legacy {
+		msg := make([]byte, LegacySize)
+		putLegacy(msg, ev)
+		return msg
+	}
+
+	org := truncate(ev.Org, maxName)
+	city := truncate(ev.City, maxName)
+	size := ExtendedSize
+	if format >= Full {
+		size += 1 + len(org)
+	}
+	if format == Place {
+		size += 3 + len(city)
+	}
+	msg := make([]byte, size)
+
+	putLegacy(msg, ev)
+	binary.LittleEndian.PutUint64(msg[17:25], uint64(ev.Time.UnixNano()/int64(time.Millisecond)))
+	binary.LittleEndian.PutUint64(msg[25:33], ev.Bytes)
+	msg[33] = ev.Agent
+	binary.LittleEndian.PutUint32(msg[34:38], ev.ASN)
+	msg[38] = ev.Flags
+	binary.LittleEndian.PutUint16(msg[39:41], ev.Radius)
+	msg[41] = ev.Kind
+	if format >= Full {
+		msg[ExtendedSize] = byte(len(org))
+		copy(msg[ExtendedSize+1:], org)
+	}
+	if format == Place {
+		rest := msg[ExtendedSize+1+len(org):]
+		if len(ev.Country) == 2 {
+			copy(rest, ev.Country)
+		}
+		rest[2] = byte(len(city))
+		copy(rest[3:], city)
+	}
+	return msg
+}
+
+func putLegacy(msg []byte, ev Event) {
+	if ev.Distro >= DistroOther {
+		msg[0] = DistroOther
+	} else {
+		msg[0] = byte(ev.Distro)
+	}
+	binary.LittleEndian.PutUint64(msg[1:9], math.Float64bits(ev.Lat))
+	binary.LittleEndian.PutUint64(msg[9:17], math.Float64bits(ev.Long))
+}
+
+// truncate cuts s down to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// DecodeEvent is the reverse of EncodeEvent for any format that isn't Wide
+func DecodeEvent(msg []byte) (Event, error) {
+	var ev Event
+	n := len(msg)
+	// Where the name of the network and the place start, 0 when not sent
+	var org, place int
+	switch {
+	case n == LegacySize, n == 25, n == 33, n == 34, n == 38, n == 39, n == 41, n == ExtendedSize:
+	case n > ExtendedSize && n == ExtendedSize+1+int(msg[ExtendedSize]):
+		org = ExtendedSize + 1
+	case n > ExtendedSize && n >= ExtendedSize+4+int(msg[ExtendedSize]):
+		org = ExtendedSize + 1
+		place = org + int(msg[ExtendedSize])
+		if n != place+3+int(msg[place+2]) {
+			return ev, fmt.Errorf("message is %d bytes, which isn't any known format", n)
+		}
+	default:
+		return ev, fmt.Errorf("message is %d bytes, which isn't any known format", n)
+	}
+
+	ev.Distro = int(msg[0])
+	ev.Lat = math.Float64frombits(binary.LittleEndian.Uint64(msg[1:9]))
+	ev.Long = math.Float64frombits(binary.LittleEndian.Uint64(msg[9:17]))
+	if n >= 25 {
+		ms := int64(binary.LittleEndian.Uint64(msg[17:25]))
+		ev.Time = time.Unix(0, ms*int64(time.Millisecond))
+	} else {
+		ev.Time = time.Now()
+	}
+	if n >= 33 {
+		ev.Bytes = binary.LittleEndian.Uint64(msg[25:33])
+	}
+	if n >= 34 {
+		ev.Agent = msg[33]
+	}
+	if n >= 38 {
+		ev.ASN = binary.LittleEndian.Uint32(msg[34:38])
+	}
+	if n >= 39 {
+		ev.Flags = msg[38]
+	}
+	if n >= 41 {
+		ev.Radius = binary.LittleEndian.Uint16(msg[39:41])
+	}
+	if n >= ExtendedSize {
+		ev.Kind = msg[41]
+	}
+	if org > 0 {
+		ev.Org = string(msg[org : org+int(msg[ExtendedSize])])
+	}
+	if place > 0 {
+		if msg[place] != 0 {
+			ev.Country = string(msg[place : place+2])
+		}
+		ev.City = string(msg[place+3:])
+	}
+	return ev, nil
+}
+
+// Framed messages start with FrameMagic, a version byte, which is the Format
+// of the rest of the message, and the event's Seq as a little endian uint32,
+// so a client can tell what it's been sent without going by the length and
+// notice when it missed something. Version 0 is followed by a legacy message,
+// version 4 by a Wide legacy message.
+const FrameMagic = 0xfe
+
+// The version of control messages, which aren't events. The byte after it
+// says what kind of control message it is and the rest is JSON.
+const FrameControl = 0xff
+
+// Bytes in front of the message in a frame
+const frameHeader = 6
+
+// EncodeFrame builds a framed message for ev in the given format
+func EncodeFrame(ev Event, format Format) []byte {
+	msg := make([]byte, frameHeader, 64)
+	msg[0] = FrameMagic
+	msg[1] = byte(format)
+	binary.LittleEndian.PutUint32(msg[2:6], ev.Seq)
+	return append(msg, EncodeEvent(ev, format)...)
+}
+
+// DecodeFrame is the reverse of EncodeFrame, returning the format the message
+// was in
+func DecodeFrame(msg []byte) (Event, Format, error) {
+	if len(msg) < frameHeader || msg[0] != FrameMagic {
+		return Event{}, 0, fmt.Errorf("message isn't framed")
+	}
+	format := Format(msg[1])
+	if format > Place|Wide {
+		return Event{}, 0, fmt.Errorf("unknown frame version %d", msg[1])
+	}
+
+	body := msg[frameHeader:]
+	var distro int
+	if format&Wide != 0 {
+		if len(body) < 2 {
+			return Event{}, 0, fmt.Errorf("version %d frame is %d bytes, which doesn't fit", format, len(msg))
+		}
+		// Put it back the way DecodeEvent reads it
+		distro = int(binary.LittleEndian.Uint16(body))
+		body = append([]byte{0}, body[2:]...)
+	}
+	var ok bool
+	switch format &^ Wide {
+	case Legacy:
+		ok = len(body) == LegacySize
+	case Extended:
+		ok = len(body) == ExtendedSize
+	case Full:
+		ok = len(body) > ExtendedSize && len(body) == ExtendedSize+1+int(body[ExtendedSize])
+	case Place:
+		ok = len(body) > ExtendedSize && len(body) >= ExtendedSize+4+int(body[ExtendedSize])
+	}
+	if !ok {
+		return Event{}, 0, fmt.Errorf("version %d frame is %d bytes, which doesn't fit", format, len(msg))
+	}
+	ev, err := DecodeEvent(body)
+	if format&Wide != 0 {
+		ev.Distro = distro
+	}
+	ev.Seq = binary.LittleEndian.Uint32(msg[2:6])
+	return ev, format, err
+}
@@ -0,0 +1,243 @@
+package parse
+
+import (
+	"bytes"
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Events for the golden files, the same every run
+var goldenEvents = []Event{
+	{Distro: 0, Lat: 0, Long: 0},
+	{Distro: 3, Lat: 51.5074, Long: -0.1278},
+	{Distro: 42, Lat: -33.8688, Long: 151.2093},
+	{Distro: 254, Lat: 90, Long: -180},
+	// Too big for a byte, sent as DistroOther
+	{Distro: 300, Lat: 35.6762, Long: 139.6503},
+	// Without GeoIP
+	{Distro: 1, Lat: math.NaN(), Long: math.NaN()},
+}
+
+// golden compares got with testdata/name, or writes it there with -update
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s changed\ngot  %x\nwant %x", name, got, want)
+	}
+}
+
+// Frontends read these byte for byte, they can't change
+func TestLegacyGolden(t *testing.T) {
+	var got []byte
+	for _, ev := range goldenEvents {
+		msg := EncodeEvent(ev, Legacy)
+		if len(msg) != LegacySize {
+			t.Fatalf("legacy message is %d bytes, want %d", len(msg), LegacySize)
+		}
+		got = append(got, msg...)
+	}
+	golden(t, "legacy.golden", got)
+}
+
+func TestEncodeLegacy(t *testing.T) {
+	got := EncodeEvent(Event{Distro: 7, Lat: 1, Long: -2}, Legacy)
+	want := []byte{
+		7,
+		0, 0, 0, 0, 0, 0, 0xf0, 0x3f,
+		0, 0, 0, 0, 0, 0, 0, 0xc0,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestEventRoundTrip(t *testing.T) {
+	ev := Event{
+		Distro:  9,
+		Lat:     48.8566,
+		Long:    2.3522,
+		Time:    time.UnixMilli(1700000000123),
+		Bytes:   1 << 33,
+		Agent:   2,
+		ASN:     64500,
+		Org:     "Example Net",
+		Flags:   FlagCountry,
+		Kind:    1,
+		Radius:  50,
+		Country: "FR",
+		City:    "Paris",
+	}
+	tests := []struct {
+		format Format
+		want   Event
+	}{
+		{Extended, Event{Distro: ev.Distro, Lat: ev.Lat, Long: ev.Long, Time: ev.Time, Bytes: ev.Bytes, Agent: ev.Agent, ASN: ev.ASN, Flags: ev.Flags, Kind: ev.Kind, Radius: ev.Radius}},
+		{Full, Event{Distro: ev.Distro, Lat: ev.Lat, Long: ev.Long, Time: ev.Time, Bytes: ev.Bytes, Agent: ev.Agent, ASN: ev.ASN, Org: ev.Org, Flags: ev.Flags, Kind: ev.Kind, Radius: ev.Radius}},
+		{Place, ev},
+	}
+	for _, tt := range tests {
+		got, err := DecodeEvent(EncodeEvent(ev, tt.format))
+		if err != nil {
+			t.Fatalf("format %d: %s", tt.format, err)
+		}
+		if !got.Time.Equal(tt.want.Time) {
+			t.Errorf("format %d: time %s, want %s", tt.format, got.Time, tt.want.Time)
+		}
+		got.Time = tt.want.Time
+		if got != tt.want {
+			t.Errorf("format %d: got %+v, want %+v", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	ev := Event{Distro: 700, Lat: 10, Long: 20, Seq: math.MaxUint32}
+	for _, format := range []Format{Legacy, Legacy | Wide, Extended | Wide} {
+		msg := EncodeFrame(ev, format)
+		got, gotFormat, err := DecodeFrame(msg)
+		if err != nil {
+			t.Fatalf("format %d: %s", format, err)
+		}
+		if gotFormat != format || got.Seq != ev.Seq || got.Lat != ev.Lat || got.Long != ev.Long {
+			t.Errorf("format %d: got %+v in format %d", format, got, gotFormat)
+		}
+		wantDistro := DistroOther
+		if format&Wide != 0 {
+			wantDistro = ev.Distro
+		}
+		if got.Distro != wantDistro {
+			t.Errorf("format %d: distro %d, want %d", format, got.Distro, wantDistro)
+		}
+	}
+}
+
+func TestDecodeEventBadLength(t *testing.T) {
+	for _, n := range []int{0, 16, 18, 44} {
+		if _, err := DecodeEvent(make([]byte, n)); err == nil {
+			t.Errorf("%d byte message decoded", n)
+		}
+	}
+}
+
+func TestPlaceNames(t *testing.T) {
+	long := strings.Repeat("ü", 200)
+	tests := []struct {
+		country, city string
+		wantCountry   string
+		wantCity      string
+	}{
+		{"DE", "München", "DE", "München"},
+		{"JP", "東京", "JP", "東京"},
+		{"KR", "서울특별시", "KR", "서울특별시"},
+		// Known country, unknown city
+		{"FR", "", "FR", ""},
+		{"", "", "", ""},
+		// Not a two letter code, sent as unknown
+		{"DEU", "Berlin", "", "Berlin"},
+		// Cut to 255 bytes without splitting a character
+		{"AT", long, "AT", long[:254]},
+	}
+	for _, tt := range tests {
+		ev := Event{Distro: 5, Lat: 48.1, Long: 11.6, Country: tt.country, City: tt.city}
+		msg := EncodeEvent(ev, Place)
+		got, err := DecodeEvent(msg)
+		if err != nil {
+			t.Fatalf("%q %q: %s", tt.country, tt.city, err)
+		}
+		if got.Country != tt.wantCountry || got.City != tt.wantCity {
+			t.Errorf("%q %q came back as %q %q", tt.country, tt.city, got.Country, got.City)
+		}
+		if !utf8.ValidString(got.City) {
+			t.Errorf("%q came back as invalid UTF-8", tt.city)
+		}
+		// Everything before the place is the legacy message
+		if !bytes.Equal(msg[:LegacySize], EncodeEvent(ev, Legacy)) {
+			t.Errorf("%q %q doesn't start with the legacy message", tt.country, tt.city)
+		}
+	}
+}
+
+// Every version decodes to what its format carries, and the body after the
+// header is the unframed message
+func TestFrameVersions(t *testing.T) {
+	ev := Event{
+		Distro: 7, Lat: 48.8566, Long: 2.3522, Time: time.UnixMilli(1700000000123),
+		Bytes: 1234, Agent: 1, ASN: 64500, Org: "Example Net", Flags: FlagCountry,
+		Kind: 2, Radius: 50, Country: "FR", City: "Paris", Seq: 99,
+	}
+	for _, format := range []Format{Legacy, Extended, Full, Place} {
+		for _, version := range []Format{format, format | Wide} {
+			msg := EncodeFrame(ev, version)
+			if msg[0] != FrameMagic || Format(msg[1]) != version {
+				t.Fatalf("version %d starts %x", version, msg[:2])
+			}
+			if !bytes.Equal(msg[frameHeader:], EncodeEvent(ev, version)) {
+				t.Errorf("version %d body isn't the unframed message", version)
+			}
+
+			got, gotVersion, err := DecodeFrame(msg)
+			if err != nil {
+				t.Fatalf("version %d: %s", version, err)
+			}
+			want, _ := DecodeEvent(EncodeEvent(ev, format))
+			want.Seq = ev.Seq
+			if gotVersion != version {
+				t.Errorf("version %d came back as %d", version, gotVersion)
+			}
+			// Legacy messages have no time, they get the time they're read
+			if format != Legacy && !got.Time.Equal(want.Time) {
+				t.Errorf("version %d: time %s, want %s", version, got.Time, want.Time)
+			}
+			got.Time = want.Time
+			if got != want {
+				t.Errorf("version %d: got %+v, want %+v", version, got, want)
+			}
+		}
+	}
+
+	// Version 0 is a legacy message with the header in front
+	if msg := EncodeFrame(ev, Legacy); len(msg) != frameHeader+LegacySize {
+		t.Errorf("version 0 frame is %d bytes", len(msg))
+	}
+}
+
+func TestDecodeFrameErrors(t *testing.T) {
+	ev := Event{Distro: 3, Lat: 1, Long: 2}
+	framed := EncodeFrame(ev, Extended)
+	unknown := append([]byte(nil), framed...)
+	unknown[1] = byte(Place|Wide) + 1
+
+	for name, msg := range map[string][]byte{
+		"empty":         nil,
+		"header only":   framed[:frameHeader],
+		"unframed":      EncodeEvent(ev, Legacy),
+		"truncated":     framed[:len(framed)-1],
+		"too long":      append(EncodeFrame(ev, Legacy), 0),
+		"wide no body":  EncodeFrame(ev, Wide)[:frameHeader+1],
+		"unknown":       unknown,
+		"control":       {FrameMagic, FrameControl, 0, 0, 0, 0, '{', '}'},
+		"name past end": append(EncodeFrame(Event{Org: "abc"}, Full)[:frameHeader+ExtendedSize], 5, 'a'),
+	} {
+		if _, _, err := DecodeFrame(msg); err == nil {
+			t.Errorf("%s frame decoded", name)
+		}
+	}
+}
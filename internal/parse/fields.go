@@ -0,0 +1,182 @@
+// fields.go
+package parse
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldMask picks which fields a masked message has, bit i for fields[i]
+type FieldMask uint32
+
+// field is one optional part of a masked message
+type field struct {
+	name string
+	put  func(msg []byte, ev Event) []byte
+	// get reads the field from the start of msg and returns the rest
+	get func(msg []byte, ev *Event) ([]byte, error)
+}
+
+// fields in the order they're sent in a masked message. New ones go on the
+// end so existing masks keep their meaning.
+var fields = []field{
+	{"time", func(msg []byte, ev Event) []byte {
+		return binary.LittleEndian.AppendUint64(msg, uint64(ev.Time.UnixNano()/int64(time.Millisecond)))
+	}, fixed(8, func(b []byte, ev *Event) {
+		ev.Time = time.Unix(0, int64(binary.LittleEndian.Uint64(b))*int64(time.Millisecond))
+	})},
+	{"bytes", func(msg []byte, ev Event) []byte {
+		return binary.LittleEndian.AppendUint64(msg, ev.Bytes)
+	}, fixed(8, func(b []byte, ev *Event) { ev.Bytes = binary.LittleEndian.Uint64(b) })},
+	{"agent", func(msg []byte, ev Event) []byte {
+		return append(msg, ev.Agent)
+	}, fixed(1, func(b []byte, ev *Event) { ev.Agent = b[0] })},
+	{"asn", func(msg []byte, ev Event) []byte {
+		return binary.LittleEndian.AppendUint32(msg, ev.ASN)
+	}, fixed(4, func(b []byte, ev *Event) { ev.ASN = binary.LittleEndian.Uint32(b) })},
+	{"flags", func(msg []byte, ev Event) []byte {
+		return append(msg, ev.Flags)
+	}, fixed(1, func(b []byte, ev *Event) { ev.Flags = b[0] })},
+	{"radius", func(msg []byte, ev Event) []byte {
+		return binary.LittleEndian.AppendUint16(msg, ev.Radius)
+	}, fixed(2, func(b []byte, ev *Event) { ev.Radius = binary.LittleEndian.Uint16(b) })},
+	{"kind", func(msg []byte, ev Event) []byte {
+		return append(msg, ev.Kind)
+	}, fixed(1, func(b []byte, ev *Event) { ev.Kind = b[0] })},
+	{"org", func(msg []byte, ev Event) []byte {
+		return putName(msg, ev.Org)
+	}, named(func(s string, ev *Event) { ev.Org = s })},
+	{"country", func(msg []byte, ev Event) []byte {
+		if len(ev.Country) == 2 {
+			return append(msg, ev.Country...)
+		}
+		return append(msg, 0, 0)
+	}, fixed(2, func(b []byte, ev *Event) {
+		if b[0] != 0 {
+			ev.Country = string(b)
+		}
+	})},
+	{"city", func(msg []byte, ev Event) []byte {
+		return putName(msg, ev.City)
+	}, named(func(s string, ev *Event) { ev.City = s })},
+	{"seq", func(msg []byte, ev Event) []byte {
+		return binary.LittleEndian.AppendUint32(msg, ev.Seq)
+	}, fixed(4, func(b []byte, ev *Event) { ev.Seq = binary.LittleEndian.Uint32(b) })},
+}
+
+// fixed reads a field that's always n bytes with read
+func fixed(n int, read func(b []byte, ev *Event)) func([]byte, *Event) ([]byte, error) {
+	return func(msg []byte, ev *Event) ([]byte, error) {
+		if len(msg) < n {
+			return nil, fmt.Errorf("message ends early")
+		}
+		read(msg[:n], ev)
+		return msg[n:], nil
+	}
+}
+
+// named reads a field written by putName
+func named(read func(s string, ev *Event)) func([]byte, *Event) ([]byte, error) {
+	return func(msg []byte, ev *Event) ([]byte, error) {
+		if len(msg) < 1 || len(msg) < 1+int(msg[0]) {
+			return nil, fmt.Errorf("message ends early")
+		}
+		n := 1 + int(msg[0])
+		read(string(msg[1:n]), ev)
+		return msg[n:], nil
+	}
+}
+
+// putName appends a length byte and s, cut down to fit
+func putName(msg []byte, s string) []byte {
+	s = truncate(s, maxName)
+	return append(append(msg, byte(len(s))), s...)
+}
+
+// ParseFieldMask reads a mask written as a comma separated list of field
+// names or as a number
+func ParseFieldMask(s string) (FieldMask, error) {
+	if n, err := strconv.ParseUint(s, 0, 32); err == nil {
+		if n >= 1<<len(fields) {
+			return 0, fmt.Errorf("field mask %s has bits for fields that don't exist", s)
+		}
+		return FieldMask(n), nil
+	}
+
+	var mask FieldMask
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		i := fieldIndex(f)
+		if i < 0 {
+			return 0, fmt.Errorf("unknown field %q", f)
+		}
+		mask |= 1 << i
+	}
+	return mask, nil
+}
+
+func fieldIndex(name string) int {
+	for i, f := range fields {
+		if f.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// String lists the fields in m in the order they're sent
+func (m FieldMask) String() string {
+	var names []string
+	for i, f := range fields {
+		if m&(1<<i) != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// EncodeMasked builds a masked message for ev: the distro id as a little
+// endian uint16, the latitude and longitude as little endian float64s, then
+// every field in mask in the order of fields
+func EncodeMasked(ev Event, mask FieldMask) []byte {
+	msg := make([]byte, 18, 64)
+	binary.LittleEndian.PutUint16(msg, uint16(ev.Distro))
+	binary.LittleEndian.PutUint64(msg[2:10], math.Float64bits(ev.Lat))
+	binary.LittleEndian.PutUint64(msg[10:18], math.Float64bits(ev.Long))
+	for i, f := range fields {
+		if mask&(1<<i) != 0 {
+			msg = f.put(msg, ev)
+		}
+	}
+	return msg
+}
+
+// DecodeMasked is the reverse of EncodeMasked for a message built with mask
+func DecodeMasked(msg []byte, mask FieldMask) (Event, error) {
+	var ev Event
+	if len(msg) < 18 {
+		return ev, fmt.Errorf("message is %d bytes, which is too short", len(msg))
+	}
+	ev.Distro = int(binary.LittleEndian.Uint16(msg))
+	ev.Lat = math.Float64frombits(binary.LittleEndian.Uint64(msg[2:10]))
+	ev.Long = math.Float64frombits(binary.LittleEndian.Uint64(msg[10:18]))
+
+	rest := msg[18:]
+	for i, f := range fields {
+		if mask&(1<<i) == 0 {
+			continue
+		}
+		var err error
+		if rest, err = f.get(rest, &ev); err != nil {
+			return ev, fmt.Errorf("reading %s: %w", f.name, err)
+		}
+	}
+	if len(rest) > 0 {
+		return ev, fmt.Errorf("%d bytes left over", len(rest))
+	}
+	return ev, nil
+}
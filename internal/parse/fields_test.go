@@ -0,0 +1,129 @@
+package parse
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// randomEvent fills in every field of an event
+func randomEvent(r *rand.Rand) Event {
+	name := func() string {
+		b := make([]byte, r.Intn(40))
+		for i := range b {
+			b[i] = byte('a' + r.Intn(26))
+		}
+		return string(b)
+	}
+	ev := Event{
+		Distro: r.Intn(1 << 16),
+		Lat:    r.Float64()*180 - 90,
+		Long:   r.Float64()*360 - 180,
+		Time:   time.UnixMilli(r.Int63n(1 << 42)),
+		Bytes:  r.Uint64(),
+		Agent:  uint8(r.Intn(256)),
+		ASN:    r.Uint32(),
+		Org:    name(),
+		Flags:  uint8(r.Intn(256)),
+		Kind:   uint8(r.Intn(256)),
+		Radius: uint16(r.Intn(1 << 16)),
+		City:   name(),
+		Seq:    r.Uint32(),
+	}
+	if r.Intn(4) > 0 {
+		ev.Country = string([]byte{byte('A' + r.Intn(26)), byte('A' + r.Intn(26))})
+	}
+	return ev
+}
+
+// masked is ev with only the fields in mask
+func masked(t *testing.T, ev Event, mask FieldMask) Event {
+	got := Event{Distro: ev.Distro, Lat: ev.Lat, Long: ev.Long}
+	for i, f := range fields {
+		if mask&(1<<i) == 0 {
+			continue
+		}
+		switch f.name {
+		case "time":
+			got.Time = ev.Time
+		case "bytes":
+			got.Bytes = ev.Bytes
+		case "agent":
+			got.Agent = ev.Agent
+		case "asn":
+			got.ASN = ev.ASN
+		case "flags":
+			got.Flags = ev.Flags
+		case "radius":
+			got.Radius = ev.Radius
+		case "kind":
+			got.Kind = ev.Kind
+		case "org":
+			got.Org = ev.Org
+		case "country":
+			got.Country = ev.Country
+		case "city":
+			got.City = ev.City
+		case "seq":
+			got.Seq = ev.Seq
+		default:
+			t.Fatalf("field %s needs adding to masked", f.name)
+		}
+	}
+	return got
+}
+
+func TestMaskedRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		mask := FieldMask(r.Intn(1 << len(fields)))
+		ev := randomEvent(r)
+		msg := EncodeMasked(ev, mask)
+
+		got, err := DecodeMasked(msg, mask)
+		if err != nil {
+			t.Fatalf("mask %s: %s", mask, err)
+		}
+		want := masked(t, ev, mask)
+		if !got.Time.Equal(want.Time) {
+			t.Fatalf("mask %s: time %s, want %s", mask, got.Time, want.Time)
+		}
+		got.Time = want.Time
+		if got != want {
+			t.Fatalf("mask %s:\ngot  %+v\nwant %+v", mask, got, want)
+		}
+
+		// Names and numbers for the mask both come back as it
+		for _, s := range []string{mask.String(), strconv.FormatUint(uint64(mask), 10)} {
+			if s == "" {
+				continue
+			}
+			if parsed, err := ParseFieldMask(s); err != nil || parsed != mask {
+				t.Fatalf("%q parsed as %d, want %d: %v", s, parsed, mask, err)
+			}
+		}
+	}
+}
+
+func TestParseFieldMaskErrors(t *testing.T) {
+	for _, s := range []string{"time,nosuchfield", "", "time,,bytes", strconv.Itoa(1 << len(fields)), "-1"} {
+		if mask, err := ParseFieldMask(s); err == nil {
+			t.Errorf("%q parsed as %s", s, mask)
+		}
+	}
+	// Fields come in the table's order whatever order they're asked for in
+	if mask, _ := ParseFieldMask("city,time"); mask.String() != "time,city" {
+		t.Errorf("got %s", mask)
+	}
+}
+
+func TestDecodeMaskedShort(t *testing.T) {
+	mask, _ := ParseFieldMask("time,org,city")
+	msg := EncodeMasked(Event{Org: "Example", City: "Paris"}, mask)
+	for n := 0; n < len(msg); n++ {
+		if _, err := DecodeMasked(msg[:n], mask); err == nil {
+			t.Errorf("%d of %d bytes decoded", n, len(msg))
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// ip.go
+package parse
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ExtractIP reads a client address as written in a log, which may be
+// bracketed IPv6 ("[2001:db8::1]") and may have a port on the end. It returns
+// nil for anything that isn't an address.
+func ExtractIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") {
+		// "[2001:db8::1]" or "[2001:db8::1]:443"
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return nil
+		}
+		rest := s[end+1:]
+		if rest != "" && !validPort(rest) {
+			return nil
+		}
+		s = s[1:end]
+	} else if i := strings.IndexByte(s, ':'); i >= 0 && strings.Count(s, ":") == 1 {
+		// "192.0.2.1:443", bare IPv6 always has more than one colon
+		if !validPort(s[i:]) {
+			return nil
+		}
+		s = s[:i]
+	}
+
+	// Drop an IPv6 zone, "fe80::1%eth0"
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+// validPort checks a ":port" suffix
+func validPort(s string) bool {
+	if len(s) < 2 || s[0] != ':' {
+		return false
+	}
+	_, err := strconv.ParseUint(s[1:], 10, 16)
+	return err == nil
+}
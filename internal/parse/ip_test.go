@@ -0,0 +1,37 @@
+package parse
+
+import "testing"
+
+func TestExtractIP(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:443", "192.0.2.1"},
+		{" 198.51.100.7 ", "198.51.100.7"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:8080", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:http", ""},
+		{"192.0.2.1:99999", ""},
+		{"[2001:db8::1", ""},
+		{"[2001:db8::1]x", ""},
+		{"-", ""},
+		{"", ""},
+		{"mirror.example.org", ""},
+	}
+	for _, tt := range tests {
+		got := ExtractIP(tt.in)
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("ExtractIP(%q) = %s, want nil", tt.in, got)
+			}
+			continue
+		}
+		if got == nil || got.String() != tt.want {
+			t.Errorf("ExtractIP(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
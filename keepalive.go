@@ -0,0 +1,163 @@
+// keepalive.go
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Every websocket is pinged each PING_INTERVAL and closed when nothing, not
+// even a pong, comes back for PONG_WAIT. It keeps NATs from dropping quiet
+// connections and notices clients that went away without closing. 0 turns
+// pings off.
+var pingInterval = envDuration("PING_INTERVAL", 30*time.Second)
+var pongWait = envDuration("PONG_WAIT", 60*time.Second)
+
+// Longest a single write to a websocket or server-sent events stream can take
+// before the client counts as gone, since one that stopped reading would
+// otherwise hold its writer forever
+var writeTimeout = envDuration("WRITE_TIMEOUT", 10*time.Second)
+
+// Clients disconnected for a write taking longer than that
+var writeTimeouts = expvar.NewInt("write_timeouts")
+
+// Longest message a client can send, see handleClientMessage
+const maxClientMessage = 4096
+
+var errPeerGone = errors.New("client stopped answering")
+var errPeerClosed = errors.New("client closed the connection")
+var errClientRemoved = errors.New("client removed")
+
+// initKeepalive checks the keepalive settings
+func initKeepalive() error {
+	if pingInterval > 0 && pongWait <= pingInterval {
+		return fmt.Errorf("PONG_WAIT must be longer than PING_INTERVAL")
+	}
+	if writeTimeout <= 0 {
+		return fmt.Errorf("WRITE_TIMEOUT must be more than 0")
+	}
+	return nil
+}
+
+// timedOut reports whether a write failed for taking longer than
+// writeTimeout, counting it if so. Websocket errors don't wrap the
+// connection's, they only say they're timeouts.
+func timedOut(err error) bool {
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		return false
+	}
+	writeTimeouts.Add(1)
+	return true
+}
+
+// keepalive pings a websocket and reads from it to tell when the client is
+// gone
+type keepalive struct {
+	id     string
+	c      *client
+	conn   *websocket.Conn
+	ticker *time.Ticker
+	dead   chan struct{}
+	// Why reading stopped, set before dead is closed
+	err error
+}
+
+// newKeepalive starts reading from conn for c. Heartbeats ping clients too, so
+// without pings of their own those clients get three heartbeat intervals to
+// answer.
+func newKeepalive(conn *websocket.Conn, id string, c *client) *keepalive {
+	k := &keepalive{id: id, c: c, conn: conn, dead: make(chan struct{})}
+	wait := time.Duration(0)
+	switch {
+	case pingInterval > 0:
+		k.ticker = time.NewTicker(pingInterval)
+		wait = pongWait
+	case c.control && heartbeatInterval > 0:
+		wait = 3 * heartbeatInterval
+	}
+	go k.read(wait)
+	return k
+}
+
+// read reads from the connection until it fails, which is how pongs and close
+// messages get handled, then closes dead. With a wait the read fails when
+// nothing comes for that long. Text messages from the client are passed to
+// handleClientMessage, anything else is thrown away.
+func (k *keepalive) read(wait time.Duration) {
+	defer close(k.dead)
+	k.conn.SetReadLimit(maxClientMessage)
+	extend := func(string) error {
+		if wait > 0 {
+			return k.conn.SetReadDeadline(time.Now().Add(wait))
+		}
+		return nil
+	}
+	extend("")
+	k.conn.SetPongHandler(extend)
+	for {
+		typ, r, err := k.conn.NextReader()
+		if err != nil {
+			k.err = errPeerGone
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				k.err = errPeerClosed
+			}
+			return
+		}
+		extend("")
+		if typ != websocket.TextMessage {
+			continue
+		}
+		msg, err := io.ReadAll(r)
+		if err == nil {
+			err = handleClientMessage(k.id, k.c, msg)
+		}
+		if err != nil {
+			log.Printf("Ignoring message from %s: %s", k.id, err)
+		}
+	}
+}
+
+// C fires when it's time for a ping, it's nil when pings are off
+func (k *keepalive) C() <-chan time.Time {
+	if k.ticker == nil {
+		return nil
+	}
+	return k.ticker.C
+}
+
+// Dead is closed once the client is gone
+func (k *keepalive) Dead() <-chan struct{} {
+	return k.dead
+}
+
+// Err says why the client is gone, once Dead is closed
+func (k *keepalive) Err() error {
+	return k.err
+}
+
+// ping sends a websocket ping
+func (k *keepalive) ping() error {
+	return k.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+}
+
+// writeClose sends a close message saying why the server is closing the
+// connection
+func writeClose(conn *websocket.Conn, code int, reason string) error {
+	msg := websocket.FormatCloseMessage(code, reason)
+	return conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeTimeout))
+}
+
+// stop stops the pings, the reading stops when the connection is closed
+func (k *keepalive) stop() {
+	if k.ticker != nil {
+		k.ticker.Stop()
+	}
+}
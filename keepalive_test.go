@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// A client that stops reading has its connection closed once a write takes
+// longer than writeTimeout
+func TestStalledReaderTimesOut(t *testing.T) {
+	old := writeTimeout
+	writeTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { writeTimeout = old })
+
+	// More than loopback buffers hold, so writes block
+	const n, size = 64, 1 << 20
+	c := testClient(t, "stalled", n)
+	big := make([]byte, size)
+	for i := 0; i < n; i++ {
+		c.ch <- message{data: big}
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/map/socket/{id}", socketHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	before := writeTimeouts.Value()
+	start := time.Now()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/map/socket/stalled", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Never read from it
+	defer conn.Close()
+
+	for writeTimeouts.Value() == before {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("writer still blocked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		var gone bool
+		hub.Update(func() { gone = c.conn == nil })
+		if gone {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out connection wasn't released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,114 @@
+// kind.go
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// eventKind is what sort of traffic a request was, sent to clients as a byte
+type eventKind byte
+
+const (
+	kindUnknown eventKind = iota
+	kindPackage
+	kindImage
+	kindMetadata
+	kindSync
+	kindOther
+)
+
+var eventKindNames = map[eventKind]string{
+	kindUnknown:  "unknown",
+	kindPackage:  "package",
+	kindImage:    "image",
+	kindMetadata: "metadata",
+	kindSync:     "sync",
+	kindOther:    "other",
+}
+
+// Lines seen per kind
+var eventKinds = expvar.NewMap("event_kinds")
+
+// kindRule puts requests whose path or user agent matches re in kind
+type kindRule struct {
+	agent bool
+	re    *regexp.Regexp
+	kind  eventKind
+}
+
+// The rules used when KIND_RULE_FILE isn't set, in the same
+// "kind path|agent regex" format as the file. The first rule that matches
+// wins. Paths are matched without their query string.
+var defaultKindRules = `
+sync agent ^rsync|^quick-fedora-mirror|^ftpsync|^lftp|^Mirror|mirrorbits|^wget.*mirror
+image path \.(iso|img|qcow2|raw|vhdx?|vmdk|ova|wim|dmg)(\.(xz|gz|bz2|zst))?$
+metadata path /(In)?Release(\.gpg)?$|/(Packages|Sources|Contents-[^/]*|Translation-[^/]*)(\.[a-z0-9]+)?$|/repodata/|APKINDEX\.tar\.gz$|\.(db|files|sig|asc|sha256|md5|sum)$|SUMS$
+package path \.(deb|udeb|rpm|apk|xbps|pkg\.tar\.[a-z0-9]+|tbz|txz|tgz|whl|gem|nupkg|msi|exe)$
+other path .
+`
+
+var kindRules []kindRule
+
+// initKindRules loads the event kind rules, from KIND_RULE_FILE if it's set
+func initKindRules() error {
+	rules := defaultKindRules
+	if path := os.Getenv("KIND_RULE_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rules = string(b)
+	}
+
+	names := make(map[string]eventKind)
+	for kind, name := range eventKindNames {
+		names[name] = kind
+	}
+
+	kindRules = nil
+	scanner := bufio.NewScanner(strings.NewReader(rules))
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 3)
+		if fields[0] == "" || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 || (fields[1] != "path" && fields[1] != "agent") {
+			return fmt.Errorf("invalid kind rule %q, expected kind, path or agent and a regex", scanner.Text())
+		}
+		kind, ok := names[fields[0]]
+		if !ok {
+			return fmt.Errorf("unknown event kind %q", fields[0])
+		}
+		re, err := regexp.Compile(strings.TrimSpace(fields[2]))
+		if err != nil {
+			return fmt.Errorf("invalid kind regex for %s: %s", fields[0], err)
+		}
+		kindRules = append(kindRules, kindRule{fields[1] == "agent", re, kind})
+	}
+	return nil
+}
+
+// classifyKind finds the kind of a request and counts it
+func classifyKind(path, agent string) eventKind {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	kind := kindUnknown
+	for _, r := range kindRules {
+		s := path
+		if r.agent {
+			s = agent
+		}
+		if s != "" && s != "-" && r.re.MatchString(s) {
+			kind = r.kind
+			break
+		}
+	}
+	eventKinds.Add(eventKindNames[kind], 1)
+	return kind
+}
@@ -0,0 +1,63 @@
+// limit.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Most clients of any kind at once, 0 for no limit. It starts as MAX_CLIENTS
+// and can be changed through /map/admin/max_clients.
+var maxClients atomic.Int64
+
+// How long clients turned away for the limit are told to wait, in seconds
+const clientsRetryAfter = 30
+
+var errTooManyClients = errors.New("too many clients")
+
+func init() {
+	maxClients.Store(int64(envInt("MAX_CLIENTS", 0)))
+	registerHealth("max_clients", func() interface{} {
+		return maxClients.Load()
+	})
+}
+
+// refuseClient answers a request for a new client that couldn't be added
+func refuseClient(w http.ResponseWriter, err error) {
+	if err == errTooManyClients {
+		w.Header().Set("Retry-After", strconv.Itoa(clientsRetryAfter))
+	}
+	http.Error(w, err.Error(), 503)
+}
+
+type clientLimit struct {
+	Clients    int   `json:"clients"`
+	MaxClients int64 `json:"max_clients"`
+}
+
+// adminMaxClientsHandler shows the client limit, and changes it to the number
+// in the body of a PUT or POST. Clients over a new lower limit stay connected.
+func adminMaxClientsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" || r.Method == "POST" {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "the limit must be a number, 0 for none", 400)
+			return
+		}
+		maxClients.Store(n)
+	}
+
+	n := hub.Len()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clientLimit{Clients: n, MaxClients: maxClients.Load()})
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+// TestMain sets things up the way main does, from the default environment
+func TestMain(m *testing.M) {
+	for _, f := range []func() error{
+		initParser, initIPExtract, initFilters, initOverrides, initDistros,
+		initAgentRules, initKindRules, initBatch, initSync, initGrid,
+		initPoll, initKeepalive, initEvict, initHistory, initOrigins,
+		initAuth, initRateLimits, initQueue,
+	} {
+		if err := f(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,176 @@
+// message.go
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+	"github.com/Spud304/MirrorMap/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// event is a single download to show on the map
+type event = parse.Event
+
+// Message formats a client can pick when registering. Everything after the
+// legacy 17 bytes is only sent to clients that asked for it.
+const (
+	// distro id, latitude and longitude
+	formatLegacy = "legacy"
+	// legacy followed by the download time in unix milliseconds, the
+	// download size in bytes, the user agent class, the AS number, the
+	// flags, the accuracy radius and the kind of traffic
+	formatExtended = "extended"
+	// extended followed by the name of the network
+	formatFull = "full"
+	// full followed by the country code and the name of the city
+	formatPlace = "place"
+	// everything as a JSON object in a text frame
+	formatJSON = "json"
+	// everything as a protobuf Event, see /map/event.proto
+	formatProto = "proto"
+	// everything as a MessagePack map with the same keys as json
+	formatMsgpack = "msgpack"
+	// a line of text like "debian 48.137 11.575 DE" for reading by eye
+	formatText = "text"
+	// the distro, location and the fields the client picked, see
+	// parse.EncodeMasked
+	formatFields = "fields"
+)
+
+// Asking for this websocket subprotocol when connecting picks formatText
+const debugSubprotocol = "tsm-debug"
+
+// messageFormat is how events are sent to clients that picked a format
+type messageFormat struct {
+	encode func(ev event) []byte
+	// Adds the magic and version bytes for clients that asked for them, with
+	// a two byte distro id if wide, nil for formats that describe themselves
+	// anyway
+	frame func(ev event, wide bool) []byte
+	// Sent in websocket text frames instead of binary ones
+	text bool
+}
+
+var messageFormats = map[string]messageFormat{
+	formatLegacy:   binaryFormat(parse.Legacy),
+	formatExtended: binaryFormat(parse.Extended),
+	formatFull:     binaryFormat(parse.Full),
+	formatPlace:    binaryFormat(parse.Place),
+	formatJSON:     {encode: encodeJSON, text: true},
+	formatProto:    {encode: encodeProto},
+	formatMsgpack:  {encode: encodeMsgpack},
+	formatText:     {encode: encodeText, text: true},
+	// Encoded by client.encode since it depends on the client's fields
+	formatFields: {},
+}
+
+func binaryFormat(format parse.Format) messageFormat {
+	return messageFormat{
+		encode: func(ev event) []byte {
+			return parse.EncodeEvent(ev, format)
+		},
+		frame: func(ev event, wide bool) []byte {
+			if wide {
+				return parse.EncodeFrame(ev, format|parse.Wide)
+			}
+			return parse.EncodeFrame(ev, format)
+		},
+	}
+}
+
+// encodeEvent builds the message for ev in the given format
+func encodeEvent(ev event, format string) []byte {
+	return messageFormats[format].encode(ev)
+}
+
+// jsonEvent is an event as sent to json clients. Lat and Lon are null when
+// the location isn't known.
+type jsonEvent struct {
+	ID      int      `json:"id"`
+	Distro  string   `json:"distro"`
+	Lat     *float64 `json:"lat"`
+	Lon     *float64 `json:"lon"`
+	Time    int64    `json:"time"`
+	Bytes   uint64   `json:"bytes"`
+	Agent   string   `json:"agent"`
+	ASN     uint32   `json:"asn,omitempty"`
+	Org     string   `json:"org,omitempty"`
+	Country string   `json:"country,omitempty"`
+	City    string   `json:"city,omitempty"`
+	Radius  uint16   `json:"radius,omitempty"`
+	Flags   uint8    `json:"flags,omitempty"`
+	Kind    string   `json:"kind"`
+	Seq     uint32   `json:"seq"`
+}
+
+func encodeJSON(ev event) []byte {
+	j := jsonEvent{
+		ID:      ev.Distro,
+		Distro:  distroName(ev.Distro),
+		Time:    ev.Time.UnixNano() / int64(time.Millisecond),
+		Bytes:   ev.Bytes,
+		Agent:   agentClassNames[agentClass(ev.Agent)],
+		ASN:     ev.ASN,
+		Org:     ev.Org,
+		Country: ev.Country,
+		City:    ev.City,
+		Radius:  ev.Radius,
+		Flags:   ev.Flags,
+		Kind:    eventKindNames[eventKind(ev.Kind)],
+		Seq:     ev.Seq,
+	}
+	// JSON has no NaN, which is what the coordinates are without GeoIP
+	if !math.IsNaN(ev.Lat) && !math.IsNaN(ev.Long) {
+		j.Lat, j.Lon = &ev.Lat, &ev.Long
+	}
+	msg, _ := json.Marshal(j)
+	return msg
+}
+
+func encodeProto(ev event) []byte {
+	p := &pb.Event{
+		DistroId: uint32(ev.Distro),
+		Distro:   distroName(ev.Distro),
+		Time:     ev.Time.UnixNano() / int64(time.Millisecond),
+		Bytes:    ev.Bytes,
+		Agent:    uint32(ev.Agent),
+		Asn:      ev.ASN,
+		Org:      ev.Org,
+		Country:  ev.Country,
+		City:     ev.City,
+		Radius:   uint32(ev.Radius),
+		Flags:    uint32(ev.Flags),
+		Kind:     uint32(ev.Kind),
+		Seq:      ev.Seq,
+	}
+	if !math.IsNaN(ev.Lat) && !math.IsNaN(ev.Long) {
+		p.Lat, p.Lon = proto.Float64(ev.Lat), proto.Float64(ev.Long)
+	}
+	msg, _ := proto.Marshal(p)
+	return msg
+}
+
+// encodeText writes the distro, location and country of ev, with - for
+// anything that isn't known
+func encodeText(ev event) []byte {
+	lat, long, country := "-", "-", ev.Country
+	if !math.IsNaN(ev.Lat) && !math.IsNaN(ev.Long) {
+		lat = strconv.FormatFloat(ev.Lat, 'f', 3, 64)
+		long = strconv.FormatFloat(ev.Long, 'f', 3, 64)
+	}
+	if country == "" {
+		country = "-"
+	}
+	return []byte(distroName(ev.Distro) + " " + lat + " " + long + " " + country)
+}
+
+// protoHandler serves the .proto file describing format=proto messages
+func protoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(pb.Proto)
+}
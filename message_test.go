@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+	"github.com/Spud304/MirrorMap/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Legacy clients keep getting 17 bytes next to clients that asked for the place
+func TestPlaceFormat(t *testing.T) {
+	legacy := registerClient(t, "")
+	place := registerClient(t, "format=place")
+
+	hub.Broadcast(event{Distro: 12, Lat: 48.1, Long: 11.6, Time: time.Now(), Country: "DE", City: "München"})
+
+	msg := <-legacy.ch
+	if len(msg.data) != parse.LegacySize {
+		t.Errorf("legacy client got %d bytes", len(msg.data))
+	}
+	msg = <-place.ch
+	ev, err := parse.DecodeEvent(msg.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Distro != 12 || ev.Country != "DE" || ev.City != "München" {
+		t.Errorf("place client got %+v", ev)
+	}
+}
+
+// Binary and JSON clients get the same data from the same line
+func TestJSONMatchesBinary(t *testing.T) {
+	useTestDB(t, testNetwork{"81.2.0.0/16", cityRecord(51.5, -0.1, "GB", "London")})
+	binary := registerClient(t, "format=place")
+	legacy := registerClient(t, "")
+	js := registerClient(t, "format=json")
+
+	readLines(newSliceSource(logLine("81.2.71.1", "/debian/pool/main/b/bash/bash.deb", "200", 4321)))
+
+	ev, err := parse.DecodeEvent((<-binary.ch).data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := parse.DecodeEvent((<-legacy.ch).data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j jsonEvent
+	if err := json.Unmarshal((<-js.ch).data, &j); err != nil {
+		t.Fatal(err)
+	}
+
+	if j.Distro != "debian" || j.ID != ev.Distro || old.Distro != ev.Distro {
+		t.Errorf("distro %q %d in JSON, %d in binary and %d in legacy", j.Distro, j.ID, ev.Distro, old.Distro)
+	}
+	if j.Lat == nil || j.Lon == nil || *j.Lat != ev.Lat || *j.Lon != ev.Long || old.Lat != ev.Lat || old.Long != ev.Long {
+		t.Errorf("location %v,%v in JSON, %v,%v in binary and %v,%v in legacy", j.Lat, j.Lon, ev.Lat, ev.Long, old.Lat, old.Long)
+	}
+	if j.Time != ev.Time.UnixMilli() || j.Bytes != ev.Bytes || j.Bytes != 4321 {
+		t.Errorf("time and size %d %d in JSON, %d %d in binary", j.Time, j.Bytes, ev.Time.UnixMilli(), ev.Bytes)
+	}
+	if j.Country != ev.Country || j.City != ev.City || j.City != "London" {
+		t.Errorf("place %s %s in JSON, %s %s in binary", j.Country, j.City, ev.Country, ev.City)
+	}
+}
+
+// countEncodes counts how many times each format is encoded until the end of
+// the test
+func countEncodes(t *testing.T) map[string]int {
+	encodes := make(map[string]int)
+	old := messageFormats
+	messageFormats = make(map[string]messageFormat)
+	for name, f := range old {
+		encode := f.encode
+		if encode != nil {
+			f.encode = func(ev event) []byte {
+				encodes[name]++
+				return encode(ev)
+			}
+		}
+		messageFormats[name] = f
+	}
+	t.Cleanup(func() { messageFormats = old })
+	return encodes
+}
+
+// broadcastTo sends ev to a new client for each query and waits until all of
+// them have it
+func broadcastTo(t *testing.T, ev event, queries ...string) []message {
+	var clients []*client
+	for _, query := range queries {
+		clients = append(clients, registerClient(t, query))
+	}
+	hub.Broadcast(ev)
+
+	var msgs []message
+	for _, c := range clients {
+		msgs = append(msgs, <-c.ch)
+	}
+	return msgs
+}
+
+// Each format is encoded once for all its clients, and only when a client
+// asked for it
+func TestFormatsEncodedOnDemand(t *testing.T) {
+	encodes := countEncodes(t)
+	broadcastTo(t, event{Distro: 1, Lat: 1, Long: 1, Time: time.Now()}, "", "", "", "format=json", "format=json")
+
+	want := map[string]int{formatLegacy: 1, formatJSON: 1}
+	if len(encodes) != len(want) || encodes[formatLegacy] != 1 || encodes[formatJSON] != 1 {
+		t.Errorf("encoded %v, want %v", encodes, want)
+	}
+}
+
+// Proto clients get the same distro and location as legacy clients, and
+// everything else the place format has
+func TestProtoMatchesLegacy(t *testing.T) {
+	events := []event{
+		{Distro: 0, Lat: 0, Long: 0},
+		{Distro: 3, Lat: 51.5074, Long: -0.1278, Time: time.UnixMilli(1700000000123), Bytes: 1 << 33, ASN: 64500, Org: "Example Net"},
+		{Distro: 42, Lat: -33.8688, Long: 151.2093, Country: "AU", City: "Sydney", Radius: 20, Flags: parse.FlagCountry},
+		{Distro: 254, Lat: 90, Long: -180, Agent: 2, Kind: 1, Seq: 1<<32 - 1},
+		// Too big for legacy, sent in full in proto
+		{Distro: 300, Lat: 35.6762, Long: 139.6503},
+		{Distro: 1, Lat: math.NaN(), Long: math.NaN()},
+	}
+	for _, ev := range events {
+		if ev.Time.IsZero() {
+			ev.Time = time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+		}
+		var p pb.Event
+		if err := proto.Unmarshal(encodeProto(ev), &p); err != nil {
+			t.Fatalf("%+v: %s", ev, err)
+		}
+		old, err := parse.DecodeEvent(encodeEvent(ev, formatLegacy))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if int(p.DistroId) != ev.Distro || p.Distro != distroName(ev.Distro) {
+			t.Errorf("distro %d sent as %d %q", ev.Distro, p.DistroId, p.Distro)
+		}
+		if ev.Distro < parse.DistroOther && int(p.DistroId) != old.Distro {
+			t.Errorf("distro %d in proto, %d in legacy", p.DistroId, old.Distro)
+		}
+		if math.IsNaN(ev.Lat) {
+			if p.Lat != nil || p.Lon != nil {
+				t.Errorf("unknown location sent as %v,%v", p.GetLat(), p.GetLon())
+			}
+		} else if p.Lat == nil || p.Lon == nil || *p.Lat != old.Lat || *p.Lon != old.Long {
+			t.Errorf("location %v,%v in proto, %v,%v in legacy", p.GetLat(), p.GetLon(), old.Lat, old.Long)
+		}
+
+		got := event{
+			Distro: int(p.DistroId), Lat: ev.Lat, Long: ev.Long, Time: time.UnixMilli(p.Time),
+			Bytes: p.Bytes, Agent: uint8(p.Agent), ASN: p.Asn, Org: p.Org, Flags: uint8(p.Flags),
+			Kind: uint8(p.Kind), Radius: uint16(p.Radius), Country: p.Country, City: p.City, Seq: p.Seq,
+		}
+		want := ev
+		want.Time = time.UnixMilli(ev.Time.UnixMilli())
+		if !got.Time.Equal(want.Time) {
+			t.Errorf("time %s, want %s", got.Time, want.Time)
+		}
+		got.Time = want.Time
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestProtoEncodedOnce(t *testing.T) {
+	encodes := countEncodes(t)
+	msgs := broadcastTo(t, event{Distro: 2, Lat: 1, Long: 1, Time: time.Now()}, "format=proto", "format=proto", "format=proto", "")
+
+	if encodes[formatProto] != 1 {
+		t.Errorf("encoded %d times for 3 clients", encodes[formatProto])
+	}
+	if &msgs[0].data[0] != &msgs[2].data[0] {
+		t.Error("proto clients got copies of the message")
+	}
+}
+
+// The served .proto describes every field proto clients are sent
+func TestProtoFile(t *testing.T) {
+	w := httptest.NewRecorder()
+	protoHandler(w, httptest.NewRequest("GET", "/map/event.proto", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	served := w.Body.String()
+
+	fields := (&pb.Event{}).ProtoReflect().Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		f := fields.Get(i)
+		decl := fmt.Sprintf(" %s = %d;", f.Name(), f.Number())
+		if !strings.Contains(served, decl) {
+			t.Errorf("%s isn't in the served file", decl)
+		}
+	}
+}
+
+// The frame version follows what the client registered with, and clients that
+// didn't ask for frames keep getting bare messages
+func TestFrameVersionFromRegistration(t *testing.T) {
+	tests := []struct {
+		query   string
+		framed  bool
+		version parse.Format
+	}{
+		{"", false, 0},
+		{"framed=true", true, parse.Legacy},
+		{"format=extended&framed=true", true, parse.Extended},
+		{"format=full&framed=true&wide=true", true, parse.Full | parse.Wide},
+		{"format=place&framed=true", true, parse.Place},
+	}
+	var queries []string
+	for _, tt := range tests {
+		queries = append(queries, tt.query)
+	}
+	msgs := broadcastTo(t, event{Distro: 300, Lat: 1, Long: 2, Time: time.Now()}, queries...)
+
+	for i, tt := range tests {
+		data := msgs[i].data
+		if !tt.framed {
+			if len(data) != parse.LegacySize || data[0] != parse.DistroOther {
+				t.Errorf("%q got %x", tt.query, data)
+			}
+			continue
+		}
+		ev, version, err := parse.DecodeFrame(data)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.query, err)
+		}
+		wantDistro := parse.DistroOther
+		if tt.version&parse.Wide != 0 {
+			wantDistro = 300
+		}
+		if version != tt.version || ev.Seq != msgs[i].seq || ev.Distro != wantDistro {
+			t.Errorf("%q got version %d seq %d distro %d", tt.query, version, ev.Seq, ev.Distro)
+		}
+	}
+
+	for _, query := range []string{"wide=true", "format=json&framed=true", "format=proto&framed=true"} {
+		w := httptest.NewRecorder()
+		if _, _, ok := register(w, httptest.NewRequest("POST", "/register?"+query, nil)); ok || w.Code != http.StatusBadRequest {
+			t.Errorf("%q registered with status %d", query, w.Code)
+		}
+	}
+}
+
+// The mask a client registered with comes back in the response, and what it's
+// sent decodes with that mask
+func TestFieldMaskEcho(t *testing.T) {
+	ev := event{Distro: 300, Lat: 48.1, Long: 11.6, Time: time.UnixMilli(1700000000123), Bytes: 99, Org: "Example", Country: "DE", City: "München"}
+	for _, fields := range []string{"city,time", "time,bytes,agent,asn,flags,radius,kind,org,country,city,seq", "seq", "0x204"} {
+		w := httptest.NewRecorder()
+		id, c, ok := register(w, httptest.NewRequest("POST", "/register?fields="+fields, nil))
+		if !ok {
+			t.Fatalf("%q: %d %s", fields, w.Code, w.Body)
+		}
+		t.Cleanup(func() { hub.Unregister(id, c) })
+
+		mask, err := parse.ParseFieldMask(w.Header().Get("X-Field-Mask"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if byName, _ := parse.ParseFieldMask(w.Header().Get("X-Fields")); byName != mask {
+			t.Errorf("%q echoed as %s and %d", fields, w.Header().Get("X-Fields"), mask)
+		}
+		hub.Broadcast(ev)
+		msg := <-c.ch
+		got, err := parse.DecodeMasked(msg.data, mask)
+		if err != nil {
+			t.Fatalf("%q: %s", fields, err)
+		}
+		if got.Distro != ev.Distro || got.Lat != ev.Lat || got.Long != ev.Long {
+			t.Errorf("%q got %+v", fields, got)
+		}
+		if strings.Contains(w.Header().Get("X-Fields"), "city") != (got.City == ev.City) {
+			t.Errorf("%q got city %q", fields, got.City)
+		}
+	}
+}
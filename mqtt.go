@@ -0,0 +1,99 @@
+// mqtt.go
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/thanhpk/randstr"
+)
+
+// With MQTT_URL every event is also published as JSON to
+// MQTT_TOPIC_PREFIX/<distro>. Events wait in a queue of MQTT_QUEUE for the
+// publisher and are dropped when it's full or the broker is gone, so the
+// broker can never hold up anything else.
+var mqttURL = os.Getenv("MQTT_URL")
+
+var mqttPublished = expvar.NewInt("mqtt_published")
+var mqttDropped = expvar.NewInt("mqtt_dropped")
+
+// nil unless publishing to MQTT
+var mqttQueue chan event
+var mqttClient mqtt.Client
+
+var mqttState atomic.Value
+
+// initMQTT connects to the broker and starts publishing
+func initMQTT() error {
+	prefix := strings.TrimSuffix(envString("MQTT_TOPIC_PREFIX", "mirror/events"), "/")
+	qos := envInt("MQTT_QOS", 0)
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("MQTT_QOS must be 0, 1 or 2")
+	}
+	size := envInt("MQTT_QUEUE", 1000)
+	if size < 1 {
+		return fmt.Errorf("MQTT_QUEUE must be at least 1")
+	}
+
+	mqttState.Store("connecting")
+	registerHealth("mqtt", func() interface{} {
+		return mqttState.Load()
+	})
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(mqttURL).
+		SetClientID(envString("MQTT_CLIENT_ID", "mirrormap-"+randstr.Hex(8))).
+		SetUsername(os.Getenv("MQTT_USERNAME")).
+		SetPassword(os.Getenv("MQTT_PASSWORD")).
+		// Keep trying forever, losing the broker should only pause publishing
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetOnConnectHandler(func(mqtt.Client) {
+			log.Printf("Connected to MQTT broker")
+			mqttState.Store("connected")
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("Lost connection to MQTT broker: %s", err)
+			mqttState.Store("disconnected")
+		})
+	c := mqtt.NewClient(opts)
+	c.Connect()
+	mqttClient = c
+
+	mqttQueue = make(chan event, size)
+	go publishMQTT(c, prefix, byte(qos))
+	return nil
+}
+
+// queueMQTT hands ev to the publisher unless it's behind
+func queueMQTT(ev event) {
+	select {
+	case mqttQueue <- ev:
+	default:
+		mqttDropped.Add(1)
+	}
+}
+
+// publishMQTT publishes everything queued while connected and drops it
+// while not, since the client would otherwise keep it all in memory
+func publishMQTT(c mqtt.Client, prefix string, qos byte) {
+	for ev := range mqttQueue {
+		if !c.IsConnectionOpen() {
+			mqttDropped.Add(1)
+			continue
+		}
+		t := c.Publish(prefix+"/"+distroName(ev.Distro), qos, false, encodeJSON(ev))
+		if !t.WaitTimeout(5*time.Second) || t.Error() != nil {
+			mqttDropped.Add(1)
+			continue
+		}
+		mqttPublished.Add(1)
+	}
+}
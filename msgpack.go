@@ -0,0 +1,97 @@
+// msgpack.go
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// encodeMsgpack writes ev as a MessagePack map with the same keys, in the same
+// order, as the json format. Every key is always there, lat and lon are nil
+// when the location isn't known. Written by hand since it's a handful of types
+// and not worth a dependency.
+func encodeMsgpack(ev event) []byte {
+	msg := make([]byte, 0, 128)
+	msg = append(msg, 0x80|15)
+	msg = mpString(msg, "id")
+	msg = mpUint(msg, uint64(ev.Distro))
+	msg = mpString(msg, "distro")
+	msg = mpString(msg, distroName(ev.Distro))
+	if math.IsNaN(ev.Lat) || math.IsNaN(ev.Long) {
+		msg = mpString(msg, "lat")
+		msg = append(msg, 0xc0)
+		msg = mpString(msg, "lon")
+		msg = append(msg, 0xc0)
+	} else {
+		msg = mpString(msg, "lat")
+		msg = mpFloat(msg, ev.Lat)
+		msg = mpString(msg, "lon")
+		msg = mpFloat(msg, ev.Long)
+	}
+	msg = mpString(msg, "time")
+	msg = mpInt(msg, ev.Time.UnixNano()/int64(time.Millisecond))
+	msg = mpString(msg, "bytes")
+	msg = mpUint(msg, ev.Bytes)
+	msg = mpString(msg, "agent")
+	msg = mpString(msg, agentClassNames[agentClass(ev.Agent)])
+	msg = mpString(msg, "asn")
+	msg = mpUint(msg, uint64(ev.ASN))
+	msg = mpString(msg, "org")
+	msg = mpString(msg, ev.Org)
+	msg = mpString(msg, "country")
+	msg = mpString(msg, ev.Country)
+	msg = mpString(msg, "city")
+	msg = mpString(msg, ev.City)
+	msg = mpString(msg, "radius")
+	msg = mpUint(msg, uint64(ev.Radius))
+	msg = mpString(msg, "flags")
+	msg = mpUint(msg, uint64(ev.Flags))
+	msg = mpString(msg, "kind")
+	msg = mpString(msg, eventKindNames[eventKind(ev.Kind)])
+	msg = mpString(msg, "seq")
+	msg = mpUint(msg, uint64(ev.Seq))
+	return msg
+}
+
+func mpString(msg []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		msg = append(msg, 0xa0|byte(n))
+	case n < 1<<8:
+		msg = append(msg, 0xd9, byte(n))
+	case n < 1<<16:
+		msg = append(msg, 0xda)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(n))
+	default:
+		msg = append(msg, 0xdb)
+		msg = binary.BigEndian.AppendUint32(msg, uint32(n))
+	}
+	return append(msg, s...)
+}
+
+func mpUint(msg []byte, u uint64) []byte {
+	switch {
+	case u < 128:
+		return append(msg, byte(u))
+	case u < 1<<8:
+		return append(msg, 0xcc, byte(u))
+	case u < 1<<16:
+		return binary.BigEndian.AppendUint16(append(msg, 0xcd), uint16(u))
+	case u < 1<<32:
+		return binary.BigEndian.AppendUint32(append(msg, 0xce), uint32(u))
+	default:
+		return binary.BigEndian.AppendUint64(append(msg, 0xcf), u)
+	}
+}
+
+func mpInt(msg []byte, i int64) []byte {
+	if i >= 0 {
+		return mpUint(msg, uint64(i))
+	}
+	return binary.BigEndian.AppendUint64(append(msg, 0xd3), uint64(i))
+}
+
+func mpFloat(msg []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(append(msg, 0xcb), math.Float64bits(f))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// The keys in the order the README has them
+var msgpackKeys = []string{"id", "distro", "lat", "lon", "time", "bytes", "agent", "asn", "org", "country", "city", "radius", "flags", "kind", "seq"}
+
+var msgpackEvents = []event{
+	{Distro: 3, Lat: 51.5074, Long: -0.1278, Time: time.UnixMilli(1700000000123)},
+	{Distro: 42, Lat: -33.8688, Long: 151.2093, Time: time.UnixMilli(1700000000123), Bytes: 1 << 33, Agent: 1, ASN: 4200000000, Org: "Example Net", Country: "AU", City: "Sydney", Radius: 1000, Flags: 3, Kind: 2, Seq: 1<<32 - 1},
+	{Distro: 300, Lat: math.NaN(), Long: math.NaN(), Time: time.UnixMilli(-1)},
+	// Names long enough for the bigger string headers
+	{Distro: 1, Lat: 1, Long: 1, Time: time.UnixMilli(0), Org: strings.Repeat("o", 40), City: strings.Repeat("c", 300)},
+	{Distro: 1, Lat: 1, Long: 1, Time: time.UnixMilli(0), Org: strings.Repeat("o", 70000)},
+}
+
+func TestMsgpackKeys(t *testing.T) {
+	for _, ev := range msgpackEvents {
+		dec := msgpack.NewDecoder(bytes.NewReader(encodeMsgpack(ev)))
+		n, err := dec.DecodeMapLen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for i := 0; i < n; i++ {
+			key, err := dec.DecodeString()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := dec.Skip(); err != nil {
+				t.Fatalf("%s: %s", key, err)
+			}
+			keys = append(keys, key)
+		}
+		if strings.Join(keys, " ") != strings.Join(msgpackKeys, " ") {
+			t.Errorf("got keys %v, want %v", keys, msgpackKeys)
+		}
+		if _, err := dec.DecodeInterface(); err == nil {
+			t.Error("more after the map")
+		}
+	}
+}
+
+// Decoded with a msgpack library, events come out the same as the json format
+func TestMsgpackMatchesJSON(t *testing.T) {
+	for _, ev := range msgpackEvents {
+		var got, want jsonEvent
+		dec := msgpack.NewDecoder(bytes.NewReader(encodeMsgpack(ev)))
+		dec.SetCustomStructTag("json")
+		if err := dec.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(encodeJSON(ev), &want); err != nil {
+			t.Fatal(err)
+		}
+
+		if (got.Lat == nil) != (want.Lat == nil) || (got.Lon == nil) != (want.Lon == nil) {
+			t.Fatalf("location %v,%v in msgpack, %v,%v in json", got.Lat, got.Lon, want.Lat, want.Lon)
+		}
+		if got.Lat != nil && (*got.Lat != *want.Lat || *got.Lon != *want.Lon) {
+			t.Errorf("location %v,%v in msgpack, %v,%v in json", *got.Lat, *got.Lon, *want.Lat, *want.Lon)
+		}
+		got.Lat, got.Lon, want.Lat, want.Lon = nil, nil, nil, nil
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestMsgpackEncodedOnce(t *testing.T) {
+	encodes := countEncodes(t)
+	msgs := broadcastTo(t, event{Distro: 2, Lat: 1, Long: 1, Time: time.Now()}, "format=msgpack", "format=msgpack", "format=msgpack")
+
+	if encodes[formatMsgpack] != 1 {
+		t.Errorf("encoded %d times for 3 clients", encodes[formatMsgpack])
+	}
+	var m map[string]interface{}
+	if err := msgpack.Unmarshal(msgs[2].data, &m); err != nil || m["distro"] != distroName(2) {
+		t.Errorf("got %v: %v", m, err)
+	}
+}
@@ -0,0 +1,73 @@
+// origin.go
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Websockets can be opened from pages on the server's own host, and from the
+// origins in ALLOWED_ORIGINS. Entries are a whole origin like
+// https://map.example.org or just a host, either of which can have wildcards
+// like *.example.org. * on its own allows every origin. Connections that
+// don't send an Origin, which browsers always do, are let through.
+var allowedOrigins []string
+
+// Websockets refused for their origin
+var originsRefused = expvar.NewInt("origins_refused")
+
+// initOrigins reads ALLOWED_ORIGINS
+func initOrigins() error {
+	for _, o := range strings.Split(envString("ALLOWED_ORIGINS", ""), ",") {
+		o = strings.ToLower(strings.TrimSpace(o))
+		if o == "" {
+			continue
+		}
+		if _, err := path.Match(o, ""); err != nil {
+			return fmt.Errorf("invalid ALLOWED_ORIGINS entry %q: %s", o, err)
+		}
+		allowedOrigins = append(allowedOrigins, o)
+	}
+	return nil
+}
+
+// checkOrigin is the upgrader's CheckOrigin
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if originAllowed(origin, r.Host) {
+		return true
+	}
+	log.Printf("Refused websocket from origin %q", origin)
+	originsRefused.Add(1)
+	return false
+}
+
+// originAllowed reports whether a page from origin can connect to host
+func originAllowed(origin, host string) bool {
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if u.Host == strings.ToLower(host) {
+		return true
+	}
+	for _, o := range allowedOrigins {
+		// Entries with a scheme match the whole origin, the rest the host
+		against := u.Host
+		if strings.Contains(o, "://") {
+			against = u.Scheme + "://" + u.Host
+		}
+		if ok, _ := path.Match(o, against); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+// overrides.go
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GEOIP_OVERRIDES is a file of networks GeoIP gets wrong, one per line with
+// # comments:
+//
+//	192.0.2.0/24 48.262 11.668 University
+//	2001:db8::/32 52.52 13.405
+//	198.51.100.0/24 suppress
+//
+// The most specific network containing an address wins over the database, a
+// label of suppress means lines from it are never sent. Reread on SIGHUP.
+var geoOverridesFile = os.Getenv("GEOIP_OVERRIDES")
+
+const overrideSuppress = "suppress"
+
+type geoOverride struct {
+	net   *net.IPNet
+	lat   float64
+	long  float64
+	label string
+}
+
+// Most specific first so the first match is the one to use
+var geoOverrides []geoOverride
+var geoOverrides_lock sync.RWMutex
+
+// Lines placed by an override, by label
+var overrideHits = expvar.NewMap("geoip_overrides")
+
+// initOverrides reads GEOIP_OVERRIDES
+func initOverrides() error {
+	if geoOverridesFile == "" {
+		return nil
+	}
+	f, err := os.Open(geoOverridesFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var overrides []geoOverride
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		o, err := parseOverride(fields)
+		if err != nil {
+			return fmt.Errorf("invalid line in %s: %q: %s", geoOverridesFile, scanner.Text(), err)
+		}
+		overrides = append(overrides, o)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	sort.SliceStable(overrides, func(i, j int) bool {
+		a, _ := overrides[i].net.Mask.Size()
+		b, _ := overrides[j].net.Mask.Size()
+		return a > b
+	})
+
+	geoOverrides_lock.Lock()
+	geoOverrides = overrides
+	geoOverrides_lock.Unlock()
+	return nil
+}
+
+// parseOverride reads the fields of one line of GEOIP_OVERRIDES
+func parseOverride(fields []string) (geoOverride, error) {
+	var o geoOverride
+	cidr := fields[0]
+	if !strings.Contains(cidr, "/") {
+		// A single address
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return o, err
+	}
+	o.net = n
+
+	if len(fields) == 2 && fields[1] == overrideSuppress {
+		o.label = overrideSuppress
+		return o, nil
+	}
+	if len(fields) < 3 {
+		return o, fmt.Errorf("expected a latitude and longitude or %s", overrideSuppress)
+	}
+	if o.lat, err = strconv.ParseFloat(fields[1], 64); err != nil || o.lat < -90 || o.lat > 90 {
+		return o, fmt.Errorf("invalid latitude %q", fields[1])
+	}
+	if o.long, err = strconv.ParseFloat(fields[2], 64); err != nil || o.long < -180 || o.long > 180 {
+		return o, fmt.Errorf("invalid longitude %q", fields[2])
+	}
+	o.label = strings.Join(fields[3:], " ")
+	return o, nil
+}
+
+// lookupOverride finds the most specific override for ip
+func lookupOverride(ip net.IP) (geoOverride, bool) {
+	geoOverrides_lock.RLock()
+	defer geoOverrides_lock.RUnlock()
+	for _, o := range geoOverrides {
+		if o.net.Contains(ip) {
+			label := o.label
+			if label == "" {
+				label = o.net.String()
+			}
+			overrideHits.Add(label, 1)
+			return o, true
+		}
+	}
+	return geoOverride{}, false
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useOverrides loads GEOIP_OVERRIDES from content until the end of the test,
+// writing it again reloads it
+func useOverrides(t *testing.T, content string) error {
+	t.Helper()
+	oldFile := geoOverridesFile
+	geoOverrides_lock.RLock()
+	old := geoOverrides
+	geoOverrides_lock.RUnlock()
+	t.Cleanup(func() {
+		geoOverridesFile = oldFile
+		geoOverrides_lock.Lock()
+		geoOverrides = old
+		geoOverrides_lock.Unlock()
+	})
+
+	geoOverridesFile = filepath.Join(t.TempDir(), "overrides")
+	if err := os.WriteFile(geoOverridesFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return initOverrides()
+}
+
+func TestOverrideLongestPrefix(t *testing.T) {
+	err := useOverrides(t, `
+# Broadest first, the order in the file doesn't matter
+10.0.0.0/8 1 1 Campus
+10.20.0.0/16 2 2 Library
+10.20.30.0/24 3 3 Lab
+10.20.30.40 suppress
+2001:db8::/32 4 4
+2001:db8:1::/48 5 5 Sync
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip    string
+		lat   float64
+		label string
+	}{
+		{"10.1.1.1", 1, "Campus"},
+		{"10.20.1.1", 2, "Library"},
+		{"10.20.30.1", 3, "Lab"},
+		{"10.20.30.40", 0, overrideSuppress},
+		{"2001:db8:2::1", 4, ""},
+		{"2001:db8:1::1", 5, "Sync"},
+		{"192.0.2.1", -1, ""},
+		{"2001:db9::1", -1, ""},
+	}
+	for _, tt := range tests {
+		o, ok := lookupOverride(net.ParseIP(tt.ip))
+		if ok != (tt.lat >= 0) {
+			t.Errorf("%s matched %v", tt.ip, ok)
+			continue
+		}
+		if ok && (o.lat != tt.lat || o.label != tt.label) {
+			t.Errorf("%s got %v %q, want %v %q", tt.ip, o.lat, o.label, tt.lat, tt.label)
+		}
+	}
+}
+
+// Overrides win over the database, and suppressed networks are never sent
+func TestOverrideBeforeDatabase(t *testing.T) {
+	useTestDB(t, testNetwork{"192.0.2.0/24", cityRecord(40.7, -74.0, "US", "New York")})
+	if err := useOverrides(t, "192.0.2.64/26 48.262 11.668 University\n192.0.2.128/25 suppress\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip  string
+		lat float64
+	}{
+		{"192.0.2.40", 40.7},
+		{"192.0.2.70", 48.262},
+		{"192.0.2.140", 0},
+	}
+	for _, tt := range tests {
+		ev, ok, err := lineEvent(Line{Text: logLine(tt.ip, "/ubuntu/pool/a.deb", "200", 1)})
+		if tt.lat == 0 {
+			if ok || err != nil {
+				t.Errorf("suppressed %s gave %v, %v", tt.ip, ok, err)
+			}
+			continue
+		}
+		if !ok || ev.Lat != tt.lat {
+			t.Errorf("%s got %v at %v, want %v: %v", tt.ip, ok, ev.Lat, tt.lat, err)
+		}
+	}
+	if ev, _, _ := lineEvent(Line{Text: logLine("192.0.2.71", "/ubuntu/pool/a.deb", "200", 1)}); ev.Org != "University" {
+		t.Errorf("override sent with org %q", ev.Org)
+	}
+}
+
+func TestOverrideReload(t *testing.T) {
+	if err := useOverrides(t, "192.0.2.0/24 1 1 Old\n"); err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("192.0.2.1")
+	if o, _ := lookupOverride(ip); o.label != "Old" {
+		t.Fatalf("got %q", o.label)
+	}
+
+	if err := os.WriteFile(geoOverridesFile, []byte("192.0.2.0/24 2 2 New\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := initOverrides(); err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := lookupOverride(ip); o.label != "New" {
+		t.Errorf("got %q after reloading", o.label)
+	}
+
+	// A bad file leaves the overrides as they were
+	if err := os.WriteFile(geoOverridesFile, []byte("192.0.2.0/24 north\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := initOverrides(); err == nil {
+		t.Error("bad file loaded")
+	}
+	if o, _ := lookupOverride(ip); o.label != "New" {
+		t.Errorf("got %q after a bad reload", o.label)
+	}
+}
+
+func TestOverrideErrors(t *testing.T) {
+	for _, line := range []string{
+		"192.0.2.0/33 1 1",
+		"not-a-network 1 1",
+		"192.0.2.0/24",
+		"192.0.2.0/24 91 0",
+		"192.0.2.0/24 0 181",
+		"192.0.2.0/24 north east",
+	} {
+		err := useOverrides(t, line+"\n")
+		if err == nil || !strings.Contains(err.Error(), "invalid line") {
+			t.Errorf("%q gave %v", line, err)
+		}
+	}
+}
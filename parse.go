@@ -0,0 +1,299 @@
+// parse.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+)
+
+// logFields are the parts of an access log line we care about
+type logFields struct {
+	IP   string
+	Path string
+	Time string
+	// Response size as written in the log, "-" when nothing was sent
+	Bytes  string
+	Status string
+	Method string
+	Agent  string
+}
+
+// logParser pulls logFields out of lines written in one particular format
+type logParser interface {
+	Parse(line string) (logFields, bool)
+}
+
+// Named log formats for LOG_FORMAT besides the default mirrormap one. Each is
+// a regex with named groups, ip and path are required and method, time,
+// status, bytes and agent are optional.
+var logFormats = map[string]string{
+	// nginx's default combined format
+	"combined": `^(?P<ip>\S+) \S+ \S+ \[(?P<time>[^\]]*)\] "(?P<method>\S+) (?P<path>[^" ]+)[^"]*" (?P<status>\d{3}) (?P<bytes>\S+) "[^"]*" "(?P<agent>[^"]*)"`,
+	// Apache's common log format
+	"common": `^(?P<ip>\S+) \S+ \S+ \[(?P<time>[^\]]*)\] "(?P<method>\S+) (?P<path>[^" ]+)[^"]*" (?P<status>\d{3}) (?P<bytes>\S+)`,
+}
+
+// nginx's $time_local, the layout of the time field unless TIME_LAYOUT says otherwise
+const timeLocalLayout = "02/Jan/2006:15:04:05 -0700"
+
+var timeLayout = envString("TIME_LAYOUT", timeLocalLayout)
+
+// The parser every input goes through
+var parser logParser
+
+// initParser sets up the parser from LOG_FORMAT, or LOG_FORMAT_REGEX for a
+// custom format, failing on anything that can't work
+func initParser() error {
+	pattern := os.Getenv("LOG_FORMAT_REGEX")
+	if pattern == "" {
+		name := envString("LOG_FORMAT", "mirrormap")
+		if name == "mirrormap" {
+			parser = quotedParser{}
+			return initDistroRegex()
+		}
+		if name == "json" {
+			parser = newJSONParser()
+			return initDistroRegex()
+		}
+		var ok bool
+		if pattern, ok = logFormats[name]; !ok {
+			return fmt.Errorf("unknown LOG_FORMAT %q", name)
+		}
+	}
+
+	p, err := newRegexParser(pattern)
+	if err != nil {
+		return err
+	}
+	parser = p
+	return initDistroRegex()
+}
+
+// parseLine runs a line through the configured parser
+func parseLine(line string) (logFields, bool) {
+	return parser.Parse(line)
+}
+
+// quotedParser handles the format described in the README, where every field is quoted:
+// "$remote_addr" "$time_local" "$request" "$status" "$body_bytes_sent" "$request_length" "$http_user_agent"
+// It's the default so it scans the line by hand instead of using a regex,
+// the fields returned are slices of the line so nothing is allocated.
+type quotedParser struct{}
+
+// Positions of the quoted fields
+const (
+	quotedIP = iota
+	quotedTime
+	quotedRequest
+	quotedStatus
+	quotedBytes
+	quotedRequestLength
+	quotedUserAgent
+	quotedFieldCount
+)
+
+func (quotedParser) Parse(line string) (logFields, bool) {
+	var quoted [quotedFieldCount]string
+	n := 0
+	for rest := line; n < quotedFieldCount; n++ {
+		start := strings.IndexByte(rest, '"')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start+1:], '"')
+		if end < 0 {
+			break
+		}
+		quoted[n] = rest[start+1 : start+1+end]
+		rest = rest[start+end+2:]
+	}
+	if n <= quotedRequest {
+		return logFields{}, false
+	}
+
+	// The request is "GET /path HTTP/1.1"
+	request := quoted[quotedRequest]
+	sp := strings.IndexByte(request, ' ')
+	if sp < 0 {
+		return logFields{}, false
+	}
+	path := request[sp+1:]
+	if sp := strings.IndexByte(path, ' '); sp >= 0 {
+		path = path[:sp]
+	}
+	if path == "" {
+		return logFields{}, false
+	}
+
+	return logFields{
+		IP:     quoted[quotedIP],
+		Path:   path,
+		Time:   quoted[quotedTime],
+		Bytes:  quoted[quotedBytes],
+		Status: quoted[quotedStatus],
+		Method: request[:sp],
+		Agent:  quoted[quotedUserAgent],
+	}, true
+}
+
+// regexParser handles any format described by a regex with named groups
+type regexParser struct {
+	re     *regexp.Regexp
+	ip     int
+	path   int
+	time   int
+	bytes  int
+	status int
+	method int
+	agent  int
+}
+
+func newRegexParser(pattern string) (*regexParser, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log format regex: %s", err)
+	}
+
+	p := &regexParser{
+		re:     re,
+		ip:     re.SubexpIndex("ip"),
+		path:   re.SubexpIndex("path"),
+		time:   re.SubexpIndex("time"),
+		bytes:  re.SubexpIndex("bytes"),
+		status: re.SubexpIndex("status"),
+		method: re.SubexpIndex("method"),
+		agent:  re.SubexpIndex("agent"),
+	}
+	if p.ip < 0 || p.path < 0 {
+		return nil, fmt.Errorf("log format regex must have named groups ip and path: %s", pattern)
+	}
+	return p, nil
+}
+
+func (p *regexParser) Parse(line string) (logFields, bool) {
+	m := p.re.FindStringSubmatch(line)
+	if m == nil {
+		return logFields{}, false
+	}
+	f := logFields{IP: m[p.ip], Path: m[p.path]}
+	if p.time >= 0 {
+		f.Time = m[p.time]
+	}
+	if p.bytes >= 0 {
+		f.Bytes = m[p.bytes]
+	}
+	if p.status >= 0 {
+		f.Status = m[p.status]
+	}
+	if p.method >= 0 {
+		f.Method = m[p.method]
+	}
+	if p.agent >= 0 {
+		f.Agent = m[p.agent]
+	}
+	return f, true
+}
+
+// parseBytes reads the response size, anything that isn't a number counts as nothing sent
+func parseBytes(s string) uint64 {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// Set from DISTRO_REGEX, when nil the first path segment is the distro
+var distroRegex *regexp.Regexp
+
+// Which match of distroRegex in the path holds the distro, from DISTRO_MATCH
+var distroMatch int
+
+// Prefixes taken off paths before looking for the distro, from PATH_STRIP_PREFIXES
+var pathStripPrefixes []string
+
+// With DISTRO_SEARCH the distro is the first path segment that's a known distro
+var distroSearch bool
+
+// initDistroRegex compiles DISTRO_REGEX once at startup
+func initDistroRegex() error {
+	pattern := os.Getenv("DISTRO_REGEX")
+	distroMatch = envInt("DISTRO_MATCH", 0)
+	distroSearch = envBool("DISTRO_SEARCH", false)
+
+	pathStripPrefixes = nil
+	if prefixes := os.Getenv("PATH_STRIP_PREFIXES"); prefixes != "" {
+		for _, prefix := range strings.Split(prefixes, ",") {
+			// Only ever strip whole segments, /pub shouldn't eat /public
+			prefix = "/" + strings.Trim(strings.TrimSpace(prefix), "/")
+			if prefix != "/" {
+				pathStripPrefixes = append(pathStripPrefixes, prefix)
+			}
+		}
+	}
+	if pattern == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid DISTRO_REGEX: %s", err)
+	}
+	if re.NumSubexp() > 1 {
+		return fmt.Errorf("DISTRO_REGEX must have at most one capture group: %s", pattern)
+	}
+	if distroMatch < 0 {
+		return fmt.Errorf("DISTRO_MATCH can't be negative")
+	}
+	distroRegex = re
+	return nil
+}
+
+// extractDistro finds the distro in a request path, either with DISTRO_REGEX,
+// by searching for a known one or by taking the first path segment
+func extractDistro(path string) string {
+	for _, prefix := range pathStripPrefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			path = path[len(prefix):]
+			break
+		}
+	}
+
+	if distroRegex == nil {
+		if distroSearch {
+			return searchDistro(path)
+		}
+		return parse.ExtractDistro(path)
+	}
+
+	matches := distroRegex.FindAllStringSubmatch(path, distroMatch+1)
+	if len(matches) <= distroMatch {
+		return ""
+	}
+	// The capture group if there is one, otherwise the whole match
+	m := matches[distroMatch]
+	return m[len(m)-1]
+}
+
+// searchDistro walks the segments of a path looking for a known distro, so
+// "/pub/linux/debian/..." is debian. Paths without one fall back to the first
+// segment so they're counted as unknown.
+func searchDistro(path string) string {
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" {
+			continue
+		}
+		if _, ok := distroID(canonicalDistro(parse.NormalizeDistro(segment))); ok {
+			return segment
+		}
+	}
+	return parse.ExtractDistro(path)
+}
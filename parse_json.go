@@ -0,0 +1,72 @@
+// parse_json.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// jsonParser handles logs written as one JSON object per line, like nginx's
+// escape=json log formats. Each field is read from a configurable key, nested
+// objects can be reached with dots ("request.path"). Extra keys are ignored.
+type jsonParser struct {
+	ip, path, time, status, bytes, method, agent string
+}
+
+func newJSONParser() *jsonParser {
+	return &jsonParser{
+		ip:     envString("JSON_IP_KEY", "remote_addr"),
+		path:   envString("JSON_PATH_KEY", "request_uri"),
+		time:   envString("JSON_TIME_KEY", "time_local"),
+		status: envString("JSON_STATUS_KEY", "status"),
+		bytes:  envString("JSON_BYTES_KEY", "body_bytes_sent"),
+		method: envString("JSON_METHOD_KEY", "request_method"),
+		agent:  envString("JSON_AGENT_KEY", "http_user_agent"),
+	}
+}
+
+func (p *jsonParser) Parse(line string) (logFields, bool) {
+	var obj map[string]interface{}
+	d := json.NewDecoder(strings.NewReader(line))
+	d.UseNumber()
+	if err := d.Decode(&obj); err != nil || obj == nil {
+		return logFields{}, false
+	}
+
+	// Missing fields are left empty and handled like any other format, a line
+	// without an address or path gets skipped further on
+	return logFields{
+		IP:     jsonField(obj, p.ip),
+		Path:   jsonField(obj, p.path),
+		Time:   jsonField(obj, p.time),
+		Status: jsonField(obj, p.status),
+		Bytes:  jsonField(obj, p.bytes),
+		Method: jsonField(obj, p.method),
+		Agent:  jsonField(obj, p.agent),
+	}, true
+}
+
+// jsonField finds key in obj as a string, "" when it's missing or not a plain value
+func jsonField(obj map[string]interface{}, key string) string {
+	var v interface{} = obj
+	for _, part := range strings.Split(key, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		if v, ok = m[part]; !ok {
+			return ""
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
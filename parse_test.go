@@ -0,0 +1,281 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// useParser sets up the parser from env until the end of the test
+func useParser(t *testing.T, env map[string]string) error {
+	t.Helper()
+	oldParser, oldRegex, oldMatch := parser, distroRegex, distroMatch
+	oldSearch, oldPrefixes := distroSearch, pathStripPrefixes
+	t.Cleanup(func() {
+		parser, distroRegex, distroMatch = oldParser, oldRegex, oldMatch
+		distroSearch, pathStripPrefixes = oldSearch, oldPrefixes
+	})
+	for _, key := range []string{"LOG_FORMAT", "LOG_FORMAT_REGEX", "DISTRO_REGEX", "DISTRO_MATCH", "DISTRO_SEARCH", "PATH_STRIP_PREFIXES"} {
+		t.Setenv(key, env[key])
+	}
+	distroRegex = nil
+	return initParser()
+}
+
+func TestLogFormats(t *testing.T) {
+	want := logFields{
+		IP:     "203.0.113.9",
+		Path:   "/debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb",
+		Time:   "15/Oct/2026:10:00:00 +0000",
+		Bytes:  "1234",
+		Status: "200",
+		Method: "GET",
+		Agent:  "Debian APT-HTTP/1.3 (2.6.1)",
+	}
+	tests := []struct {
+		name string
+		env  map[string]string
+		line string
+		// Fields the format doesn't have
+		without []string
+	}{
+		{
+			name: "mirrormap",
+			line: `"203.0.113.9" "15/Oct/2026:10:00:00 +0000" "GET /debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb HTTP/1.1" "200" "1234" "180" "Debian APT-HTTP/1.3 (2.6.1)"`,
+		},
+		{
+			name: "combined",
+			env:  map[string]string{"LOG_FORMAT": "combined"},
+			line: `203.0.113.9 - - [15/Oct/2026:10:00:00 +0000] "GET /debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb HTTP/1.1" 200 1234 "-" "Debian APT-HTTP/1.3 (2.6.1)"`,
+		},
+		{
+			name:    "common",
+			env:     map[string]string{"LOG_FORMAT": "common"},
+			line:    `203.0.113.9 - frank [15/Oct/2026:10:00:00 +0000] "GET /debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb HTTP/1.0" 200 1234`,
+			without: []string{"agent"},
+		},
+		{
+			name: "json",
+			env:  map[string]string{"LOG_FORMAT": "json"},
+			line: `{"remote_addr":"203.0.113.9","time_local":"15/Oct/2026:10:00:00 +0000","request_method":"GET","request_uri":"/debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb","status":200,"body_bytes_sent":1234,"http_user_agent":"Debian APT-HTTP/1.3 (2.6.1)"}`,
+		},
+		{
+			name:    "regex",
+			env:     map[string]string{"LOG_FORMAT_REGEX": `^(?P<ip>[0-9.]+) (?P<path>/\S*)$`},
+			line:    `203.0.113.9 /debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb`,
+			without: []string{"time", "bytes", "status", "method", "agent"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := useParser(t, tt.env); err != nil {
+				t.Fatal(err)
+			}
+			w := want
+			for _, f := range tt.without {
+				switch f {
+				case "time":
+					w.Time = ""
+				case "bytes":
+					w.Bytes = ""
+				case "status":
+					w.Status = ""
+				case "method":
+					w.Method = ""
+				case "agent":
+					w.Agent = ""
+				}
+			}
+			got, ok := parseLine(tt.line)
+			if !ok {
+				t.Fatal("line didn't match")
+			}
+			if got != w {
+				t.Errorf("got %+v\nwant %+v", got, w)
+			}
+			if d := extractDistro(got.Path); d != "debian" {
+				t.Errorf("got distro %q, want debian", d)
+			}
+
+			// A line in some other format doesn't come out mangled
+			if f, ok := parseLine("GET /debian/ 200"); ok && f.IP != "" {
+				t.Errorf("other format parsed as %+v", f)
+			}
+		})
+	}
+}
+
+func TestLogFormatErrors(t *testing.T) {
+	for _, tt := range []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{"LOG_FORMAT": "w3c"}, `unknown LOG_FORMAT "w3c"`},
+		{map[string]string{"LOG_FORMAT_REGEX": `(?P<ip>\S+`}, "invalid log format regex"},
+		{map[string]string{"LOG_FORMAT_REGEX": `(?P<ip>\S+) (?P<url>\S+)`}, "must have named groups ip and path"},
+	} {
+		err := useParser(t, tt.env)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v gave %v, want %q", tt.env, err, tt.err)
+		}
+	}
+}
+
+func TestUnmatchedLinesCounted(t *testing.T) {
+	if err := useParser(t, map[string]string{"LOG_FORMAT": "combined"}); err != nil {
+		t.Fatal(err)
+	}
+	before := mapValue(linesSkipped, skipUnmatched)
+	for _, line := range []string{
+		// The default format when combined is configured
+		logLine("192.0.2.1", "/ubuntu/", "200", 1),
+		"",
+		"- - -",
+	} {
+		if _, ok, err := prepareLine(Line{Text: line}); ok || err != errMalformed {
+			t.Errorf("%q gave %v, %v", line, ok, err)
+		}
+	}
+	if got := mapValue(linesSkipped, skipUnmatched) - before; got != 3 {
+		t.Errorf("counted %d unmatched lines, want 3", got)
+	}
+}
+
+func TestDistroRegex(t *testing.T) {
+	tests := []struct {
+		regex, match string
+		path, want   string
+	}{
+		// The default, first path segment
+		{"", "", "/ubuntu/dists/jammy/InRelease", "ubuntu"},
+		{"", "", "/archlinux/?foo=bar", "archlinux"},
+		// A mirror prefix in front of the repo, the old second-match layout
+		{`/([^/?#]+)`, "1", "/mirror/ubuntu/dists/jammy/InRelease", "ubuntu"},
+		{`/([^/?#]+)`, "1", "/mirror/fedora?arch=x86_64", "fedora"},
+		{`/([^/?#]+)`, "1", "/ubuntu", ""},
+		// No group, the whole match is the distro
+		{`[a-z]+linux`, "", "/pub/archlinux/core/", "archlinux"},
+		{`^/repos/([^/]+)/`, "", "/repos/debian/pool/main/", "debian"},
+		{`^/repos/([^/]+)/`, "", "/debian/pool/main/", ""},
+	}
+	for _, tt := range tests {
+		err := useParser(t, map[string]string{"DISTRO_REGEX": tt.regex, "DISTRO_MATCH": tt.match})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := extractDistro(tt.path); got != tt.want {
+			t.Errorf("%q match %s in %q gave %q, want %q", tt.regex, tt.match, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestDistroRegexErrors(t *testing.T) {
+	for _, tt := range []struct {
+		regex, match, err string
+	}{
+		{`/([^/]+`, "", "invalid DISTRO_REGEX"},
+		{`/([^/]+)/([^/]+)`, "", "at most one capture group"},
+		{`/([^/]+)`, "-1", "DISTRO_MATCH can't be negative"},
+	} {
+		err := useParser(t, map[string]string{"DISTRO_REGEX": tt.regex, "DISTRO_MATCH": tt.match})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q match %q gave %v, want %q", tt.regex, tt.match, err, tt.err)
+		}
+	}
+}
+
+var benchLine = `"203.0.113.9" "15/Oct/2026:10:00:00 +0000" "GET /debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb HTTP/1.1" "200" "1234" "180" "Debian APT-HTTP/1.3 (2.6.1)"`
+
+// The way lines used to be parsed, compiling the regexes for every line and
+// splitting the request up, to compare against
+func oldParseLine(line string) (ip, distro string) {
+	quotes := regexp.MustCompile(`"(.*?)"`).FindAllString(line, -1)
+	if len(quotes) < 3 {
+		return "", ""
+	}
+	ip = strings.Trim(quotes[0], `"`)
+	matches := regexp.MustCompile(`\/(.*?)\/`).FindAllString(quotes[2], -1)
+	if len(matches) < 1 {
+		return ip, ""
+	}
+	parts := strings.SplitN(matches[0], "/", 3)
+	return ip, parts[1]
+}
+
+func BenchmarkParseLineOld(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if ip, distro := oldParseLine(benchLine); ip == "" || distro != "debian" {
+			b.Fatalf("got %q %q", ip, distro)
+		}
+	}
+}
+
+func BenchmarkParseLine(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f, ok := quotedParser{}.Parse(benchLine)
+		if !ok || extractDistro(f.Path) != "debian" {
+			b.Fatalf("got %+v", f)
+		}
+	}
+}
+
+func BenchmarkParseLineCombined(b *testing.B) {
+	p, err := newRegexParser(logFormats["combined"])
+	if err != nil {
+		b.Fatal(err)
+	}
+	line := `203.0.113.9 - - [15/Oct/2026:10:00:00 +0000] "GET /debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb HTTP/1.1" 200 1234 "-" "Debian APT-HTTP/1.3 (2.6.1)"`
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, ok := p.Parse(line)
+		if !ok || extractDistro(f.Path) != "debian" {
+			b.Fatalf("got %+v", f)
+		}
+	}
+}
+
+func TestNestedLayouts(t *testing.T) {
+	paths := []string{
+		"/pub/linux/debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb",
+		"/mirror/ubuntu/dists/jammy/InRelease",
+		"/ubuntu/dists/jammy/InRelease",
+		"/public/fedora/x.iso",
+		"/pub/linux/",
+	}
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []string
+	}{
+		// Nothing set, the first segment like always
+		{"default", nil, []string{"pub", "mirror", "ubuntu", "public", "pub"}},
+		{
+			"strip",
+			map[string]string{"PATH_STRIP_PREFIXES": "/pub/linux, mirror/,/pub"},
+			// /pub doesn't take the start of /public
+			[]string{"debian", "ubuntu", "ubuntu", "public", ""},
+		},
+		// linux is a distro of its own, which is what the strip list is for
+		{"search", map[string]string{"DISTRO_SEARCH": "true"}, []string{"linux", "ubuntu", "ubuntu", "public", "linux"}},
+		{
+			"strip then search",
+			map[string]string{"DISTRO_SEARCH": "true", "PATH_STRIP_PREFIXES": "/pub/linux"},
+			[]string{"debian", "ubuntu", "ubuntu", "public", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := useParser(t, tt.env); err != nil {
+				t.Fatal(err)
+			}
+			for i, path := range paths {
+				if got := extractDistro(path); got != tt.want[i] {
+					t.Errorf("%s gave %q, want %q", path, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
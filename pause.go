@@ -0,0 +1,40 @@
+// pause.go
+package main
+
+// A websocket client can send {"op":"pause"} to stop getting events, like
+// when its tab is hidden, and {"op":"resume"} to start again. While paused
+// the last PAUSE_BUFFER events are kept to be sent on resume, 0 keeps none.
+// It can't be more than CLIENT_BUFFER so they all fit.
+var pauseBuffer = envInt("PAUSE_BUFFER", 0)
+
+// hold keeps msg for when c resumes, dropping the oldest past pauseBuffer.
+// Those weren't missed for not keeping up so they don't count as dropped.
+// Called with the hub's lock held for writing.
+func (c *client) hold(msg message) {
+	if pauseBuffer <= 0 {
+		return
+	}
+	if len(c.held) >= pauseBuffer {
+		c.held = c.held[1:]
+	}
+	c.held = append(c.held, msg)
+}
+
+// resume sends c what was held for it while paused and starts sending it
+// events again
+func (h *Hub) resume(id string, c *client) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !c.paused {
+		return
+	}
+	c.paused = false
+	for _, msg := range c.held {
+		// It may have been removed for missing too many
+		if h.clients[id] != c {
+			break
+		}
+		h.send(id, c, msg)
+	}
+	c.held = nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readSeq reads the next json event from conn
+func readSeq(t *testing.T, conn *websocket.Conn) uint32 {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j jsonEvent
+	if err := json.Unmarshal(msg, &j); err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+	return j.Seq
+}
+
+// Pausing, a burst of events, then resuming, keeping none or the last few of
+// the burst
+func TestPauseBurstResume(t *testing.T) {
+	for _, held := range []int{0, 5} {
+		old := pauseBuffer
+		pauseBuffer = held
+		t.Cleanup(func() { pauseBuffer = old })
+
+		url := socketServer(t)
+		conn, c := dialClient(t, url, "format=json")
+		paused := func() bool {
+			var p bool
+			hub.Update(func() { p = c.paused })
+			return p
+		}
+		send := func(msg string) {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		send(`{"op":"pause"}`)
+		waitFor(t, "pausing", paused)
+		var burst []uint32
+		for i := 0; i < 50; i++ {
+			hub.Broadcast(event{Distro: 1, Lat: 1, Long: 1, Time: time.Now()})
+			hub.Update(func() { burst = append(burst, nextSeq.Load()-1) })
+		}
+		var n int
+		hub.Update(func() { n = len(c.held) })
+		if len(c.ch) != 0 || n != held {
+			t.Fatalf("%d queued and %d held while paused, want 0 and %d", len(c.ch), n, held)
+		}
+
+		send(`{"op":"resume"}`)
+		waitFor(t, "resuming", func() bool { return !paused() })
+		for _, seq := range burst[len(burst)-held:] {
+			if got := readSeq(t, conn); got != seq {
+				t.Fatalf("keeping %d: got %d after resuming, want %d", held, got, seq)
+			}
+		}
+		// Then carries on from now, on the same connection and registration
+		hub.Broadcast(event{Distro: 2, Lat: 1, Long: 1, Time: time.Now()})
+		if got, want := readSeq(t, conn), nextSeq.Load()-1; got != want {
+			t.Errorf("keeping %d: got %d, want the new event %d", held, got, want)
+		}
+	}
+}
+
+// Messages say what they're for in op, or type like the ones clients are sent
+func TestClientMessageOp(t *testing.T) {
+	id, c := registerID(t, "format=json")
+	paused := func() bool {
+		var p bool
+		hub.Update(func() { p = c.paused })
+		return p
+	}
+	for _, tt := range []struct {
+		msg    string
+		paused bool
+	}{
+		{`{"op":"pause"}`, true},
+		{`{"op":"resume"}`, false},
+		{`{"type":"pause"}`, true},
+		{`{"type":"resume"}`, false},
+	} {
+		if err := handleClientMessage(id, c, []byte(tt.msg)); err != nil {
+			t.Fatalf("%s: %s", tt.msg, err)
+		}
+		if paused() != tt.paused {
+			t.Errorf("paused is %v after %s", !tt.paused, tt.msg)
+		}
+	}
+	for _, msg := range []string{`{}`, `{"op":"sleep"}`} {
+		if err := handleClientMessage(id, c, []byte(msg)); err == nil {
+			t.Errorf("%s was accepted", msg)
+		}
+	}
+}
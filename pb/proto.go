@@ -0,0 +1,8 @@
+package pb
+
+import _ "embed"
+
+// Proto is mirrormap.proto, served so consumers can generate their own code
+//
+//go:embed mirrormap.proto
+var Proto []byte
@@ -0,0 +1,174 @@
+// poll.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// For clients that can't keep any connection open, /map/poll/{id} waits up
+// to POLL_WAIT for events and returns up to POLL_MAX of them as a JSON array.
+// Each client keeps the last POLL_BUFFER events for its next poll, and is
+// forgotten when it hasn't polled for POLL_EXPIRY.
+var pollWait = envDuration("POLL_WAIT", 25*time.Second)
+var pollMax = envInt("POLL_MAX", 100)
+var pollBufferSize = envInt("POLL_BUFFER", 100)
+var pollExpiry = envDuration("POLL_EXPIRY", time.Minute)
+
+// initPoll checks the polling settings
+func initPoll() error {
+	if pollWait <= 0 || pollExpiry <= pollWait {
+		return fmt.Errorf("POLL_WAIT must be more than 0 and POLL_EXPIRY longer than it")
+	}
+	if pollMax < 1 || pollBufferSize < 1 {
+		return fmt.Errorf("POLL_MAX and POLL_BUFFER must be at least 1")
+	}
+	return nil
+}
+
+type polledEvent struct {
+	seq uint32
+	msg []byte
+}
+
+// pollBuffer holds the events of a client that polls instead of reading a
+// websocket
+type pollBuffer struct {
+	lock   sync.Mutex
+	events []polledEvent
+	// Closed when events are added
+	added chan struct{}
+	// When the client last polled
+	seen time.Time
+}
+
+func newPollBuffer() *pollBuffer {
+	return &pollBuffer{added: make(chan struct{}), seen: time.Now()}
+}
+
+// add keeps an event for the next poll, reporting false if the oldest one had
+// to go to make room
+func (p *pollBuffer) add(seq uint32, msg []byte) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kept := len(p.events) < pollBufferSize
+	if !kept {
+		p.events = p.events[1:]
+	}
+	p.events = append(p.events, polledEvent{seq, msg})
+	close(p.added)
+	p.added = make(chan struct{})
+	return kept
+}
+
+// after returns up to pollMax events that came after since, or all of them
+// without since, and a channel closed once there are more
+func (p *pollBuffer) after(since uint32, hasSince bool) ([][]byte, <-chan struct{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.seen = time.Now()
+	var msgs [][]byte
+	for _, e := range p.events {
+		// Sequence numbers wrap around, compare the distance between them
+		if hasSince && int32(e.seq-since) <= 0 {
+			continue
+		}
+		msgs = append(msgs, e.msg)
+		if len(msgs) == pollMax {
+			break
+		}
+	}
+	return msgs, p.added
+}
+
+// pollHandler sends a registered client the events after ?since=, waiting up
+// to pollWait for some to come along
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !requireAuth(w, r, id) {
+		return
+	}
+	var since uint64
+	hasSince := r.URL.Query().Has("since")
+	if hasSince {
+		var err error
+		if since, err = strconv.ParseUint(r.URL.Query().Get("since"), 10, 32); err != nil {
+			http.Error(w, "since must be a sequence number", 400)
+			return
+		}
+	}
+
+	c, ok := hub.Lookup(id)
+	if !ok {
+		unknownID(w, id)
+		return
+	}
+	hub.Update(func() {
+		if c.poll == nil && !c.aggregate && !c.shared {
+			c.attached = true
+			c.poll = newPollBuffer()
+			log.Printf("%s is polling", id)
+		}
+	})
+	if c.aggregate {
+		http.Error(w, "aggregate clients can't poll", 400)
+		return
+	}
+	if c.shared {
+		http.Error(w, "shared clients can't poll", 400)
+		return
+	}
+
+	timeout := time.NewTimer(pollWait)
+	defer timeout.Stop()
+	for {
+		msgs, more := c.poll.after(uint32(since), hasSince)
+		if len(msgs) > 0 {
+			writePoll(w, msgs)
+			return
+		}
+		select {
+		case <-more:
+		case <-timeout.C:
+			writePoll(w, nil)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writePoll(w http.ResponseWriter, msgs [][]byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(encodeBatch(msgs, formatJSON))
+}
+
+// expirePolls forgets clients that stopped polling
+func expirePolls() {
+	for range time.Tick(pollExpiry / 2) {
+		evictPolls()
+	}
+}
+
+// evictPolls forgets clients that haven't polled for pollExpiry
+func evictPolls() {
+	hub.Evict(func(id string, c *client) bool {
+		if c.poll == nil {
+			return false
+		}
+		c.poll.lock.Lock()
+		expired := time.Since(c.poll.seen) > pollExpiry
+		c.poll.lock.Unlock()
+		if expired {
+			log.Printf("%s stopped polling", id)
+		}
+		return expired
+	})
+}
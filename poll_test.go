@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// pollServer serves registering and polling until the end of the test
+func pollServer(t *testing.T) string {
+	r := mux.NewRouter()
+	r.HandleFunc("/map/register", registerHandler)
+	r.HandleFunc("/map/poll/{id}", pollHandler)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// get fetches url like curl -s, giving the status and body
+func get(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+// poll polls id, failing the test unless it gets events back
+func poll(t *testing.T, url, id, query string) []jsonEvent {
+	t.Helper()
+	code, body := get(t, url+"/map/poll/"+id+query)
+	if code != http.StatusOK {
+		t.Fatalf("poll%s got %d %s", query, code, body)
+	}
+	var events []jsonEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		t.Fatalf("poll%s got %s: %s", query, body, err)
+	}
+	return events
+}
+
+// The example in the README
+func TestPollEndToEnd(t *testing.T) {
+	oldWait, oldMax := pollWait, pollMax
+	pollWait, pollMax = 200*time.Millisecond, 5
+	t.Cleanup(func() { pollWait, pollMax = oldWait, oldMax })
+	url := pollServer(t)
+
+	code, body := get(t, url+"/map/register")
+	if code != http.StatusOK {
+		t.Fatalf("register got %d %s", code, body)
+	}
+	id := string(body)
+	t.Cleanup(func() {
+		if c, ok := hub.Lookup(id); ok {
+			hub.Unregister(id, c)
+		}
+	})
+
+	// Nothing yet, after waiting
+	start := time.Now()
+	if events := poll(t, url, id, ""); len(events) != 0 || time.Since(start) < pollWait {
+		t.Errorf("got %d events after %s", len(events), time.Since(start))
+	}
+
+	// A poll waiting when an event comes gets it straight away
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		hub.Broadcast(event{Distro: 1, Lat: 1, Long: 1, Time: time.Now()})
+	}()
+	events := poll(t, url, id, "")
+	if len(events) != 1 {
+		t.Fatalf("got %d events", len(events))
+	}
+	last := events[0].Seq
+
+	// Capped at pollMax, the rest come with the next poll
+	for i := 0; i < pollMax+3; i++ {
+		hub.Broadcast(event{Distro: 2, Lat: 1, Long: 1, Time: time.Now()})
+	}
+	since := "?since=" + strconv.FormatUint(uint64(last), 10)
+	events = poll(t, url, id, since)
+	if len(events) != pollMax || events[0].Seq != last+1 {
+		t.Fatalf("got %d events starting at %d, want %d from %d", len(events), events[0].Seq, pollMax, last+1)
+	}
+	since = "?since=" + strconv.FormatUint(uint64(events[len(events)-1].Seq), 10)
+	if events = poll(t, url, id, since); len(events) != 3 || events[2].Seq != last+uint32(pollMax)+3 {
+		t.Errorf("got %d more events", len(events))
+	}
+
+	for query, want := range map[string]int{
+		"?since=abc": http.StatusBadRequest,
+		"?since=-1":  http.StatusBadRequest,
+	} {
+		if code, _ := get(t, url+"/map/poll/"+id+query); code != want {
+			t.Errorf("poll%s got %d, want %d", query, code, want)
+		}
+	}
+	if code, _ := get(t, url+"/map/poll/nosuchid"); code != http.StatusNotFound {
+		t.Errorf("unknown id got %d", code)
+	}
+}
+
+// A polling client has a buffer of its own, and is forgotten once it stops
+// polling
+func TestPollExpiry(t *testing.T) {
+	oldWait := pollWait
+	pollWait = 10 * time.Millisecond
+	t.Cleanup(func() { pollWait = oldWait })
+	url := pollServer(t)
+
+	id, c := registerID(t, "")
+	poll(t, url, id, "")
+	hub.Broadcast(event{Distro: 1, Lat: 1, Long: 1, Time: time.Now()})
+	if len(c.ch) != 0 {
+		t.Error("polling client's event went to its websocket channel")
+	}
+
+	evictPolls()
+	if _, ok := hub.Lookup(id); !ok {
+		t.Fatal("client forgotten while polling")
+	}
+	c.poll.lock.Lock()
+	c.poll.seen = time.Now().Add(-pollExpiry - time.Second)
+	c.poll.lock.Unlock()
+	evictPolls()
+	if _, ok := hub.Lookup(id); ok {
+		t.Error("client kept after it stopped polling")
+	}
+	if code, _ := get(t, url+"/map/poll/"+id); code != http.StatusNotFound {
+		t.Errorf("forgotten client got %d", code)
+	}
+}
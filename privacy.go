@@ -0,0 +1,121 @@
+// privacy.go
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+)
+
+// With PRIVACY_MODE client addresses are only used for the GeoIP lookup and
+// never kept: dedup and the GeoIP cache key on a salted hash with the salt
+// changing every day, the line is let go of straight after the lookup, and
+// logged lines have addresses taken out.
+var privacyMode = envBool("PRIVACY_MODE", false)
+
+var anonSalt []byte
+var anonSaltDay string
+var anonSalt_lock sync.Mutex
+
+// anonKey is what ip is remembered by, a salted hash of it in PRIVACY_MODE
+func anonKey(ip string) string {
+	if !privacyMode {
+		return ip
+	}
+
+	day := time.Now().UTC().Format("2006-01-02")
+	anonSalt_lock.Lock()
+	if day != anonSaltDay {
+		// Yesterday's hashes can't be matched to anything any more
+		anonSalt = make([]byte, 16)
+		rand.Read(anonSalt)
+		anonSaltDay = day
+	}
+	salt := anonSalt
+	anonSalt_lock.Unlock()
+
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(ip))
+	return string(h.Sum(nil)[:16])
+}
+
+// Anything that might be an address, checked properly by redactIPs
+var reMaybeIP = regexp.MustCompile(`[0-9A-Fa-f:.\[\]]{7,}`)
+
+// redactIPs takes every address out of s in PRIVACY_MODE
+func redactIPs(s string) string {
+	if !privacyMode {
+		return s
+	}
+	return reMaybeIP.ReplaceAllStringFunc(s, func(m string) string {
+		if parse.ExtractIP(m) != nil {
+			return "[ip]"
+		}
+		// An address followed by something that isn't a port, like "192.0.2.1:http"
+		if trimmed := strings.TrimRight(m, ":."); parse.ExtractIP(trimmed) != nil {
+			return "[ip]" + m[len(trimmed):]
+		}
+		return m
+	})
+}
+
+// With PRIVACY_JITTER_KM every location is moved by up to that many km before
+// it's sent, so a city level location and a timestamp can't pin down someone
+// in a small town. 0 turns it off.
+var privacyJitterKm = envFloat("PRIVACY_JITTER_KM", 0)
+
+// Mixed into the offsets so they can't be worked out from an address, picked
+// at startup so a client still lands in the same place all day
+var jitterSalt = func() []byte {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return salt
+}()
+
+// Roughly how many km one degree of latitude covers
+const kmPerDegree = 111.32
+
+// jitter moves lat and long to a point within privacyJitterKm of them, the
+// same point for the same ip all day. Latitude stays within range and on the
+// same side of the equator.
+func jitter(lat, long float64, ip string, when time.Time) (float64, float64) {
+	if privacyJitterKm <= 0 {
+		return lat, long
+	}
+
+	h := fnv.New128a()
+	h.Write(jitterSalt)
+	h.Write([]byte(ip))
+	h.Write([]byte(when.UTC().Format("2006-01-02")))
+	sum := h.Sum(nil)
+	u := float64(binary.LittleEndian.Uint64(sum[:8])>>11) / (1 << 53)
+	v := float64(binary.LittleEndian.Uint64(sum[8:])>>11) / (1 << 53)
+
+	// Spread evenly over the disc rather than bunched in the middle
+	dist := privacyJitterKm * math.Sqrt(u)
+	bearing := 2 * math.Pi * v
+	dLat := dist * math.Cos(bearing) / kmPerDegree
+	// Degrees of longitude shrink towards the poles
+	dLong := dist * math.Sin(bearing) / (kmPerDegree * math.Max(math.Cos(lat*math.Pi/180), 0.01))
+
+	newLat := lat + dLat
+	if lat != 0 && math.Signbit(newLat) != math.Signbit(lat) {
+		newLat = lat - dLat
+	}
+	newLat = math.Max(-90, math.Min(90, newLat))
+
+	newLong := math.Mod(long+dLong+180, 360)
+	if newLong < 0 {
+		newLong += 360
+	}
+	return newLat, newLong - 180
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// distanceKm is the great circle distance between two points
+func distanceKm(lat1, long1, lat2, long2 float64) float64 {
+	const earthKm = 6371
+	rad := math.Pi / 180
+	dLat, dLong := (lat2-lat1)*rad, (long2-long1)*rad
+	a := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Pow(math.Sin(dLong/2), 2)
+	return 2 * earthKm * math.Asin(math.Sqrt(a))
+}
+
+func TestJitterOffByDefault(t *testing.T) {
+	if lat, long := jitter(48.1, 11.6, "192.0.2.1", time.Now()); lat != 48.1 || long != 11.6 {
+		t.Errorf("moved to %v,%v without PRIVACY_JITTER_KM", lat, long)
+	}
+}
+
+func TestJitterBounds(t *testing.T) {
+	old := privacyJitterKm
+	privacyJitterKm = 25
+	t.Cleanup(func() { privacyJitterKm = old })
+
+	places := [][2]float64{
+		{48.1, 11.6},
+		// Right by the equator, both sides
+		{0.05, 32.6},
+		{-0.05, -78.5},
+		// Near the poles
+		{89.95, 0},
+		{-89.95, 139.3},
+		// Either side of the antimeridian
+		{-17.7, 179.99},
+		{65.0, -179.99},
+	}
+	day := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	for _, p := range places {
+		var moved float64
+		for i := 0; i < 500; i++ {
+			ip := fmt.Sprintf("198.51.%d.%d", i/256, i%256)
+			lat, long := jitter(p[0], p[1], ip, day)
+
+			if lat < -90 || lat > 90 || long < -180 || long >= 180 {
+				t.Fatalf("%v moved out of range to %v,%v", p, lat, long)
+			}
+			if math.Signbit(lat) != math.Signbit(p[0]) {
+				t.Fatalf("%v moved across the equator to %v,%v", p, lat, long)
+			}
+			d := distanceKm(p[0], p[1], lat, long)
+			if d > privacyJitterKm*1.01 {
+				t.Fatalf("%v moved %.1f km to %v,%v", p, d, lat, long)
+			}
+			moved = math.Max(moved, d)
+
+			// The same all day, somewhere else the next
+			if lat2, long2 := jitter(p[0], p[1], ip, day.Add(11*time.Hour)); lat2 != lat || long2 != long {
+				t.Fatalf("%s moved from %v,%v to %v,%v later that day", ip, lat, long, lat2, long2)
+			}
+			if lat2, long2 := jitter(p[0], p[1], ip, day.Add(24*time.Hour)); lat2 == lat && long2 == long {
+				t.Fatalf("%s is still at %v,%v the next day", ip, lat, long)
+			}
+		}
+		// The whole radius gets used, not just the middle of it
+		if moved < privacyJitterKm/2 {
+			t.Errorf("%v was never moved more than %.1f km", p, moved)
+		}
+	}
+}
+
+// lockedBuffer collects log output from any goroutine
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// With PRIVACY_MODE on no address from a replayed log turns up anywhere:
+// logs, skipped line samples, messages in every format or the history
+func TestPrivacyModeKeepsNoAddresses(t *testing.T) {
+	oldPrivacy, oldSamples := privacyMode, skipSamples
+	privacyMode, skipSamples = true, 100
+	var logged lockedBuffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() {
+		privacyMode, skipSamples = oldPrivacy, oldSamples
+		log.SetOutput(os.Stderr)
+		skipLogged_lock.Lock()
+		skipLogged = make(map[string]int)
+		skipLogged_lock.Unlock()
+	})
+	useTestDB(t,
+		testNetwork{"81.2.0.0/16", cityRecord(51.5, -0.1, "GB", "London")},
+		testNetwork{"192.0.2.0/24", map[string]interface{}{"country": map[string]interface{}{"iso_code": "ZZ"}}},
+	)
+
+	addresses := []string{"81.2.70.1", "81.2.70.2", "81.2.70.3", "81.2.70.4", "192.0.2.77", "2001:db8::5", "81.2.70.5"}
+	lines := []string{
+		logLine(addresses[0], "/ubuntu/pool/a.deb", "200", 1),
+		logLine(addresses[1]+", 10.0.0.1", "/debian/pool/b.deb", "200", 1),
+		// Skipped for all sorts of reasons, with samples logged
+		logLine(addresses[2], "/nosuchdistro/x.iso", "200", 1),
+		addresses[3] + " not a log line",
+		logLine(addresses[4], "/ubuntu/pool/a.deb", "200", 1),
+		logLine("["+addresses[5]+"]:443", "/ubuntu/pool/a.deb", "200", 1),
+		logLine(addresses[6]+":http", "/ubuntu/pool/a.deb", "200", 1),
+	}
+
+	var clients []*client
+	for f := range messageFormats {
+		if f != formatFields {
+			clients = append(clients, registerClient(t, "format="+f))
+		}
+	}
+	clients = append(clients, registerClient(t, "fields=time,bytes,agent,asn,flags,radius,kind,org,country,city,seq"))
+
+	readLines(newSliceSource(lines...))
+
+	sent := 0
+	var out []byte
+	for _, c := range clients {
+		for len(c.ch) > 0 {
+			out = append(out, (<-c.ch).data...)
+			sent++
+		}
+	}
+	if sent != 2*len(clients) {
+		t.Errorf("%d messages sent, want %d", sent, 2*len(clients))
+	}
+	var kept []event
+	hub.Update(func() { kept = backfillFor(nil, time.Time{}) })
+	out = fmt.Appendf(out, "%+v", kept)
+
+	if !strings.Contains(logged.String(), "Skipped line") {
+		t.Fatal("no skipped lines were logged")
+	}
+	for _, addr := range addresses {
+		if strings.Contains(logged.String(), addr) {
+			t.Errorf("%s was logged:\n%s", addr, logged.String())
+		}
+		if bytes.Contains(out, []byte(addr)) {
+			t.Errorf("%s was sent or kept", addr)
+		}
+	}
+}
+
+func TestRedactIPs(t *testing.T) {
+	old := privacyMode
+	privacyMode = true
+	t.Cleanup(func() { privacyMode = old })
+
+	tests := []struct {
+		in, want string
+	}{
+		{`"192.0.2.1" "GET /ubuntu/ HTTP/1.1"`, `"[ip]" "GET /ubuntu/ HTTP/1.1"`},
+		{"192.0.2.1:443 and [2001:db8::1]:8080", "[ip] and [ip]"},
+		{"192.0.2.1:http", "[ip]:http"},
+		{"error looking up '2001:db8::5': no", "error looking up '[ip]': no"},
+		{"10.0.0.1, 81.2.69.142", "[ip], [ip]"},
+		// Things that only look a bit like addresses stay
+		{"15/Oct/2026:10:00:00 +0000", "15/Oct/2026:10:00:00 +0000"},
+		{"bash_5.2.15-2_amd64.deb", "bash_5.2.15-2_amd64.deb"},
+		{"deadbeef", "deadbeef"},
+	}
+	for _, tt := range tests {
+		if got := redactIPs(tt.in); got != tt.want {
+			t.Errorf("redactIPs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
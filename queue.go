@@ -0,0 +1,110 @@
+// queue.go
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// Lines waiting for a worker, and lines dropped because the queue was full
+var queueDropped = expvar.NewInt("queue_dropped")
+
+// Between preparing lines and looking up where they came from is a queue of
+// INGEST_QUEUE lines worked through by INGEST_WORKERS workers, one per CPU by
+// default since GeoIP lookups are the slow part. INGEST_OVERFLOW says what
+// happens when it's full: block the reader, drop-newest or drop-oldest.
+var ingestQueueSize int
+var ingestWorkers int
+var ingestOverflow string
+
+// The queue in use, only for reporting its length
+var ingestQueue chan preparedLine
+var ingestQueue_lock sync.RWMutex
+
+func init() {
+	expvar.Publish("queue_length", expvar.Func(func() interface{} {
+		ingestQueue_lock.RLock()
+		defer ingestQueue_lock.RUnlock()
+		return len(ingestQueue)
+	}))
+}
+
+// initQueue reads the queue settings
+func initQueue() error {
+	ingestQueueSize = envInt("INGEST_QUEUE", 1000)
+	ingestWorkers = envInt("INGEST_WORKERS", runtime.NumCPU())
+	ingestOverflow = envString("INGEST_OVERFLOW", "block")
+	if ingestQueueSize < 1 || ingestWorkers < 1 {
+		return fmt.Errorf("INGEST_QUEUE and INGEST_WORKERS must be at least 1")
+	}
+	switch ingestOverflow {
+	case "block", "drop-newest", "drop-oldest":
+	default:
+		return fmt.Errorf("INGEST_OVERFLOW must be block, drop-newest or drop-oldest, not %q", ingestOverflow)
+	}
+	return nil
+}
+
+// startWorkers makes a new queue with workers locating and broadcasting
+// everything put in it. Closing the queue stops them, wait returns once
+// they're finished.
+func startWorkers() (queue chan preparedLine, wait func()) {
+	queue = make(chan preparedLine, ingestQueueSize)
+	ingestQueue_lock.Lock()
+	ingestQueue = queue
+	ingestQueue_lock.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < ingestWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				// A bad line is skipped, it's never a reason to stop reading.
+				// broadcast never blocks so there's no need for another stage
+				// between here and the clients.
+				if ev, ok, _ := locateLine(p); ok {
+					hub.Broadcast(ev)
+				}
+				p.done()
+			}
+		}()
+	}
+	return queue, wg.Wait
+}
+
+// enqueue adds a line to the queue following INGEST_OVERFLOW
+func enqueue(queue chan preparedLine, l preparedLine) {
+	switch ingestOverflow {
+	case "drop-newest":
+		select {
+		case queue <- l:
+		default:
+			dropLine(l)
+		}
+	case "drop-oldest":
+		for {
+			select {
+			case queue <- l:
+				return
+			default:
+			}
+			// Make room, unless a worker beat us to it
+			select {
+			case old := <-queue:
+				dropLine(old)
+			default:
+			}
+		}
+	default:
+		queue <- l
+	}
+}
+
+// dropLine gives up on a line, it's still done as far as the source is concerned
+func dropLine(l preparedLine) {
+	queueDropped.Add(1)
+	l.done()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// benchmarkWorkers replays a log of different clients through readLines
+// with every lookup going to the database
+func benchmarkWorkers(b *testing.B, workers int) {
+	useTestDB(b, testNetwork{"81.2.0.0/16", cityRecord(51.5, -0.1, "GB", "London")})
+	oldWorkers, oldDedup, oldCache := ingestWorkers, dedup, geoLookups
+	ingestWorkers, dedup, geoLookups = workers, nil, nil
+	b.Cleanup(func() { ingestWorkers, dedup, geoLookups = oldWorkers, oldDedup, oldCache })
+
+	const n = 20000
+	lines := make([]string, n)
+	for i, ip := range replayAddresses(n) {
+		lines[i] = logLine(fmt.Sprint(ip), "/ubuntu/pool/a.deb", "200", 1)
+	}
+	c := testClient(b, "bench-workers", n)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		readLines(newSliceSource(lines...))
+		for len(c.ch) > 0 {
+			<-c.ch
+		}
+	}
+	b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "lines/s")
+}
+
+func BenchmarkWorkers1(b *testing.B)      { benchmarkWorkers(b, 1) }
+func BenchmarkWorkersNumCPU(b *testing.B) { benchmarkWorkers(b, runtime.NumCPU()) }
+
+// Several workers at once lose nothing, run with -race
+func TestWorkersDeliverEverything(t *testing.T) {
+	useTestDB(t, testNetwork{"81.2.0.0/16", cityRecord(51.5, -0.1, "GB", "London")})
+	oldWorkers := ingestWorkers
+	ingestWorkers = 4
+	t.Cleanup(func() { ingestWorkers = oldWorkers })
+
+	const n = 2000
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = logLine(fmt.Sprintf("81.2.%d.%d", 100+i/250, i%250), "/ubuntu/pool/a.deb", "200", 1)
+	}
+	c := testClient(t, "workers", n)
+	readLines(newSliceSource(lines...))
+
+	if got := len(c.ch); got != n {
+		t.Errorf("got %d events from %d lines", got, n)
+	}
+}
@@ -0,0 +1,181 @@
+// ratelimit.go
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each address can register REGISTER_RATE times a second and open
+// UPGRADE_RATE websockets a second, with bursts of up to REGISTER_BURST and
+// UPGRADE_BURST. /map/socket does both so it counts for both. 0 turns either
+// off. Only the last RATE_LIMIT_SIZE addresses seen are tracked.
+var registerLimiter, upgradeLimiter *rateLimiter
+
+// Requests from TRUSTED_PROXIES, a comma separated list of addresses and
+// CIDR ranges, are counted against the address in PROXY_HEADER instead
+var trustedProxies []*net.IPNet
+var proxyHeader = envString("PROXY_HEADER", "X-Forwarded-For")
+
+// Requests turned away by each limit
+var registerRateLimited = expvar.NewInt("register_rate_limited")
+var upgradeRateLimited = expvar.NewInt("upgrade_rate_limited")
+
+// rateLimiter is a token bucket per address, forgetting the least recently
+// seen once it's tracking size of them
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	size  int
+
+	lock  sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// initRateLimits reads the rate limit and trusted proxy settings
+func initRateLimits() error {
+	size := envInt("RATE_LIMIT_SIZE", 10000)
+	if size < 1 {
+		return fmt.Errorf("RATE_LIMIT_SIZE must be at least 1")
+	}
+	var err error
+	if registerLimiter, err = newRateLimiter("REGISTER", size); err != nil {
+		return err
+	}
+	if upgradeLimiter, err = newRateLimiter("UPGRADE", size); err != nil {
+		return err
+	}
+
+	for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("invalid TRUSTED_PROXIES entry %q", p)
+		}
+		trustedProxies = append(trustedProxies, n)
+	}
+	return nil
+}
+
+// newRateLimiter reads prefix_RATE and prefix_BURST, nil when the rate is 0
+func newRateLimiter(prefix string, size int) (*rateLimiter, error) {
+	rate := envFloat(prefix+"_RATE", 0)
+	burst := envInt(prefix+"_BURST", 10)
+	if rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) || burst < 1 {
+		return nil, fmt.Errorf("%s_RATE can't be negative and %s_BURST must be at least 1", prefix, prefix)
+	}
+	if rate == 0 {
+		return nil, nil
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), size: size, order: list.New(), items: make(map[string]*list.Element)}, nil
+}
+
+// allow takes a token for addr, or says how long until there's one. A nil
+// limiter allows everything.
+func (l *rateLimiter) allow(addr string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var b *bucket
+	if e, ok := l.items[addr]; ok {
+		l.order.MoveToFront(e)
+		b = e.Value.(*bucket)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	} else {
+		b = &bucket{key: addr, tokens: l.burst, last: now}
+		l.items[addr] = l.order.PushFront(b)
+		if l.order.Len() > l.size {
+			oldest := l.order.Back()
+			l.order.Remove(oldest)
+			delete(l.items, oldest.Value.(*bucket).key)
+		}
+	}
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// limit answers with 429 and returns false if the address r is from is over
+// l, counting it in limited
+func limit(w http.ResponseWriter, r *http.Request, l *rateLimiter, limited *expvar.Int) bool {
+	ok, wait := l.allow(requestIP(r), time.Now())
+	if ok {
+		return true
+	}
+	limited.Add(1)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "too many requests", 429)
+	return false
+}
+
+// requestIP is the address r came from. Through a trusted proxy that's the
+// last one in the proxy header that isn't another trusted proxy, since
+// anything before it could have been made up by the client.
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(r.Header.Get(proxyHeader), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// trustedProxy reports whether addr is in TRUSTED_PROXIES
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
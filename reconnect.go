@@ -0,0 +1,76 @@
+// reconnect.go
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A websocket client that disconnects is kept for RECONNECT_GRACE, so
+// connecting to /map/socket/{id} again picks up where it left off with the
+// same options, and gets the events that fit in its buffer meanwhile. 0
+// forgets it straight away.
+var reconnectGrace = envDuration("RECONNECT_GRACE", 30*time.Second)
+
+// attach makes conn the connection of c, returning the one it replaces for
+// the caller to close. Whatever connected last wins. Called with the hub's
+// lock held.
+func (c *client) attach(conn *websocket.Conn) *websocket.Conn {
+	old := c.conn
+	c.conn = conn
+	c.attached = true
+	c.detached = false
+	c.gen++
+	// Pausing was up to the old connection
+	c.paused, c.held = false, nil
+	return old
+}
+
+// replace closes the connection a newer one took over from
+func replace(old *websocket.Conn) {
+	writeClose(old, websocket.CloseNormalClosure, "replaced by a newer connection")
+	old.Close()
+}
+
+// release is called once conn, a connection of client id, has closed. Unless
+// a newer connection took over, which it reports, c is kept for
+// reconnectGrace in case it comes back, then removed. Connections to a shared
+// client are removed straight away.
+func (h *Hub) release(id string, c *client, conn *websocket.Conn) (replaced bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if c.parent != nil {
+		h.unshare(id, c)
+		return false
+	}
+	if c.conn != conn {
+		return true
+	}
+	c.conn = nil
+	if h.clients[id] == c {
+		h.keep(id, c)
+	}
+	return false
+}
+
+// keep removes client id after reconnectGrace unless it's connected again by
+// then. Called with the lock held for writing.
+func (h *Hub) keep(id string, c *client) {
+	if reconnectGrace <= 0 || h.shuttingDown {
+		h.remove(id, c)
+		return
+	}
+
+	c.detached = true
+	gen := c.gen
+	time.AfterFunc(reconnectGrace, func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if c.detached && c.gen == gen && h.clients[id] == c {
+			h.remove(id, c)
+			log.Printf("%s didn't reconnect", id)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+// sample.go
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Lines kept and dropped by sampling, and the fraction kept
+var sampleKept = expvar.NewInt("sample_kept")
+var sampleDropped = expvar.NewInt("sample_dropped")
+
+func init() {
+	expvar.Publish("sample_rate", expvar.Func(func() interface{} {
+		kept, dropped := sampleKept.Value(), sampleDropped.Value()
+		if kept+dropped == 0 {
+			return 1.0
+		}
+		return float64(kept) / float64(kept+dropped)
+	}))
+}
+
+// Sampling settings. SAMPLE_MODE is off, ratio to keep one in SAMPLE_RATIO
+// lines, or rate to keep at most SAMPLE_RATE lines a second. With
+// SAMPLE_PER_DISTRO every distro is sampled on its own so quiet ones still show up.
+var sampleMode string
+var sampleRatio int
+var sampleRate int
+var samplePerDistro bool
+
+var samplers = make(map[int]*sampler)
+var samplers_lock sync.Mutex
+
+// sampler keeps the state for one stream of lines
+type sampler struct {
+	lock sync.Mutex
+
+	// ratio mode, lines seen so far
+	seen uint64
+
+	// rate mode, lines seen this second and last second and lines kept this second
+	window     time.Time
+	thisSecond int
+	lastSecond int
+	kept       int
+}
+
+// initSampling reads the sampling settings
+func initSampling() error {
+	sampleMode = envString("SAMPLE_MODE", "off")
+	samplePerDistro = envBool("SAMPLE_PER_DISTRO", false)
+	switch sampleMode {
+	case "off":
+	case "ratio":
+		sampleRatio = envInt("SAMPLE_RATIO", 10)
+		if sampleRatio < 1 {
+			return fmt.Errorf("SAMPLE_RATIO must be at least 1")
+		}
+	case "rate":
+		sampleRate = envInt("SAMPLE_RATE", 100)
+		if sampleRate < 1 {
+			return fmt.Errorf("SAMPLE_RATE must be at least 1")
+		}
+	default:
+		return fmt.Errorf("unknown SAMPLE_MODE %q", sampleMode)
+	}
+	return nil
+}
+
+// sampled reports whether a line for distro should be kept
+func sampled(distro int) bool {
+	if sampleMode == "off" {
+		return true
+	}
+
+	key := 0
+	if samplePerDistro {
+		key = distro
+	}
+	samplers_lock.Lock()
+	s, ok := samplers[key]
+	if !ok {
+		s = &sampler{}
+		samplers[key] = s
+	}
+	samplers_lock.Unlock()
+
+	keep := s.keep(time.Now())
+	if keep {
+		sampleKept.Add(1)
+	} else {
+		sampleDropped.Add(1)
+	}
+	return keep
+}
+
+func (s *sampler) keep(now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if sampleMode == "ratio" {
+		// The first line is always kept so nothing disappears completely
+		keep := s.seen%uint64(sampleRatio) == 0
+		s.seen++
+		return keep
+	}
+
+	// Spread the drops evenly by keeping each line with the chance that
+	// would have let last second's traffic through at SAMPLE_RATE
+	if now.Sub(s.window) >= time.Second {
+		if now.Sub(s.window) >= 2*time.Second {
+			s.lastSecond = 0
+		} else {
+			s.lastSecond = s.thisSecond
+		}
+		s.window = now
+		s.thisSecond = 0
+		s.kept = 0
+	}
+	s.thisSecond++
+
+	// Never go over the cap even when traffic suddenly picks up
+	if s.kept >= sampleRate {
+		return false
+	}
+	if s.lastSecond > sampleRate && rand.Float64() >= float64(sampleRate)/float64(s.lastSecond) {
+		return false
+	}
+	s.kept++
+	return true
+}
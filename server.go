@@ -2,208 +2,523 @@
 package main
 
 import (
-	"bufio"
-	"encoding/binary"
-	"fmt"
+	"context"
+	"errors"
+	"expvar"
+	"flag"
 	"log"
-	"math"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"regexp"
-	"strings"
-	"sync"
+	"strconv"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/Spud304/MirrorMap/internal/parse"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"github.com/oschwald/geoip2-golang"
 	"github.com/thanhpk/randstr"
 )
 
-// Globals
-var clients map[string]chan []byte
-var clients_lock sync.RWMutex
-var reQuotes *regexp.Regexp
-
-var upgrader = websocket.Upgrader{} // use default options
+var upgrader = websocket.Upgrader{
+	// permessage-deflate for clients that offer it, unless WS_COMPRESSION is off
+	EnableCompression: envBool("WS_COMPRESSION", true),
+	Subprotocols:      []string{debugSubprotocol},
+	CheckOrigin:       checkOrigin,
+}
 
-func InitRegex() (err error) {
-	reQuotes, err = regexp.Compile(`"(.*?)"`)
-	if err != nil {
-		return err
-	}
+// Messages smaller than this aren't worth compressing, deflate would only
+// make a 17 byte legacy message bigger
+const compressMin = 128
+
+// writeMessage sends msg to conn, compressing it if it's big enough and the
+// client negotiated compression. It fails if it takes longer than
+// WRITE_TIMEOUT.
+func writeMessage(conn *websocket.Conn, msgType int, msg []byte) error {
+	conn.EnableWriteCompression(len(msg) >= compressMin)
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return conn.WriteMessage(msgType, msg)
+}
 
-	return nil
+// message is something queued for a client. Events broadcast to websockets
+// also come prepared, framed once for every client they go to.
+type message struct {
+	data     []byte
+	prepared *websocket.PreparedMessage
+	// The Seq of the event, for server-sent events
+	seq uint32
 }
 
-func fileIn(clients map[string]chan []byte) {
-	db, err := geoip2.Open("GeoLite2-City.mmdb")
-	if err != nil {
-		fmt.Println(err)
-		return
+// writeQueued sends m to conn like writeMessage, using the prepared frame
+// when there is one
+func writeQueued(conn *websocket.Conn, format string, m message) error {
+	if m.prepared == nil {
+		return writeMessage(conn, messageType(format), m.data)
 	}
+	conn.EnableWriteCompression(len(m.data) >= compressMin)
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return conn.WritePreparedMessage(m.prepared)
+}
 
-	// Create a map of dists and give them an id, hashing a map is quicker than an array
-	distList := []string{"almalinux", "alpine", "archlinux", "archlinux32", "artix-linux", "blender", "centos", "clonezilla", "cpan", "cran", "ctan", "cygwin", "debian", "debian-cd", "eclipse", "freebsd", "gentoo", "gentoo-portage", "gparted", "ipfire", "isabelle", "linux", "linuxmint", "manjaro", "msys2", "odroid", "openbsd", "opensuse", "parrot", "raspbian", "RebornOS", "ros", "sabayon", "serenity", "slackware", "slitaz", "tdf", "templeos", "ubuntu", "ubuntu-cdimage", "ubuntu-ports", "ubuntu-releases", "videolan", "voidlinux", "zorinos"}
-	distMap := make(map[string]int)
-	for i, dist := range distList {
-		distMap[dist] = i
+// messageType is the kind of websocket message format is sent in
+func messageType(format string) int {
+	if messageFormats[format].text {
+		return websocket.TextMessage
 	}
+	return websocket.BinaryMessage
+}
 
-	// Track the previous IP to avoid sending duplicate data
-	prevSkip := false
-	prevIp := ""
-	scanner := bufio.NewScanner(os.Stdin)
-	// Iterate through stdin
-	for scanner.Scan() {
-		if reQuotes == nil {
-			InitRegex()
-		}
-		// If there are no connected clients skip the line
-		clients_lock.RLock()
-		skip := len(clients) == 0
-		clients_lock.RUnlock()
-
-		if prevSkip != skip {
-			prevSkip = skip
-			if skip {
-				log.Println("All clients disconnected, skipping...")
-			} else {
-				log.Println("A new client connected, no longer skipping")
-			}
-		}
+// client is a registered websocket client
+type client struct {
+	ch     chan message
+	format string
+	// Messages start with the magic and version bytes
+	framed bool
+	// Framed messages have a two byte distro id
+	wide bool
+	// Events are sent in batches, see writeBatches
+	batch bool
+	// Control messages are sent along with events, see sendControl
+	control bool
+	// What formatFields messages have in them
+	fields parse.FieldMask
+	// Gets counts on a grid instead of events, see runGrid
+	aggregate bool
+	// Which events to send, nil for all of them
+	filter *clientFilter
+	// Most events a second to send, nil for no limit
+	throttle *throttle
+	// Events held back by throttle
+	throttled atomic.Uint64
+	// Sent nothing but control messages while paused, see hold
+	paused bool
+	held   []message
+	// When it registered, zero for clients that are connected as they're
+	// added, and whether it's connected a websocket or polled since. See
+	// expireRegistrations.
+	created  time.Time
+	attached bool
+	// The websocket sending to it, nil while there isn't one, and whether
+	// it's being kept after that closed. gen counts connections. See release.
+	conn     *websocket.Conn
+	detached bool
+	gen      uint64
+	// Events kept for a client that polls instead of reading a websocket,
+	// nil until it first polls
+	poll *pollBuffer
+	// Events that didn't fit in ch
+	dropped atomic.Uint64
+	// Drops in a row and since windowStart, and whether it was removed for
+	// them, see send
+	streak      int
+	windowStart time.Time
+	windowDrops int
+	evicted     bool
+	// Registered with shared=true, with this many connections now and next
+	// numbering them. Connections have the client they're to as parent. See
+	// share.
+	shared   bool
+	children int
+	next     int
+	parent   *client
+	// How far back to send events from when it connects, see writeBackfill
+	backfill time.Duration
+}
 
-		if skip {
-			continue
-		}
+// key names the messages the client is sent, clients with the same key get
+// the same bytes
+func (c *client) key() string {
+	switch {
+	case c.format == formatFields:
+		return c.format + "+" + strconv.FormatUint(uint64(c.fields), 10)
+	case c.wide:
+		return c.format + "+wide"
+	case c.framed:
+		return c.format + "+framed"
+	}
+	return c.format
+}
 
-		line := scanner.Text()
+// encode builds the message for ev the way the client wants it
+func (c *client) encode(ev event) []byte {
+	return c.encodeAs(ev, c.format)
+}
 
-		// Parse the ip
-		quoteList := reQuotes.FindAllString(line, -1)
-		ip := quoteList[0]
+// encodeAs builds the message for ev in format with the client's other
+// options, for when the format was read under the hub's lock
+func (c *client) encodeAs(ev event, format string) []byte {
+	if format == formatFields {
+		return parse.EncodeMasked(ev, c.fields)
+	}
+	if c.framed {
+		return messageFormats[format].frame(ev, c.wide)
+	}
+	return encodeEvent(ev, format)
+}
 
-		if ip == prevIp {
-			// if the ips are the same skip the line
-			continue
-		}
+// The Seq of the next event broadcast
+var nextSeq atomic.Uint32
 
-		if ip == "" {
-			continue
-		}
+func socketHandler(w http.ResponseWriter, r *http.Request) {
+	// Handles the websocket
+	vars := mux.Vars(r)
+	id := vars["id"]
+	if !limit(w, r, upgradeLimiter, upgradeRateLimited) {
+		return
+	}
+	if !requireSocketAuth(w, r, id) {
+		return
+	}
+
+	// get the channel, before upgrading so a bad id doesn't leave a
+	// connection waiting on nothing
+	c, ok := hub.Lookup(id)
+	if !ok {
+		unknownID(w, id)
+		return
+	}
+	connectSocket(w, r, id, c, nil)
+}
 
-		// Check the validity of the ip
-		ipNew := net.ParseIP(strings.TrimSpace(ip))
-		results, err := db.City(ipNew)
+// newSocketHandler registers a client and connects its websocket in one go,
+// taking the same options as registerHandler. The id is sent back in the
+// X-Client-Id header.
+func newSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !limit(w, r, registerLimiter, registerRateLimited) || !limit(w, r, upgradeLimiter, upgradeRateLimited) {
+		return
+	}
+	if !requireSocketAuth(w, r, "") {
+		return
+	}
+	// Browsers can't see why an upgrade failed, so they're told with a close
+	// message instead
+	if hub.Full() {
+		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			fmt.Println(err)
 			return
 		}
+		writeClose(conn, websocket.CloseTryAgainLater, errTooManyClients.Error())
+		conn.Close()
+		return
+	}
 
-		listDistro := quoteList[2]
-		// use a regular expression to extra the distro
-		if len(listDistro) < 2 {
-			continue
-		}
-
-		// do some formating to distro to make it so I can hash it
-		distro := strings.Replace(listDistro, "/", "", -1)
-
-		long := results.Location.Longitude
-		lat := results.Location.Latitude
-
-		// convert lat to string
-		distByte := byte(distMap[distro])
-
-		// convert lat to little endian Uint8 array
-		var latByte [8]byte
-		binary.LittleEndian.PutUint64(latByte[:], math.Float64bits(lat))
-
-		// convert long to little endian Uint8 array
-		var longByte [8]byte
-		binary.LittleEndian.PutUint64(longByte[:], math.Float64bits(long))
-
-		// turn dist, lat, and long to byte array to send
-		msg := []byte{distByte}
-		msg = append(msg, latByte[:]...)
-		msg = append(msg, longByte[:]...)
-
-		clients_lock.Lock()
-		// send the message to each client
-		for _, ch := range clients {
-			select {
-			case ch <- msg:
-			default:
-				// if the client is blocking we skip it
-			}
-		}
-		clients_lock.Unlock()
+	id, c, ok := register(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("X-Client-Id", id)
+	if !connectSocket(w, r, id, c, w.Header()) {
+		// Nothing else will use the id
+		hub.Unregister(id, c)
 	}
 }
 
-func socketHandler(w http.ResponseWriter, r *http.Request) {
-	// Handles the websocket
-	vars := mux.Vars(r)
-	id := vars["id"]
-
-	if id == "" {
-		w.WriteHeader(404)
-		return
+// connectSocket serves a websocket connecting to client id. A shared client
+// gets a new connection each time, see share. It returns false if the
+// connection never got upgraded.
+func connectSocket(w http.ResponseWriter, r *http.Request, id string, c *client, header http.Header) bool {
+	if !c.shared {
+		return serveSocket(w, r, id, c, header)
 	}
+	connID, conn, err := hub.share(id, c)
+	switch err {
+	case nil:
+	case errClientRemoved:
+		unknownID(w, id)
+		return false
+	default:
+		refuseClient(w, err)
+		return false
+	}
+	if !serveSocket(w, r, connID, conn, header) {
+		hub.release(connID, conn, nil)
+		return false
+	}
+	return true
+}
 
-	// get the channel
-	ch := clients[id]
+// serveSocket upgrades the request and sends client id everything for it,
+// with header added to the upgrade response. It returns false if the
+// connection never got upgraded.
+func serveSocket(w http.ResponseWriter, r *http.Request, id string, c *client, header http.Header) bool {
+	// The format can also be picked when connecting
+	format := r.URL.Query().Get("format")
+	for _, p := range websocket.Subprotocols(r) {
+		if p == debugSubprotocol {
+			format = formatText
+		}
+	}
+	// So can how far back to backfill, reconnecting clients may want less
+	backfill := c.backfill
+	if r.URL.Query().Has("backfill") {
+		var err error
+		if backfill, err = parseBackfill(r.URL.Query().Get("backfill")); err != nil {
+			http.Error(w, err.Error(), 400)
+			return false
+		}
+		if backfill > 0 && (!c.control || c.aggregate) {
+			http.Error(w, "backfill needs control=true and can't be used with aggregate", 400)
+			return false
+		}
+	}
+	var err error
+	hub.Update(func() { format, err = switchFormat(c, format) })
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return false
+	}
 
 	log.Printf("%s connected!\n", id)
 
 	// Upgrade our raw HTTP connection to a websocket based one
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Print("Error during connection upgradation:", err)
-		return
+		return false
 	}
-
-	for {
-		// Reciever byte array
-		val := <-ch
-		// Send message across websocket
-		err = conn.WriteMessage(2, val)
-		if err != nil {
-			break
+	openSockets.Add(1)
+	defer openSockets.Done()
+
+	var old *websocket.Conn
+	var past []event
+	hub.Update(func() {
+		old = c.attach(conn)
+		if backfill > 0 {
+			past = backfillFor(c.filter, time.Now().Add(-backfill))
+			// Whatever was waiting is in the backfill if it's recent enough
+			for len(c.ch) > 0 {
+				<-c.ch
+			}
 		}
+	})
+	if old != nil {
+		replace(old)
+	}
+
+	k := newKeepalive(conn, id, c)
+	defer k.stop()
+	if c.control {
+		// Counts so far before anything else
+		err = writeControl(conn, c, format, controlSync, snapshot(time.Now()))
+	}
+	if err == nil && backfill > 0 {
+		err = writeBackfill(conn, c, format, past)
+	}
+	switch {
+	case err != nil:
+		// The sync message didn't make it, nothing else will
+	case c.batch:
+		err = writeBatches(conn, c, format, k)
+	default:
+		err = writeEvents(conn, c, format, k)
 	}
 
 	// Close connection gracefully
+	if err == errClientRemoved {
+		var evicted bool
+		hub.Update(func() { evicted = c.evicted })
+		switch {
+		case hub.ShuttingDown():
+			writeClose(conn, websocket.CloseGoingAway, "server shutting down")
+		case evicted:
+			writeClose(conn, websocket.CloseTryAgainLater, "too slow")
+		}
+	}
 	conn.Close()
-	clients_lock.Lock()
-	log.Printf("Error sending message %s : %s", id, err)
-	delete(clients, id)
-	clients_lock.Unlock()
+	switch {
+	case hub.release(id, c, conn):
+		log.Printf("%s reconnected, closed its old connection", id)
+	case err == errPeerClosed || err == errClientRemoved:
+		log.Printf("%s disconnected", id)
+	case timedOut(err):
+		log.Printf("%s stopped reading, disconnected it", id)
+	default:
+		log.Printf("Error sending message %s : %s", id, err)
+	}
+	return true
+}
+
+// switchFormat changes the format c is sent to format, unless it's "", and
+// returns the one it's sent in now. Called with the hub's lock held, another
+// connection for the same id could be changing it.
+func switchFormat(c *client, format string) (string, error) {
+	if format == "" {
+		return c.format, nil
+	}
+	f, ok := messageFormats[format]
+	if !ok {
+		return "", errors.New("unknown format")
+	}
+	if c.framed && f.frame == nil {
+		return "", errors.New("format can't be framed")
+	}
+	if c.control && !c.framed && !f.text {
+		return "", errors.New("control messages need json or framed=true")
+	}
+	if c.format != format {
+		c.format = format
+		// Anything already waiting was encoded the old way
+		for len(c.ch) > 0 {
+			<-c.ch
+		}
+	}
+	return format, nil
+}
+
+// writeEvents sends everything for c to conn in the given format until a
+// write fails or the client goes
+func writeEvents(conn *websocket.Conn, c *client, format string, k *keepalive) error {
+	idle := newIdleTimer(c)
+	for {
+		var err error
+		select {
+		case m, ok := <-c.ch:
+			if !ok {
+				return errClientRemoved
+			}
+			// Send message across websocket
+			err = writeQueued(conn, format, m)
+		case <-idle.C():
+			err = writeHeartbeat(conn, c, format)
+		case <-k.C():
+			err = k.ping()
+		case <-k.Dead():
+			return k.Err()
+		}
+		if err != nil {
+			return err
+		}
+		idle.reset()
+	}
 }
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
+	if !limit(w, r, registerLimiter, registerRateLimited) {
+		return
+	}
+	if !requireAuth(w, r, "") {
+		return
+	}
+	id, _, ok := register(w, r)
+	if !ok {
+		return
+	}
+	w.WriteHeader(200)
+	w.Write([]byte(id))
+}
+
+// register adds a client with the options in r, or answers with what's wrong
+// with them and returns false. Headers saying what the client's messages have
+// in them are set on w.
+func register(w http.ResponseWriter, r *http.Request) (string, *client, bool) {
 	// Create UUID but badly
 	// Should work as we arent serving enough clients were psuedo random will mess us up
 	id := randstr.Hex(16)
 
-	clients_lock.Lock()
-	clients[id] = make(chan []byte, 10)
-	clients_lock.Unlock()
+	// Clients that don't ask for anything get the original 17 byte messages
+	format := r.URL.Query().Get("format")
+
+	// fields= asks for only the fields listed, by name or as a bitmask
+	var mask parse.FieldMask
+	if s := r.URL.Query().Get("fields"); s != "" {
+		if format != "" && format != formatFields {
+			http.Error(w, "fields can't be used with another format", 400)
+			return "", nil, false
+		}
+		var err error
+		if mask, err = parse.ParseFieldMask(s); err != nil {
+			http.Error(w, err.Error(), 400)
+			return "", nil, false
+		}
+		format = formatFields
+	}
+	if format == "" {
+		format = formatLegacy
+	}
+	f, ok := messageFormats[format]
+	if !ok {
+		http.Error(w, "unknown format", 400)
+		return "", nil, false
+	}
+	// framed=true asks for the magic and version bytes in front of each message
+	framed, _ := strconv.ParseBool(r.URL.Query().Get("framed"))
+	if framed && f.frame == nil {
+		http.Error(w, "format can't be framed", 400)
+		return "", nil, false
+	}
+
+	// wide=true asks for distro ids that don't fit in a byte, which only
+	// framed messages have room to say
+	wide, _ := strconv.ParseBool(r.URL.Query().Get("wide"))
+	if wide && !framed {
+		http.Error(w, "wide needs framed=true", 400)
+		return "", nil, false
+	}
+
+	// control=true asks for control messages, which have to be told apart
+	// from events
+	control, _ := strconv.ParseBool(r.URL.Query().Get("control"))
+	if control && !framed && !f.text {
+		http.Error(w, "control messages need json or framed=true", 400)
+		return "", nil, false
+	}
+
+	// aggregate=true asks for counts on a grid instead of events, in JSON
+	// for json clients and binary for everyone else
+	aggregate, _ := strconv.ParseBool(r.URL.Query().Get("aggregate"))
+	if aggregate && (framed || format == formatFields || r.URL.Query().Has("batch")) {
+		http.Error(w, "aggregate can't be used with framed, fields or batch", 400)
+		return "", nil, false
+	}
+
+	filter, throttle, err := parseSelection(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return "", nil, false
+	}
+
+	// backfill=60 asks for the last minute of events when connecting, which
+	// only clients that get control messages can tell apart from live ones
+	backfill, err := parseBackfill(r.URL.Query().Get("backfill"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return "", nil, false
+	}
+	if backfill > 0 && (!control || aggregate) {
+		http.Error(w, "backfill needs control=true and can't be used with aggregate", 400)
+		return "", nil, false
+	}
+
+	// shared=true lets more than one websocket connect with the id at once,
+	// each sent every event
+	shared, _ := strconv.ParseBool(r.URL.Query().Get("shared"))
+
+	// batch=true asks for events in batches, which need more room to queue up
+	batch, _ := strconv.ParseBool(r.URL.Query().Get("batch"))
+	queue := clientBuffer
+	if batch {
+		queue = max(queue, 2*batchMax)
+	}
+
+	c := &client{ch: make(chan message, queue), format: format, framed: framed, wide: wide, batch: batch, control: control, fields: mask, aggregate: aggregate, filter: filter, throttle: throttle, shared: shared, backfill: backfill, created: time.Now()}
+	if err := hub.Register(id, c); err != nil {
+		refuseClient(w, err)
+		return "", nil, false
+	}
 	log.Printf("new connection registered: %s\n", id)
 
-	// Send id to client
-	w.WriteHeader(200)
-	w.Write([]byte(id))
-}
+	// Browsers pass this when connecting instead of a token
+	if authRequired() {
+		w.Header().Set("X-Ticket", newTicket(id))
+	}
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	// Send diagnostic information
-	clients_lock.RLock()
-	w.WriteHeader(200)
-	w.Write([]byte(fmt.Sprint(len(clients))))
-	clients_lock.RUnlock()
+	// What its messages will have in them
+	if format == formatFields {
+		w.Header().Set("X-Fields", mask.String())
+		w.Header().Set("X-Field-Mask", strconv.FormatUint(uint64(mask), 10))
+	}
+	return id, c, true
 }
 
 type HTMLStrippingFileSystem struct {
@@ -225,27 +540,147 @@ func main() {
 	// 	log.Fatal("Error loading .env file")
 	// }
 
-	// Create a type safe Map for strings to channels
-	clients = make(map[string]chan []byte)
+	flag.Parse()
 
-	interrupt := make(chan os.Signal) // Channel to listen for interrupt signal to terminate gracefully
-	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	// Fail early on a log format that can't work
+	if err := initParser(); err != nil {
+		log.Fatalf("Error in log format: %s", err)
+	}
+	if err := initIPExtract(); err != nil {
+		log.Fatalf("Error in IP_EXTRACT: %s", err)
+	}
+	if err := initFilters(); err != nil {
+		log.Fatalf("Error in filters: %s", err)
+	}
+	if err := initOverrides(); err != nil {
+		log.Fatalf("Error in GEOIP_OVERRIDES: %s", err)
+	}
+	if err := initDistros(); err != nil {
+		log.Fatalf("Error loading distros: %s", err)
+	}
+	go reloadOnHangup()
+	if err := initAgentRules(); err != nil {
+		log.Fatalf("Error in user agent classes: %s", err)
+	}
+	if err := initKindRules(); err != nil {
+		log.Fatalf("Error in event kind rules: %s", err)
+	}
+	if err := initBatch(); err != nil {
+		log.Fatalf("Error in batch settings: %s", err)
+	}
+	if err := initSync(); err != nil {
+		log.Fatalf("Error in sync settings: %s", err)
+	}
+	if err := initGrid(); err != nil {
+		log.Fatalf("Error in grid settings: %s", err)
+	}
+	if err := initPoll(); err != nil {
+		log.Fatalf("Error in poll settings: %s", err)
+	}
+	if err := initKeepalive(); err != nil {
+		log.Fatalf("Error in keepalive settings: %s", err)
+	}
+	if err := initEvict(); err != nil {
+		log.Fatalf("Error in client buffer settings: %s", err)
+	}
+	if err := initHistory(); err != nil {
+		log.Fatalf("Error in history settings: %s", err)
+	}
+	if err := initOrigins(); err != nil {
+		log.Fatalf("Error in allowed origins: %s", err)
+	}
+	if err := initAuth(); err != nil {
+		log.Fatalf("Error loading client tokens: %s", err)
+	}
+	if err := initRateLimits(); err != nil {
+		log.Fatalf("Error in rate limit settings: %s", err)
+	}
 
-	go func() {
-		<-interrupt
-		fmt.Println("\r- Ctrl+C pressed in Terminal")
-		os.Exit(1)
-	}()
+	if validatePath != "" {
+		// Check the log format and exit without serving anything
+		os.Exit(runValidate())
+	}
 
-	// Read from standard in and pass cordinates to each client
-	go fileIn(clients)
+	// Counts events for aggregate clients
+	go runGrid()
+	go expirePolls()
+	go expireRegistrations()
+
+	if demoEnabled() {
+		if err := checkDemoExclusive(); err != nil {
+			log.Fatalf("%s", err)
+		}
+		// Make up events instead of reading real ones
+		go demoIn()
+	} else if upstreamURL != "" {
+		// Relay another instance instead of parsing logs
+		go upstreamIn()
+	} else {
+		// Pick where log lines come from, stdin unless INPUT_SOURCE says otherwise
+		src, err := newInputSource()
+		if err != nil {
+			log.Fatalf("Error creating input source: %s", err)
+		}
+
+		if err := initQueue(); err != nil {
+			log.Fatalf("Error in ingest queue: %s", err)
+		}
+
+		go func() {
+			if maxmindLicenseKey != "" {
+				// Wait for a database if we have to download one first
+				ensureGeoDB()
+				go refreshGeoDB()
+			}
+
+			// Open the GeoIP database
+			if err := initIngest(); err != nil {
+				log.Printf("Error starting ingest: %s", err)
+				setIngestState("dead", err)
+				return
+			}
+			// Read from the input source and pass cordinates to each client
+			fileIn(src)
+		}()
+
+		if grpcIngestAddr != "" {
+			if err := startGRPCIngest(); err != nil {
+				log.Fatalf("Error starting gRPC ingest: %s", err)
+			}
+		}
+	}
+
+	if mqttURL != "" {
+		if err := initMQTT(); err != nil {
+			log.Fatalf("Error in MQTT settings: %s", err)
+		}
+	}
+	if grpcSubscribeAddr != "" {
+		if err := startGRPCSubscribe(); err != nil {
+			log.Fatalf("Error starting gRPC events: %s", err)
+		}
+	}
 
 	// gorilla/mux router
 	r := mux.NewRouter()
 
 	r.HandleFunc("/map/health", healthHandler)
+	r.Handle("/map/stats", expvar.Handler())
+	r.HandleFunc("/map/distros", distrosHandler)
+	r.HandleFunc("/map/event.proto", protoHandler)
 	r.HandleFunc("/map/register", registerHandler)
+	r.HandleFunc("/map/socket", newSocketHandler)
 	r.HandleFunc("/map/socket/{id}", socketHandler)
+	r.HandleFunc("/map/events", sseHandler)
+	r.HandleFunc("/map/poll/{id}", pollHandler)
+	r.HandleFunc("/map/ticket", ticketHandler)
+	if adminSecret != "" {
+		r.HandleFunc("/map/admin/clients", adminAuth(adminClientsHandler))
+		r.HandleFunc("/map/admin/max_clients", adminAuth(adminMaxClientsHandler))
+	}
+	if ingestSecret != "" {
+		r.HandleFunc("/map/ingest", ingestHandler).Methods("POST")
+	}
 	r.PathPrefix("/map").Handler(http.StripPrefix("/map", http.FileServer(http.Dir("static"))))
 
 	r.Use(loggingMiddleware)
@@ -256,6 +691,17 @@ func main() {
 		Handler: r,
 	}
 
-	log.Printf("Serving on http://localhost:%d/map", 8000)
-	log.Fatalf("%s", l.ListenAndServe())
+	// Ctrl+C or SIGTERM shut down gracefully, a second one stops straight away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		log.Printf("Serving on http://localhost:%d/map", 8000)
+		if err := l.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("%s", err)
+		}
+	}()
+	<-ctx.Done()
+	stop()
+
+	log.Println("Shutting down")
+	shutdown(l)
 }
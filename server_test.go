@@ -0,0 +1,316 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/thanhpk/randstr"
+)
+
+// noReconnectGrace removes clients as soon as their socket closes until the
+// end of the test
+func noReconnectGrace(t *testing.T) {
+	old := reconnectGrace
+	reconnectGrace = 0
+	t.Cleanup(func() { reconnectGrace = old })
+}
+
+// waitFor fails the test unless cond is true within 5 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// Registering, connecting, unregistering and broadcasting all at once, for
+// the race detector
+func TestConcurrentSockets(t *testing.T) {
+	noReconnectGrace(t)
+	url := socketServer(t)
+	before := hub.Len()
+	reg := func() (string, *client) {
+		w := httptest.NewRecorder()
+		id, c, ok := register(w, httptest.NewRequest("POST", "/register", nil))
+		if !ok {
+			t.Errorf("registering got %d", w.Code)
+		}
+		return id, c
+	}
+
+	stop := make(chan struct{})
+	broadcasting := make(chan struct{})
+	go func() {
+		defer close(broadcasting)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				hub.Broadcast(event{Distro: 1, Lat: 1, Long: 1, Time: time.Now()})
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		// Connects, reads an event and goes
+		go func() {
+			defer wg.Done()
+			id, _ := reg()
+			conn, _, err := websocket.DefaultDialer.Dial(url+"/"+id, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, _, err := conn.ReadMessage(); err != nil {
+				t.Error(err)
+			}
+		}()
+		// Unregistered before connecting
+		go func() {
+			defer wg.Done()
+			id, c := reg()
+			hub.Unregister(id, c)
+			_, resp, err := websocket.DefaultDialer.Dial(url+"/"+id, nil)
+			if err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+				t.Errorf("connecting after unregistering got %v", err)
+			}
+		}()
+		// Unregistered while connected
+		go func() {
+			defer wg.Done()
+			id, c := reg()
+			conn, _, err := websocket.DefaultDialer.Dial(url+"/"+id, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			hub.Unregister(id, c)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					// Closed by the server, not still open at the deadline
+					if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						t.Error("socket kept open after unregistering")
+					}
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-broadcasting
+
+	waitFor(t, "clients to be removed", func() bool { return hub.Len() == before })
+}
+
+// Only the connection a client has now removes it when it closes
+func TestNewerConnectionKeepsClient(t *testing.T) {
+	noReconnectGrace(t)
+	url := socketServer(t)
+	id, c := registerID(t, "")
+
+	older, _, err := websocket.DefaultDialer.Dial(url+"/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer older.Close()
+	waitFor(t, "the first connection", func() bool {
+		var conn *websocket.Conn
+		hub.Update(func() { conn = c.conn })
+		return conn != nil
+	})
+	newer, _, err := websocket.DefaultDialer.Dial(url+"/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newer.Close()
+
+	older.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = older.ReadMessage()
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.CloseNormalClosure {
+		t.Fatalf("older connection ended with %v", err)
+	}
+	if got, ok := hub.Lookup(id); !ok || got != c {
+		t.Fatal("client went with its older connection")
+	}
+
+	hub.Broadcast(event{Distro: 1, Lat: 1, Long: 1, Time: time.Now()})
+	newer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := newer.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	newer.Close()
+	waitFor(t, "the client to be removed", func() bool {
+		_, ok := hub.Lookup(id)
+		return !ok
+	})
+}
+
+// Unknown ids are turned away before upgrading, leaving nothing running
+func TestUnknownSocketID(t *testing.T) {
+	url := socketServer(t)
+	expiredIDs_lock.Lock()
+	expiredIDs["expiredid"] = time.Now()
+	expiredIDs_lock.Unlock()
+	t.Cleanup(func() {
+		expiredIDs_lock.Lock()
+		delete(expiredIDs, "expiredid")
+		expiredIDs_lock.Unlock()
+	})
+
+	// Settled after the server starts
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		_, resp, err := websocket.DefaultDialer.Dial(url+"/"+randstr.Hex(16), nil)
+		if err != websocket.ErrBadHandshake || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("random id got %v", err)
+		}
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(url+"/expiredid", nil)
+	if err != websocket.ErrBadHandshake || resp.StatusCode != http.StatusGone {
+		t.Fatalf("expired id got %v", err)
+	}
+
+	waitFor(t, "goroutines to finish", func() bool { return runtime.NumGoroutine() <= before })
+}
+
+// useShutdown undoes shutdown at the end of the test
+func useShutdown(t *testing.T) {
+	status := ingestStatus.Load()
+	t.Cleanup(func() {
+		hub.Update(func() { hub.shuttingDown = false })
+		ingestSource_lock.Lock()
+		ingestSource, ingestStopped = nil, nil
+		ingestSource_lock.Unlock()
+		if status == nil {
+			status = ingestState{}
+		}
+		ingestStatus.Store(status)
+	})
+}
+
+// Shutting down sends every socket a close message after what was read, stops
+// reading and frees the port
+func TestShutdownClosesSockets(t *testing.T) {
+	useShutdown(t)
+	useTestDB(t, testNetwork{"198.18.0.0/15", cityRecord(52.5, 13.4, "DE", "Berlin")})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/map/socket/{id}", socketHandler)
+	srv := &http.Server{Handler: r}
+	go srv.Serve(l)
+	url := "ws://" + l.Addr().String() + "/map/socket"
+
+	var conns []*websocket.Conn
+	for _, query := range []string{"", "format=json", "batch=true", "framed=true&control=true"} {
+		conn, _ := dialClient(t, url, query)
+		conns = append(conns, conn)
+	}
+
+	pr, pw := io.Pipe()
+	src := newReaderSource(pr)
+	ingested := make(chan struct{})
+	go func() {
+		fileIn(src)
+		close(ingested)
+	}()
+	// Read and broadcast, but still waiting to go out in a batch
+	observer := registerClient(t, "")
+	if _, err := io.WriteString(pw, logLine(testIP(), "/debian/pool/a.deb", "200", 1)+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-observer.ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("line wasn't sent")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		shutdown(srv)
+		close(done)
+	}()
+
+	for i, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		events := 0
+		for {
+			_, _, err := conn.ReadMessage()
+			if err == nil {
+				events++
+				continue
+			}
+			ce, ok := err.(*websocket.CloseError)
+			if !ok || ce.Code != websocket.CloseGoingAway || ce.Text != "server shutting down" {
+				t.Errorf("socket %d ended with %v", i, err)
+			}
+			break
+		}
+		if events == 0 {
+			t.Errorf("socket %d got nothing before closing", i)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't finish")
+	}
+	select {
+	case <-ingested:
+	case <-time.After(time.Second):
+		t.Error("still reading after shutting down")
+	}
+	if _, _, ok := register(httptest.NewRecorder(), httptest.NewRequest("POST", "/register", nil)); ok {
+		t.Error("registered while shutting down")
+	}
+	again, err := net.Listen("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("port still in use: %s", err)
+	}
+	again.Close()
+}
+
+// backfill comes from the query like every other option, not the form body
+func TestBackfillFromQuery(t *testing.T) {
+	c := registerClient(t, "format=json&control=true&backfill=60")
+	if c.backfill != time.Minute {
+		t.Errorf("backfill=60 in the query gave %s", c.backfill)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/register?format=json&control=true", strings.NewReader("backfill=60"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	id, c, ok := register(w, r)
+	if !ok {
+		t.Fatalf("registering got %d %s", w.Code, w.Body)
+	}
+	defer hub.Unregister(id, c)
+	if c.backfill != 0 {
+		t.Errorf("backfill=60 in the form body gave %s", c.backfill)
+	}
+}
@@ -0,0 +1,58 @@
+// shared.go
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A client registered with shared=true can have any number of websockets
+// connected to its id at once, say a kiosk config on more than one screen.
+// Each connection is a copy of it under id/n with a buffer of its own, so a
+// slow screen only misses events itself. The shared client only holds the
+// options and isn't sent anything. Without shared the newest connection
+// takes over, see attach.
+
+// share adds a connection to shared client id, returning the id and client
+// it's sent events as
+func (h *Hub) share(id string, c *client) (string, *client, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.shuttingDown {
+		return "", nil, errShuttingDown
+	}
+	if h.clients[id] != c {
+		return "", nil, errClientRemoved
+	}
+	if h.full() {
+		return "", nil, errTooManyClients
+	}
+
+	var t *throttle
+	if c.throttle != nil {
+		t = newThrottle(c.throttle.rate)
+	}
+	conn := &client{ch: make(chan message, cap(c.ch)), format: c.format, framed: c.framed, wide: c.wide, batch: c.batch, control: c.control, fields: c.fields, aggregate: c.aggregate, filter: c.filter, throttle: t, backfill: c.backfill, attached: true, parent: c}
+	c.next++
+	connID := id + "/" + strconv.Itoa(c.next)
+	h.clients[connID] = conn
+	c.children++
+	c.attached = true
+	// Cancels forgetting it, see keep
+	c.detached = false
+	c.gen++
+	return connID, conn, nil
+}
+
+// unshare forgets connection id of a shared client. Once the last one has
+// gone the shared client is kept like any other, see keep. Called with the
+// lock held for writing.
+func (h *Hub) unshare(id string, c *client) {
+	h.remove(id, c)
+	p := c.parent
+	p.children--
+	parentID := id[:strings.LastIndexByte(id, '/')]
+	if p.children == 0 && h.clients[parentID] == p {
+		h.keep(parentID, p)
+	}
+}
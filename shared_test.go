@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Two screens on one shared id, either going first, neither taking the other's
+// events or its registration
+func TestSharedConnectConnectDisconnect(t *testing.T) {
+	noReconnectGrace(t)
+	url := socketServer(t)
+
+	for _, firstGoes := range []bool{true, false} {
+		id, shared := registerID(t, "shared=true&format=json")
+		dial := func() *websocket.Conn {
+			conn, _, err := websocket.DefaultDialer.Dial(url+"/"+id, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		}
+		children := func() int {
+			var n int
+			hub.Update(func() { n = shared.children })
+			return n
+		}
+		first := dial()
+		waitFor(t, "the first connection", func() bool { return children() == 1 })
+		second := dial()
+		waitFor(t, "the second connection", func() bool { return children() == 2 })
+
+		hub.Broadcast(event{Distro: 1, Lat: 1, Long: 1, Time: time.Now()})
+		seq := nextSeq.Load() - 1
+		for i, conn := range []*websocket.Conn{first, second} {
+			if got := readSeq(t, conn); got != seq {
+				t.Errorf("connection %d got %d, want %d", i+1, got, seq)
+			}
+		}
+
+		gone, stays := first, second
+		if !firstGoes {
+			gone, stays = second, first
+		}
+		gone.Close()
+		waitFor(t, "a connection to go", func() bool { return children() == 1 })
+		if c, ok := hub.Lookup(id); !ok || c != shared {
+			t.Fatal("shared id went with one of its connections")
+		}
+		hub.Broadcast(event{Distro: 1, Lat: 1, Long: 1, Time: time.Now()})
+		if got, want := readSeq(t, stays), nextSeq.Load()-1; got != want {
+			t.Errorf("remaining connection got %d, want %d", got, want)
+		}
+
+		stays.Close()
+		waitFor(t, "the shared id to go with its last connection", func() bool {
+			_, ok := hub.Lookup(id)
+			return !ok
+		})
+	}
+}
+
+// Connections come and go while the shared id is kept for reconnecting
+func TestSharedReconnect(t *testing.T) {
+	old := reconnectGrace
+	reconnectGrace = time.Minute
+	t.Cleanup(func() { reconnectGrace = old })
+	url := socketServer(t)
+	id, shared := registerID(t, "shared=true&format=json")
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "connecting", func() bool {
+		var n int
+		hub.Update(func() { n = shared.children })
+		return n == 1
+	})
+	conn.Close()
+	waitFor(t, "disconnecting", func() bool {
+		var detached bool
+		hub.Update(func() { detached = shared.detached })
+		return detached
+	})
+
+	conn, _, err = websocket.DefaultDialer.Dial(url+"/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	hub.Broadcast(event{Distro: 1, Lat: 1, Long: 1, Time: time.Now()})
+	if got, want := readSeq(t, conn), nextSeq.Load()-1; got != want {
+		t.Errorf("reconnected screen got %d, want %d", got, want)
+	}
+	var detached bool
+	hub.Update(func() { detached = shared.detached })
+	if detached {
+		t.Error("still set to be forgotten after reconnecting")
+	}
+}
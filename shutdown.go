@@ -0,0 +1,93 @@
+// shutdown.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// How long SIGINT or SIGTERM waits for lines already read to be sent and for
+// clients to be told before giving up on them
+var shutdownTimeout = envDuration("SHUTDOWN_TIMEOUT", 10*time.Second)
+
+// Websockets still being written to
+var openSockets sync.WaitGroup
+
+// The input source fileIn is reading and a channel closed when it returns,
+// nil when it isn't reading one
+var ingestSource InputSource
+var ingestStopped chan struct{}
+var ingestSource_lock sync.Mutex
+
+// The gRPC servers running, if any
+var grpcIngestServer, grpcSubscribeServer *grpc.Server
+
+var errShuttingDown = errors.New("shutting down")
+
+// shutdown stops taking clients, sends whatever has been read already, tells
+// every client the server is going and stops srv
+func shutdown(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	hub.Shutdown()
+
+	// Stop reading, the workers finish what's queued before fileIn returns
+	stopGRPC(ctx, grpcIngestServer)
+	ingestSource_lock.Lock()
+	src, stopped := ingestSource, ingestStopped
+	ingestSource_lock.Unlock()
+	if src != nil {
+		src.Close()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			log.Printf("Gave up waiting for queued lines to be sent")
+		}
+	}
+
+	// Closing their channels ends every stream, websockets get a close
+	// message on the way
+	hub.Evict(func(string, *client) bool { return true })
+	stopGRPC(ctx, grpcSubscribeServer)
+	done := make(chan struct{})
+	go func() {
+		openSockets.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping the server: %s", err)
+	}
+	if mqttClient != nil {
+		mqttClient.Disconnect(250)
+	}
+}
+
+// stopGRPC lets a gRPC server finish its streams, or stops it outright when
+// ctx ends first
+func stopGRPC(ctx context.Context, s *grpc.Server) {
+	if s == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.Stop()
+	}
+}
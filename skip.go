@@ -0,0 +1,56 @@
+// skip.go
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"sync"
+)
+
+// Lines that couldn't be plotted because something about them was wrong, by
+// reason. Lines dropped on purpose, like filtered ones, are counted elsewhere.
+var linesSkipped = expvar.NewMap("lines_skipped")
+
+// Reasons a line is skipped
+const (
+	skipUnmatched     = "unmatched"
+	skipEmptyIP       = "empty_ip"
+	skipInvalidIP     = "invalid_ip"
+	skipNoDistro      = "no_distro"
+	skipUnknownDistro = "unknown_distro"
+	skipLookup        = "geoip_lookup"
+	skipNoLocation    = "no_location"
+)
+
+// With SKIP_SAMPLES the first few lines skipped for each reason are logged,
+// handy for working out why a log format isn't being understood
+var skipSamples = envInt("SKIP_SAMPLES", 0)
+var skipLogged = make(map[string]int)
+var skipLogged_lock sync.Mutex
+
+func init() {
+	registerHealth("skipped", func() interface{} {
+		return json.RawMessage(linesSkipped.String())
+	})
+}
+
+// skipLine counts a line skipped for reason and passes err back
+func skipLine(reason string, l Line, err error) error {
+	linesSkipped.Add(reason, 1)
+
+	if skipSamples > 0 {
+		skipLogged_lock.Lock()
+		sample := skipLogged[reason] < skipSamples
+		if sample {
+			skipLogged[reason]++
+		}
+		skipLogged_lock.Unlock()
+		if sample {
+			// Errors from GeoIP name the address too
+			log.Printf("Skipped line (%s): %s: %q", reason, redactIPs(err.Error()), redactIPs(l.Text))
+		}
+	}
+
+	return err
+}
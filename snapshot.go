@@ -0,0 +1,124 @@
+// snapshot.go
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clients registered with control=true get a sync message as soon as they
+// connect, with how many events each distro had in the last SYNC_WINDOW, so
+// counters don't start from nothing. Only the SYNC_MAX_DISTROS busiest are
+// sent to keep it small.
+var syncWindow = envDuration("SYNC_WINDOW", 15*time.Minute)
+var syncMaxDistros = envInt("SYNC_MAX_DISTROS", 256)
+
+// recentBucket counts the events of one minute by distro id
+type recentBucket struct {
+	minute int64
+	counts map[int]uint64
+}
+
+// One bucket per minute of SYNC_WINDOW, used as a ring
+var recent []recentBucket
+var recent_lock sync.Mutex
+
+// initSync checks the sync settings
+func initSync() error {
+	if syncWindow < time.Minute {
+		return fmt.Errorf("SYNC_WINDOW must be at least 1m")
+	}
+	if syncMaxDistros < 0 {
+		return fmt.Errorf("SYNC_MAX_DISTROS can't be negative")
+	}
+	recent = make([]recentBucket, int(syncWindow/time.Minute))
+	return nil
+}
+
+// countRecent counts an event for distro and hands out its Seq, together so
+// a sync message knows exactly which events its counts cover. Called with
+// the hub's lock held for writing.
+func countRecent(distro int, now time.Time) uint32 {
+	recent_lock.Lock()
+	defer recent_lock.Unlock()
+	seq := nextSeq.Add(1) - 1
+	if len(recent) == 0 {
+		return seq
+	}
+
+	minute := now.Unix() / 60
+	b := &recent[minute%int64(len(recent))]
+	if b.minute != minute || b.counts == nil {
+		b.minute = minute
+		b.counts = make(map[int]uint64)
+	}
+	b.counts[distro]++
+	return seq
+}
+
+type syncCount struct {
+	ID     int    `json:"id"`
+	Distro string `json:"distro"`
+	Count  uint64 `json:"count"`
+}
+
+// syncData is sent in a sync message. Counts covers the events before Seq,
+// the ones a client gets with a lower Seq are already in it.
+type syncData struct {
+	Seq    uint32      `json:"seq"`
+	Window int         `json:"window"`
+	Counts []syncCount `json:"counts"`
+}
+
+// snapshot builds the data of a sync message, busiest distros first
+func snapshot(now time.Time) syncData {
+	totals := make(map[int]uint64)
+	recent_lock.Lock()
+	seq := nextSeq.Load()
+	minute := now.Unix() / 60
+	for _, b := range recent {
+		if minute-b.minute < int64(len(recent)) {
+			for id, n := range b.counts {
+				totals[id] += n
+			}
+		}
+	}
+	recent_lock.Unlock()
+
+	counts := make([]syncCount, 0, len(totals))
+	for id, n := range totals {
+		counts = append(counts, syncCount{ID: id, Count: n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].ID < counts[j].ID
+	})
+	if len(counts) > syncMaxDistros {
+		counts = counts[:syncMaxDistros]
+	}
+	for i := range counts {
+		counts[i].Distro = distroName(counts[i].ID)
+	}
+	return syncData{Seq: seq, Window: len(recent) * 60, Counts: counts}
+}
+
+// recentRate is about how many events a second there have been over the
+// last minute or so
+func recentRate(now time.Time) float64 {
+	minute := now.Unix() / 60
+	var n uint64
+	recent_lock.Lock()
+	for _, b := range recent {
+		if b.minute == minute || b.minute == minute-1 {
+			for _, count := range b.counts {
+				n += count
+			}
+		}
+	}
+	recent_lock.Unlock()
+	return float64(n) / float64(60+now.Unix()%60)
+}
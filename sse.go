@@ -0,0 +1,117 @@
+// sse.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/thanhpk/randstr"
+)
+
+// Server-sent events for clients that can't get a websocket through, sent a
+// comment every SSE_KEEPALIVE so proxies don't give up on a quiet stream, 0
+// turns it off
+var sseKeepalive = envDuration("SSE_KEEPALIVE", 15*time.Second)
+
+// sseHandler streams events as JSON, registered like a websocket client for
+// as long as the request lasts and taking the same distros, bbox, sample and
+// max_eps options. Each event's id is its Seq, so a client that reconnects
+// with Last-Event-ID is sent what it missed that's still in the history.
+func sseHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", 500)
+		return
+	}
+
+	if !requireAuth(w, r, "") {
+		return
+	}
+	filter, throttle, err := parseSelection(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var last uint64
+	resume := r.Header.Get("Last-Event-ID") != ""
+	if resume {
+		if last, err = strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 32); err != nil {
+			http.Error(w, "Last-Event-ID must be a sequence number", 400)
+			return
+		}
+	}
+
+	id := randstr.Hex(16)
+	c := &client{ch: make(chan message, clientBuffer), format: formatJSON, filter: filter, throttle: throttle}
+	if err := hub.Register(id, c); err != nil {
+		refuseClient(w, err)
+		return
+	}
+	log.Printf("%s connected for server-sent events", id)
+	defer hub.Unregister(id, c)
+
+	var missed []event
+	if resume {
+		hub.Update(func() {
+			missed = historyAfter(filter, uint32(last))
+			// Anything already waiting is in the history too
+			for len(c.ch) > 0 {
+				<-c.ch
+			}
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx holding on to them
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	flusher.Flush()
+	// Each write has writeTimeout, like websockets
+	rc := http.NewResponseController(w)
+
+	var keepalive <-chan time.Time
+	if sseKeepalive > 0 {
+		t := time.NewTicker(sseKeepalive)
+		defer t.Stop()
+		keepalive = t.C
+	}
+	for _, ev := range missed {
+		rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err = writeSSE(w, message{data: encodeJSON(ev), seq: ev.Seq}); err != nil {
+			break
+		}
+	}
+	if err == nil && len(missed) > 0 {
+		err = rc.Flush()
+	}
+	for err == nil {
+		select {
+		case msg, ok := <-c.ch:
+			if !ok {
+				return
+			}
+			rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+			_, err = writeSSE(w, msg)
+		case <-keepalive:
+			rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+	}
+	if timedOut(err) {
+		log.Printf("%s stopped reading, disconnected it", id)
+	}
+}
+
+// writeSSE writes msg as a download event
+func writeSSE(w http.ResponseWriter, msg message) (int, error) {
+	return fmt.Fprintf(w, "id: %d\nevent: download\ndata: %s\n\n", msg.seq, msg.data)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextSSEID reads events from r until one has an id
+func nextSSEID(t *testing.T, r *bufio.Reader) uint32 {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, ok := strings.CutPrefix(strings.TrimSpace(line), "id: "); ok {
+			id, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return uint32(id)
+		}
+	}
+}
+
+func TestSSEResumeWithFilter(t *testing.T) {
+	oldSize := historySize
+	historySize = 10
+	initHistory()
+	nextSeq.Store(100)
+	t.Cleanup(func() {
+		historySize = oldSize
+		initHistory()
+		nextSeq.Store(0)
+	})
+
+	at := func(lat, long float64) {
+		hub.Broadcast(event{Lat: lat, Long: long, Time: time.Now()})
+	}
+	// 100 to 103, the even ones in the box
+	at(1, 1)
+	at(50, 50)
+	at(2, 2)
+	at(50, 50)
+
+	srv := httptest.NewServer(http.HandlerFunc(sseHandler))
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"?bbox=0,0,10,10", nil)
+	req.Header.Set("Last-Event-ID", "100")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	r := bufio.NewReader(resp.Body)
+
+	if id := nextSSEID(t, r); id != 102 {
+		t.Fatalf("resumed with %d, want 102", id)
+	}
+	// 104 and 105 are live
+	at(50, 50)
+	at(3, 3)
+	if id := nextSSEID(t, r); id != 105 {
+		t.Fatalf("got live event %d, want 105", id)
+	}
+}
+
+func TestSSEBadOptions(t *testing.T) {
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/map/events?bbox=1,2,3", nil),
+		httptest.NewRequest("GET", "/map/events?max_eps=fast", nil),
+		httptest.NewRequest("GET", "/map/events", nil),
+	} {
+		if req.URL.RawQuery == "" {
+			req.Header.Set("Last-Event-ID", "abc")
+		}
+		w := httptest.NewRecorder()
+		sseHandler(w, req)
+		if w.Code != 400 {
+			t.Errorf("%s with Last-Event-ID %q got %d, want 400", req.URL, req.Header.Get("Last-Event-ID"), w.Code)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// throttle.go
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// throttle lets events through to a client at no more than rate a second. It's
+// a token bucket with room for one token, so what gets through is spread out
+// evenly instead of coming in bursts with gaps between. Only used with
+// the hub's lock held for writing.
+type throttle struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	// When it started and how many events it's let through since
+	start  time.Time
+	passed uint64
+}
+
+// parseThrottle reads max_eps, nil when it isn't set
+func parseThrottle(s string) (*throttle, error) {
+	if s == "" {
+		return nil, nil
+	}
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return nil, fmt.Errorf("max_eps must be a number of events a second more than 0")
+	}
+	return newThrottle(rate), nil
+}
+
+// newThrottle starts a throttle at rate events a second
+func newThrottle(rate float64) *throttle {
+	now := time.Now()
+	return &throttle{rate: rate, tokens: 1, last: now, start: now}
+}
+
+// allow reports whether an event can go out now. A nil throttle allows
+// everything.
+func (t *throttle) allow(now time.Time) bool {
+	if t == nil {
+		return true
+	}
+	t.tokens = math.Min(1, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	t.passed++
+	return true
+}
+
+// effectiveRate is the events a second let through since it started
+func (t *throttle) effectiveRate(now time.Time) float64 {
+	secs := now.Sub(t.start).Seconds()
+	if secs <= 0 {
+		return 0
+	}
+	return float64(t.passed) / secs
+}
@@ -0,0 +1,95 @@
+// upstream.go
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Spud304/MirrorMap/internal/parse"
+	"github.com/gorilla/websocket"
+)
+
+// Base URL of another instance to mirror, e.g. https://mirror.example.org/map
+var upstreamURL = envString("UPSTREAM_URL", "")
+
+var upstreamState atomic.Value
+
+// upstreamIn connects to another instance as a regular client and rebroadcasts
+// everything it sends, registering again whenever the connection drops
+func upstreamIn() {
+	upstreamState.Store("connecting")
+	registerHealth("upstream", func() interface{} {
+		return upstreamState.Load()
+	})
+	setIngestState("upstream", nil)
+
+	b := newBackoff()
+	for {
+		err := followUpstream(b)
+		upstreamState.Store("disconnected")
+		log.Printf("Lost connection to upstream %s: %s", upstreamURL, err)
+		time.Sleep(b.next())
+	}
+}
+
+// followUpstream registers with the upstream and relays messages until the socket fails
+func followUpstream(b *backoff) error {
+	base := strings.TrimSuffix(upstreamURL, "/")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	// Ask for the full format with wide ids so nothing is lost in the relay
+	resp, err := client.Get(base + "/register?framed=true&wide=true&format=" + formatPlace)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return errors.New("register returned " + resp.Status)
+	}
+	id := strings.TrimSpace(string(body))
+
+	socket, err := url.Parse(base + "/socket/" + id)
+	if err != nil {
+		return err
+	}
+	switch socket.Scheme {
+	case "https":
+		socket.Scheme = "wss"
+	case "http":
+		socket.Scheme = "ws"
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(socket.String(), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	log.Printf("Following upstream %s as %s", upstreamURL, id)
+	upstreamState.Store("connected")
+	b.reset()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		ev, _, err := parse.DecodeFrame(msg)
+		if err != nil {
+			log.Printf("Bad message from upstream: %s", err)
+			continue
+		}
+		hub.Broadcast(ev)
+	}
+}
@@ -0,0 +1,103 @@
+// useragent.go
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// agentClass is the kind of client that made a request, sent to clients as a byte
+type agentClass byte
+
+const (
+	agentUnknown agentClass = iota
+	agentPackageManager
+	agentBrowser
+	agentMirrorSync
+	agentOther
+)
+
+var agentClassNames = map[agentClass]string{
+	agentUnknown:        "unknown",
+	agentPackageManager: "package-manager",
+	agentBrowser:        "browser",
+	agentMirrorSync:     "mirror-sync",
+	agentOther:          "other",
+}
+
+// Lines seen per agent class
+var agentClasses = expvar.NewMap("agent_classes")
+
+// agentRule puts user agents matching re in class
+type agentRule struct {
+	re    *regexp.Regexp
+	class agentClass
+}
+
+// The rules used when UA_CLASS_FILE isn't set, in the same "class regex"
+// format as the file. The first rule that matches wins.
+var defaultAgentRules = `
+package-manager ^(Debian )?APT-|^apt-|libdnf|^dnf/|^yum/|^urlgrabber|pacman/|^zypper|^ZYpp|^apk-tools|^xbps|^emerge|portage|^pkg/|^fetch libfetch|^Homebrew|^Chocolatey|^pip/|^cpan|^R \(|^MSYS2
+mirror-sync ^rsync|^quick-fedora-mirror|^ftpsync|^lftp|^Mirror|mirrorbits|^wget.*mirror
+browser Mozilla/|Opera/
+other .
+`
+
+var agentRules []agentRule
+
+// initAgentRules loads the user agent classes, from UA_CLASS_FILE if it's set
+func initAgentRules() error {
+	rules := defaultAgentRules
+	if path := os.Getenv("UA_CLASS_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rules = string(b)
+	}
+
+	names := make(map[string]agentClass)
+	for class, name := range agentClassNames {
+		names[name] = class
+	}
+
+	agentRules = nil
+	scanner := bufio.NewScanner(strings.NewReader(rules))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, pattern, _ := strings.Cut(line, " ")
+		class, ok := names[name]
+		if !ok {
+			return fmt.Errorf("unknown user agent class %q", name)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			return fmt.Errorf("invalid user agent regex for %s: %s", name, err)
+		}
+		agentRules = append(agentRules, agentRule{re, class})
+	}
+	return nil
+}
+
+// classifyAgent finds the class of a user agent and counts it. Lines without
+// one are unknown.
+func classifyAgent(agent string) agentClass {
+	class := agentUnknown
+	if agent != "" && agent != "-" {
+		for _, r := range agentRules {
+			if r.re.MatchString(agent) {
+				class = r.class
+				break
+			}
+		}
+	}
+	agentClasses.Add(agentClassNames[class], 1)
+	return class
+}
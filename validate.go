@@ -0,0 +1,118 @@
+// validate.go
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Validation settings, given on the command line
+var validatePath string
+var validateLines int
+var validateMin float64
+
+func init() {
+	flag.StringVar(&validatePath, "validate", "", "check a log (or - for stdin) can be understood, print a summary and exit")
+	flag.IntVar(&validateLines, "validate-lines", 1000, "how many lines to check with --validate")
+	flag.Float64Var(&validateMin, "validate-min", 0.9, "fraction of lines that must be understood for --validate to pass")
+}
+
+// How many example events --validate prints
+const validateExamples = 5
+
+// runValidate runs lines from validatePath through everything but the
+// broadcast and prints what happened, returning the exit code
+func runValidate() int {
+	var f io.Reader = os.Stdin
+	if validatePath != "-" {
+		file, err := os.Open(validatePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening %s: %s\n", validatePath, err)
+			return 2
+		}
+		defer file.Close()
+		f = file
+	}
+	r, err := openMaybeGzip(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", validatePath, err)
+		return 2
+	}
+
+	if err := initIngest(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening the GeoIP database: %s\n", err)
+		return 2
+	}
+
+	var read, parsed, filtered int
+	distros := make(map[string]int)
+	var examples []event
+
+	scanner := bufio.NewScanner(r)
+	for read < validateLines && scanner.Scan() {
+		read++
+		ev, ok, err := lineEvent(Line{Text: scanner.Text()})
+		if !ok {
+			if err == nil {
+				filtered++
+			}
+			continue
+		}
+
+		parsed++
+		distros[distroName(ev.Distro)]++
+		if len(examples) < validateExamples {
+			examples = append(examples, ev)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", validatePath, err)
+		return 2
+	}
+
+	skipped := read - parsed - filtered
+	fmt.Printf("Read %d lines: %d parsed, %d filtered out on purpose, %d skipped\n", read, parsed, filtered, skipped)
+
+	if skipped > 0 {
+		fmt.Println("\nSkipped lines by reason:")
+		linesSkipped.Do(func(kv expvar.KeyValue) {
+			fmt.Printf("  %-16s %s\n", kv.Key, kv.Value)
+		})
+	}
+
+	if len(distros) > 0 {
+		names := make([]string, 0, len(distros))
+		for name := range distros {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return distros[names[i]] > distros[names[j]]
+		})
+		fmt.Println("\nDistros seen:")
+		for _, name := range names {
+			fmt.Printf("  %-16s %d\n", name, distros[name])
+		}
+	}
+
+	if len(examples) > 0 {
+		fmt.Println("\nExample events:")
+		for _, ev := range examples {
+			fmt.Printf("  %s (id %d) at %.4f, %.4f, %s, %d bytes, %s\n", distroName(ev.Distro), ev.Distro,
+				ev.Lat, ev.Long, ev.Time.Format(timeLocalLayout), ev.Bytes, agentClassNames[agentClass(ev.Agent)])
+		}
+	}
+
+	// Lines dropped on purpose don't count against the log format
+	considered := read - filtered
+	if considered == 0 || float64(parsed)/float64(considered) < validateMin {
+		fmt.Printf("\nFAIL: less than %.0f%% of lines were understood\n", validateMin*100)
+		return 1
+	}
+	fmt.Println("\nOK")
+	return 0
+}